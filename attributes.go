@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Clients hold custom attributes described by the JSON Schemas an admin
+// defines for their tenant, in two namespaces:
+// - attributes, which users set at registration and update through PATCH /me
+// - app metadata, which only admins with the clients:metadata permission set
+//   (e.g. a subscription plan)
+// Both are returned by /me, and the attributes listed in ATTRIBUTE_CLAIMS (e.g.
+// `department,appMetadata.plan`) are included in tokens.
+
+// appMetadataClaimPrefix prefixes the app metadata listed in ATTRIBUTE_CLAIMS
+const appMetadataClaimPrefix = "appMetadata."
+
+// errAttributesNotObject is returned when the schema of a namespace of custom
+// attributes does not describe an object
+var errAttributesNotObject = errors.New("invalid schema: custom attributes must be an object")
+
+// AttributeSchema describes the schemas of the custom attributes of the
+// clients of a tenant. Attributes are not validated until a schema is defined.
+type AttributeSchema struct {
+	TenantId    string      `bson:"_id" json:"tenantId,omitempty"`
+	Attributes  *JSONSchema `bson:"attributes,omitempty" json:"attributes,omitempty"`
+	AppMetadata *JSONSchema `bson:"appMetadata,omitempty" json:"appMetadata,omitempty"`
+	UpdatedAt   time.Time   `bson:"updatedAt" json:"updatedAt"`
+}
+
+// getAttributeSchemaCollection returns the collection attribute schemas are
+// stored in
+func getAttributeSchemaCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("attributeSchemas")
+}
+
+// getAttributeSchema returns the attribute schemas of a tenant
+func getAttributeSchema(ctx context.Context, clients *mongo.Collection, tenantId string) (*AttributeSchema, error) {
+	schema := &AttributeSchema{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getAttributeSchemaCollection(clients).FindOne(dbCtx, bson.M{"_id": tenantId}).Decode(schema)
+	if err == mongo.ErrNoDocuments {
+		return &AttributeSchema{TenantId: tenantId}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// validateAttributes checks custom attributes against a schema. Attributes are
+// always an object, unset attributes are validated as an empty object so that
+// required attributes are enforced.
+func validateAttributes(schema *JSONSchema, attributes map[string]interface{}) error {
+	if schema == nil {
+		return nil
+	}
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	value, err := normaliseJSON(attributes)
+	if err != nil {
+		return err
+	}
+	return schema.validate(value, "")
+}
+
+// mergeAttributes applies a JSON merge patch (RFC 7386) to the top-level
+// custom attributes: attributes set to null are removed and the others are
+// replaced
+func mergeAttributes(current map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for name, value := range current {
+		merged[name] = value
+	}
+	for name, value := range patch {
+		if value == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// attributeClaims returns the custom attributes of a client included in its
+// tokens as configured by ATTRIBUTE_CLAIMS
+func attributeClaims(client *Client) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for _, name := range attributeClaimNames {
+		var value interface{}
+		var ok bool
+		if strings.HasPrefix(name, appMetadataClaimPrefix) {
+			value, ok = client.AppMetadata[strings.TrimPrefix(name, appMetadataClaimPrefix)]
+		} else {
+			value, ok = client.Attributes[name]
+		}
+		if ok {
+			claims[name] = value
+		}
+	}
+	if len(claims) == 0 {
+		return nil
+	}
+	return claims
+}
+
+// makeGetAttributeSchemaHandler returns the attribute schemas of the tenant of
+// the request, e.g. to render a registration form
+func makeGetAttributeSchemaHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schema, err := getAttributeSchema(c.Request.Context(), clients, requestTenant(c))
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get attribute schema")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"schema": schema})
+	}
+}
+
+// makePutAttributeSchemaHandler replaces the attribute schemas of the tenant of
+// the admin. Existing attributes are not revalidated, they are validated
+// against the new schema the next time they are updated.
+func makePutAttributeSchemaHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form struct {
+			Attributes  json.RawMessage `json:"attributes"`
+			AppMetadata json.RawMessage `json:"appMetadata"`
+		}
+
+		admin, ok := authoriseTenantRequest(c, clients, permSettingsManage)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		schema := &AttributeSchema{TenantId: admin.TenantId, UpdatedAt: time.Now()}
+		for _, namespace := range []struct {
+			data   json.RawMessage
+			schema **JSONSchema
+		}{{form.Attributes, &schema.Attributes}, {form.AppMetadata, &schema.AppMetadata}} {
+			if len(namespace.data) == 0 || string(namespace.data) == "null" {
+				continue
+			}
+			parsed, err := parseJSONSchema(namespace.data)
+			if err == nil && parsed.Type != "" && parsed.Type != "object" {
+				err = errAttributesNotObject
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+			*namespace.schema = parsed
+		}
+
+		opts := options.Replace().SetUpsert(true)
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		_, err := getAttributeSchemaCollection(clients).ReplaceOne(dbCtx, bson.M{"_id": schema.TenantId}, schema, opts)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to update attribute schema")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "update-attribute-schema", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: admin.TenantId})
+		c.JSON(http.StatusOK, gin.H{"schema": schema})
+	}
+}
+
+// makePutAppMetadataHandler replaces the app metadata of a client
+func makePutAppMetadataHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var metadata map[string]interface{}
+
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		target, err := getClientByIdOrEmail(c.Request.Context(), clients, "", c.Param("id"), "")
+		status, admin := authorise(clients, c, claim, permClientsMetadata, target)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Client not found"})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&metadata); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+
+		schema, err := getAttributeSchema(c.Request.Context(), clients, target.TenantId)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get attribute schema")
+			return
+		}
+		if err := validateAttributes(schema.AppMetadata, metadata); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		_, err = clients.UpdateOne(dbCtx, bson.M{"_id": target.Id}, bson.M{"$set": bson.M{"appMetadata": metadata}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to update app metadata")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "update-app-metadata", ActorId: admin.Id.Hex(), TargetId: target.Id.Hex(), Outcome: auditSuccess})
+		c.JSON(http.StatusOK, gin.H{"appMetadata": metadata})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAttributeSchema requires a department and only allows a phone number
+// besides, and restricts the plan in the app metadata
+const testAttributeSchema = `{
+	"attributes": {
+		"type": "object",
+		"properties": {
+			"department": {"type": "string", "enum": ["sales", "engineering"]},
+			"phone": {"type": "string", "pattern": "^\\+[0-9]{6,15}$"}
+		},
+		"required": ["department"],
+		"additionalProperties": false
+	},
+	"appMetadata": {
+		"type": "object",
+		"properties": {"plan": {"type": "string", "enum": ["free", "pro"]}}
+	}
+}`
+
+// loginToTenant logs in to a tenant and returns the token cookie
+func loginToTenant(tenantId string, email string) *http.Cookie {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+email+`", "password": "somePassword"}`))
+	req.Header.Set(tenantHeader, tenantId)
+	handler.ServeHTTP(recorder, req)
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "token" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// createAttributeTenant creates a tenant with the test attribute schema and
+// returns its ID and the token cookie of an admin of the tenant
+func createAttributeTenant(t *testing.T) (string, *http.Cookie) {
+	tenantId := createTestTenant(t, `{}`)
+	email := genRandomEmail()
+	createNewUserClient(context.Background(), clients, tenantId, email, "somePassword", "John", "Smith", []string{"admin"}, nil, nil)
+	admin := loginToTenant(tenantId, email)
+
+	recorder := sendWithCookie("PUT", "/attribute-schema", testAttributeSchema, admin)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	return tenantId, admin
+}
+
+// registerToTenant registers a user with the attributes to a tenant
+func registerToTenant(tenantId string, email string, attributes string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	payload := `{"email": "` + email + `", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": [], "attributes": ` + attributes + `}`
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(payload))
+	req.Header.Set(tenantHeader, tenantId)
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAttributesValidatedAgainstSchema(t *testing.T) {
+	tenantId, _ := createAttributeTenant(t)
+	email := genRandomEmail()
+
+	recorder := registerToTenant(tenantId, email, `{}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"message":"department is required"}`, recorder.Body.String())
+
+	recorder = registerToTenant(tenantId, email, `{"department": "sales"}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	user := loginToTenant(tenantId, email)
+	recorder = sendWithCookie("GET", "/me", "", user)
+	etag := recorder.Header().Get("ETag")
+
+	// Updates are merged into the current attributes before being validated
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/me", strings.NewReader(`{"attributes": {"phone": "12345"}}`))
+	req.AddCookie(user)
+	req.Header.Set("If-Match", etag)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("PATCH", "/me", strings.NewReader(`{"attributes": {"phone": "+4420123456"}}`))
+	req.AddCookie(user)
+	req.Header.Set("If-Match", etag)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response struct {
+		User Client `json:"user"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Equal(t, map[string]interface{}{"department": "sales", "phone": "+4420123456"}, response.User.Attributes)
+}
+
+func TestAppMetadataSetByAdmins(t *testing.T) {
+	attributeClaimNames = []string{"department", "appMetadata.plan"}
+	defer func() { attributeClaimNames = []string{} }()
+
+	tenantId, admin := createAttributeTenant(t)
+	email := genRandomEmail()
+	registerToTenant(tenantId, email, `{"department": "engineering"}`)
+	user, _ := getClientByEmail(context.Background(), clients, tenantId, email)
+
+	// Users cannot set their own app metadata
+	recorder := sendWithCookie("PUT", "/clients/"+user.Id.Hex()+"/app-metadata", `{"plan": "pro"}`, loginToTenant(tenantId, email))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = sendWithCookie("PUT", "/clients/"+user.Id.Hex()+"/app-metadata", `{"plan": "enterprise"}`, admin)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = sendWithCookie("PUT", "/clients/"+user.Id.Hex()+"/app-metadata", `{"plan": "pro"}`, admin)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// The configured attributes are included in tokens
+	claim := &Claim{}
+	jwt.ParseWithClaims(loginToTenant(tenantId, email).Value, claim, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	assert.Equal(t, map[string]interface{}{"department": "engineering", "appMetadata.plan": "pro"}, claim.Attributes)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Security relevant events (registration, login, logout, suspension, deletion)
+// are recorded in an append-only audit log. Every event is numbered and stores
+// the hash of the previous event, and its own hash covers its content and the
+// previous hash. Modifying, removing or reordering any event therefore breaks
+// the chain, which is detected by verifyAuditLog.
+
+// Audit event outcomes
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// Appending an event is retried, with a jittered exponential backoff, for as
+// long as events appended concurrently by other instances claim its sequence
+// number, up to auditAppendTimeout
+const (
+	auditRetryBaseDelay = 5 * time.Millisecond
+	auditRetryMaxDelay  = 250 * time.Millisecond
+	auditAppendTimeout  = 30 * time.Second
+)
+
+// auditQueueSize is the number of events waiting to be appended beyond which
+// new events are dropped rather than holding up the requests recording them
+const auditQueueSize = 1024
+
+// queuedAuditEvent is an event waiting to be appended to the audit log of the
+// client collection
+type queuedAuditEvent struct {
+	clients *mongo.Collection
+	event   *AuditEvent
+}
+
+// Events are recorded by requests onto auditQueue and appended one at a time by
+// runAuditWorker, so that requests neither wait on the audit log nor contend
+// with each other for its sequence numbers. auditPending counts the events that
+// have been queued but not appended yet.
+var (
+	auditQueue   = make(chan queuedAuditEvent, auditQueueSize)
+	auditPending sync.WaitGroup
+)
+
+// Default and maximum number of events returned by the audit query endpoints
+const (
+	auditDefaultLimit = 50
+	auditMaxLimit     = 500
+)
+
+// AuditEvent describes a security relevant event. The sequence number is used as
+// the document ID so that two events can never claim the same position in the
+// chain.
+type AuditEvent struct {
+	Seq       int64     `bson:"_id" json:"seq"`
+	Time      time.Time `bson:"time" json:"time"`
+	Action    string    `bson:"action" json:"action"`
+	ActorId   string    `bson:"actorId,omitempty" json:"actorId,omitempty"`
+	TargetId  string    `bson:"targetId,omitempty" json:"targetId,omitempty"`
+	IP        string    `bson:"ip" json:"ip"`
+	UserAgent string    `bson:"userAgent" json:"userAgent"`
+	Outcome   string    `bson:"outcome" json:"outcome"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	PrevHash  string    `bson:"prevHash" json:"prevHash"`
+	Hash      string    `bson:"hash" json:"hash"`
+}
+
+// getAuditCollection returns the collection audit events are stored in
+func getAuditCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("auditLog")
+}
+
+// auditEventHash computes the hash of an event from its content and the hash
+// of the previous event. The time is hashed with millisecond precision as that
+// is the precision it is stored with.
+func auditEventHash(event *AuditEvent) string {
+	content, _ := json.Marshal([]interface{}{
+		event.Seq, event.Time.UnixMilli(), event.Action, event.ActorId, event.TargetId,
+		event.IP, event.UserAgent, event.Outcome, event.Reason, event.PrevHash,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAuditEvent chains the event to the last event of the audit log and
+// appends it. If another event claimed the same sequence number in the meantime
+// the event is chained to the new last event and appended again until it
+// succeeds or the context is done.
+func appendAuditEvent(ctx context.Context, clients *mongo.Collection, event *AuditEvent) error {
+	auditLog := getAuditCollection(clients)
+	for attempt := 1; ; attempt++ {
+		last := &AuditEvent{}
+		opts := options.FindOne().SetSort(bson.M{"_id": -1})
+		dbCtx, cancel := dbContext(ctx)
+		err := auditLog.FindOne(dbCtx, bson.M{}, opts).Decode(last)
+		cancel()
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		event.Seq = last.Seq + 1
+		event.PrevHash = last.Hash
+		event.Hash = auditEventHash(event)
+
+		dbCtx, cancel = dbContext(ctx)
+		_, err = auditLog.InsertOne(dbCtx, event)
+		cancel()
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+
+		// Spread the retries of concurrent appends
+		delay := exponentialBackoff(auditRetryBaseDelay, auditRetryMaxDelay, attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))):
+		}
+	}
+}
+
+// recordAudit queues an event of the request to be appended to the audit log,
+// filling in the time and the IP and user agent of the caller. The event is
+// appended even if the caller disconnects. Failing to record an event is logged
+// but does not fail the request.
+func recordAudit(clients *mongo.Collection, c *gin.Context, event AuditEvent) {
+	event.Time = time.Now().UTC().Truncate(time.Millisecond)
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	auditPending.Add(1)
+	select {
+	case auditQueue <- queuedAuditEvent{clients: clients, event: &event}:
+	default:
+		auditPending.Done()
+		log.Println("Unable to record audit event, the audit queue is full: " + event.Action)
+	}
+}
+
+// runAuditWorker appends the queued audit events in order. This is a blocking
+// call and is expected to be run in its own goroutine.
+func runAuditWorker() {
+	for queued := range auditQueue {
+		ctx, cancel := context.WithTimeout(context.Background(), auditAppendTimeout)
+		if err := appendAuditEvent(ctx, queued.clients, queued.event); err != nil {
+			log.Println("Unable to record audit event: ", err)
+		}
+		cancel()
+		auditPending.Done()
+	}
+}
+
+// waitForAuditEvents waits until every queued audit event has been appended
+func waitForAuditEvents() {
+	auditPending.Wait()
+}
+
+// findAuditEvents returns the events matching the filter, most recent first
+func findAuditEvents(ctx context.Context, clients *mongo.Collection, filter bson.M, limit int64) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit)
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getAuditCollection(clients).Find(dbCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &events)
+	return events, err
+}
+
+// getClientActivity returns the most recent events the client was the actor or
+// target of
+func getClientActivity(ctx context.Context, clients *mongo.Collection, clientId string, limit int64) ([]AuditEvent, error) {
+	filter := bson.M{"$or": []bson.M{{"actorId": clientId}, {"targetId": clientId}}}
+	return findAuditEvents(ctx, clients, filter, limit)
+}
+
+// verifyAuditLog walks the audit log in order and checks every event is chained
+// to the previous one and has not been modified. It returns the number of
+// events checked and the sequence number of the first invalid event, or 0 if
+// the whole chain is valid. As the whole log is read, every batch of events is
+// given DB_TIMEOUT_MS to be read rather than the whole walk.
+func verifyAuditLog(ctx context.Context, clients *mongo.Collection) (int64, int64, error) {
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	dbCtx, cancel := dbContext(ctx)
+	cursor, err := getAuditCollection(clients).Find(dbCtx, bson.M{}, opts)
+	cancel()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	next := func() bool {
+		dbCtx, cancel := dbContext(ctx)
+		defer cancel()
+		return cursor.Next(dbCtx)
+	}
+
+	var checked int64
+	prev := &AuditEvent{}
+	for next() {
+		event := &AuditEvent{}
+		if err := cursor.Decode(event); err != nil {
+			return checked, 0, err
+		}
+		checked++
+		if event.Seq != prev.Seq+1 || event.PrevHash != prev.Hash || event.Hash != auditEventHash(event) {
+			return checked, event.Seq, nil
+		}
+		prev = event
+	}
+	return checked, 0, cursor.Err()
+}
+
+// auditLimit parses the limit query parameter of the audit query endpoints
+func auditLimit(c *gin.Context) int64 {
+	limit, err := strconv.ParseInt(c.Query("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		return auditDefaultLimit
+	}
+	if limit > auditMaxLimit {
+		return auditMaxLimit
+	}
+	return limit
+}
+
+// makeAuditQueryHandler is an admin only handler querying the audit log. Events
+// can be filtered by actor, target, action and outcome.
+func makeAuditQueryHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permAuditRead, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		filter := bson.M{}
+		for _, field := range []string{"actorId", "targetId", "action", "outcome"} {
+			if value := c.Query(field); value != "" {
+				filter[field] = value
+			}
+		}
+
+		events, err := findAuditEvents(c.Request.Context(), clients, filter, auditLimit(c))
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to query audit log")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"events": events})
+	}
+}
+
+// makeAuditVerifyHandler is an admin only handler checking the integrity of the
+// audit log hash chain
+func makeAuditVerifyHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permAuditRead, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		checked, invalid, err := verifyAuditLog(c.Request.Context(), clients)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to verify audit log")
+			return
+		}
+
+		if invalid != 0 {
+			c.JSON(http.StatusOK, gin.H{"valid": false, "checked": checked, "firstInvalidSeq": invalid})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"valid": true, "checked": checked})
+	}
+}
+
+// makeActivityHandler returns the recent activity of the authenticated client
+func makeActivityHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		events, err := getClientActivity(c.Request.Context(), clients, client.Id.Hex(), auditLimit(c))
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get activity")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"events": events})
+	}
+}
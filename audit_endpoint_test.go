@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFailedLoginIsAudited(t *testing.T) {
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+	cookie := registerAndLogin(email, user)
+
+	// Attempt to log in with the wrong password
+	recorder := httptest.NewRecorder()
+	login := `{"email": "` + email + `", "password": "someOtherPassword"}`
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(login))
+	req.Header.Set("User-Agent", "audit-test")
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// The user can see the failed login in their recent activity once appended
+	waitForAuditEvents()
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/me/activity", nil)
+	req.AddCookie(cookie)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var body struct {
+		Events []AuditEvent `json:"events"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	// Most recent first: the failed login, the successful login and the registration
+	assert.Len(t, body.Events, 3)
+	assert.Equal(t, "login", body.Events[0].Action)
+	assert.Equal(t, auditFailure, body.Events[0].Outcome)
+	assert.Equal(t, "incorrect password", body.Events[0].Reason)
+	assert.Equal(t, "audit-test", body.Events[0].UserAgent)
+	assert.Equal(t, "register-user", body.Events[2].Action)
+}
+
+func TestAuditLogTamperingIsDetected(t *testing.T) {
+	// Create an admin user
+	adminHashedPass, _ := hashAndSalt("somePassword")
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: genRandomEmail()},
+		{Key: "hashedPassword", Value: adminHashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: []string{"admin"}},
+	})
+	adminToken := issueTestToken(t, result.InsertedID.(primitive.ObjectID).Hex())
+
+	verify := func() string {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/audit/verify", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+		handler.ServeHTTP(recorder, req)
+		return recorder.Body.String()
+	}
+
+	// Make sure there is at least one event in the audit log
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+genRandomEmail()+`", "password": "somePassword"}`))
+	handler.ServeHTTP(recorder, req)
+	waitForAuditEvents()
+
+	assert.Contains(t, verify(), `"valid":true`)
+
+	// Rewrite the reason of the most recent event
+	auditLog := getAuditCollection(clients)
+	events, _ := findAuditEvents(context.Background(), clients, bson.M{}, 1)
+	last := events[0]
+	auditLog.UpdateOne(context.Background(), bson.M{"_id": last.Seq}, bson.M{"$set": bson.M{"reason": "tampered"}})
+
+	assert.Contains(t, verify(), `"valid":false`)
+
+	// Restore the original event so the chain is valid again
+	auditLog.UpdateOne(context.Background(), bson.M{"_id": last.Seq}, bson.M{"$set": bson.M{"reason": last.Reason}})
+	assert.Contains(t, verify(), `"valid":true`)
+}
+
+func TestConcurrentAuditEventsAreAllAppended(t *testing.T) {
+	const appends = 50
+	targetId := primitive.NewObjectID().Hex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			event := &AuditEvent{Time: time.Now().UTC().Truncate(time.Millisecond), Action: "login", TargetId: targetId, Outcome: auditSuccess}
+			assert.NoError(t, appendAuditEvent(context.Background(), clients, event))
+		}()
+	}
+	wg.Wait()
+
+	// No event is lost and the chain is still valid
+	count, _ := getAuditCollection(clients).CountDocuments(context.Background(), bson.M{"targetId": targetId})
+	assert.Equal(t, int64(appends), count)
+
+	_, invalid, err := verifyAuditLog(context.Background(), clients)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), invalid)
+}
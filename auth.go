@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -17,6 +19,32 @@ import (
 type Claim struct {
 	Id     string   `json:"id"`
 	Groups []string `json:"groups"`
+
+	// Kind is the kind of the client (see kinds.go)
+	Kind string `json:"kind,omitempty"`
+
+	// Permissions are only included when configured by TOKEN_CLAIMS (see
+	// permissions.go)
+	Permissions []string `json:"permissions,omitempty"`
+
+	// Purpose is set on single purpose tokens (e.g. account restoration links)
+	// which must never be accepted as an authentication token
+	Purpose string `json:"purpose,omitempty"`
+
+	// Version is the token version of the client the token was issued for.
+	// Tokens issued before the version was incremented are rejected.
+	Version int `json:"ver,omitempty"`
+
+	// TenantId is the tenant of the client, unset for the default tenant
+	TenantId string `json:"tenant,omitempty"`
+
+	// Attributes are the custom attributes of the client listed in
+	// ATTRIBUTE_CLAIMS (see attributes.go)
+	Attributes map[string]interface{} `json:"attrs,omitempty"`
+
+	// Nonce is the hash of the nonce of the browser a login link was requested
+	// from (see magicLink.go)
+	Nonce string `json:"nonce,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -48,33 +76,66 @@ func processClaim(token string) (int, *Claim) {
 		}
 		return http.StatusBadRequest, nil
 	}
-	if !tkn.Valid {
+	if !tkn.Valid || claim.Purpose != "" {
 		return http.StatusUnauthorized, nil
 	}
 
 	return http.StatusOK, claim
 }
 
-func authenticate(users *mongo.Collection, claim *Claim) (int, *Client) {
+// genPurposeToken generates a signed token for the client that can only be
+// used for the given purpose and expires at the given time
+func genPurposeToken(id string, purpose string, expiresAt time.Time) (string, error) {
+	claims := &Claim{
+		Id:      id,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+// processPurposeToken parses a token generated by genPurposeToken and checks it
+// was issued for the given purpose
+func processPurposeToken(token string, purpose string) (*Claim, bool) {
+	claim := &Claim{}
+	tkn, err := jwt.ParseWithClaims(token, claim, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	if err != nil || !tkn.Valid || claim.Purpose != purpose {
+		return nil, false
+	}
+	return claim, true
+}
+
+func authenticate(ctx context.Context, users *mongo.Collection, claim *Claim) (int, *Client) {
 	user := &Client{}
 
 	// Get user by the ID in the token claim payload
 	objID, _ := primitive.ObjectIDFromHex(claim.Id)
-	value := users.FindOne(context.Background(), bson.M{"_id": objID}).Decode(user)
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	value := users.FindOne(dbCtx, bson.M{"_id": objID}).Decode(user)
+	if value != nil && value != mongo.ErrNoDocuments {
+		return storageErrorStatus(value), nil
+	}
 
 	// Check user if user can be authenticated
-	if value == mongo.ErrNoDocuments {
+	if value == mongo.ErrNoDocuments || user.TokenVersion != claim.Version || user.TenantId != claim.TenantId {
 		return http.StatusUnauthorized, user
 	} else {
+		upgradeClient(ctx, users, user)
 		return http.StatusOK, user
 	}
 }
 
-func authAndAuthorised(users *mongo.Collection, claim *Claim) (int, *Client) {
-	code, user := authenticate(users, claim)
+func authAndAuthorised(ctx context.Context, users *mongo.Collection, claim *Claim) (int, *Client) {
+	code, user := authenticate(ctx, users, claim)
 	switch code {
 	case http.StatusOK:
-		if user.Suspended {
+		if user.Suspended || user.DeletionState != "" {
 			return http.StatusUnauthorized, nil
 		} else {
 			return http.StatusOK, user
@@ -84,59 +145,50 @@ func authAndAuthorised(users *mongo.Collection, claim *Claim) (int, *Client) {
 	}
 }
 
-func authAndAuthorisedAdmin(users *mongo.Collection, claim *Claim) (int, *Client) {
-	code, user := authAndAuthorised(users, claim)
-	switch code {
-	case http.StatusOK:
-		// If user group contains "admin" then they are authorised
-		for _, group := range user.Groups {
-			if group == "admin" {
-				return http.StatusOK, user
-			}
+// inGroup checks if a client is a member of the given group
+func inGroup(client *Client, group string) bool {
+	return contains(client.Groups, group)
+}
+
+// contains checks if a slice of strings contains the given value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
-		return http.StatusUnauthorized, nil
-	default:
-		return code, nil
 	}
+	return false
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header.
+// Service clients present their API token this way as they have no cookie.
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
 }
 
 // Needs to be a jwt token so that the API gateway can verify it
-func generateAPIClientToken(client *Client) (string, error) {
+func generateAPIClientToken(ctx context.Context, clients *mongo.Collection, client *Client) (string, error) {
 	// Create the JWT claims, which includes the user ID with no expiration time
+	// unless the kind of the client has a token lifetime (e.g. devices)
 	claims := &Claim{
 		Id:               client.Id.Hex(),
-		Groups:           client.Groups,
+		Version:          client.TokenVersion,
+		TenantId:         client.TenantId,
 		RegisteredClaims: jwt.RegisteredClaims{},
 	}
+	if kind := clientKinds[clientKind(client)]; !kind.PersistentToken && kind.TokenLifetime > 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(kind.TokenLifetime))
+	}
+	if err := setClaimGroups(ctx, clients, client, claims); err != nil {
+		return "", err
+	}
 
 	// Create the JWT token
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenStr, err := token.SignedString(jwtKey)
 	return tokenStr, err
 }
-
-func genToken(id string, groups []string) (string, error) {
-	// Declare the expiration time of the token as determined by the jwtTokenExpiration variable
-	expirationTime := time.Now().Add(jwtTokenExpiration)
-
-	// Create the JWT claims, which includes the authenticated user ID and expiry time
-	claims := &Claim{
-		Id:     id,
-		Groups: groups,
-		RegisteredClaims: jwt.RegisteredClaims{
-			// In JWT, the expiry time is expressed as unix milliseconds
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
-	}
-
-	// Create the token with the HS256 algorithm used for signing, and the created claim
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Create the JWT string
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		// If there is an error in creating the JWT return an internal server error
-		return "", err
-	}
-	return tokenString, nil
-}
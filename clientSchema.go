@@ -1,22 +1,90 @@
 package main
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // At a bare minimum any authenticated client (including people/users, services,
 // and bots) must have an email address and a hashed password.
 
 type Client struct {
 	// Required fields for all clients
-	Id        primitive.ObjectID `bson:"_id," json:"-"`
+	Id        primitive.ObjectID `bson:"_id" json:"-"`
 	Email     string             `bson:"email" json:"email"`
 	Suspended bool               `bson:"suspended" json:"-"`
 	Groups    []string           `bson:"groups" json:"groups"`
 
-	// If the client is a person, then the following fields are required
-	FirstName      string `bson:"firstName, omitempty" json:"firstName"`
-	LastName       string `bson:"lastName, omitempty" json:"lastName"`
-	HashedPassword string `bson:"hashedPassword, omitempty" json:"-"`
+	// The email address as the client typed it, unset if it is the normalised
+	// email address (see email.go)
+	DisplayEmail string `bson:"displayEmail,omitempty" json:"displayEmail,omitempty"`
+
+	// The kind of client (user, service, device or bot), which defines the
+	// fields it must have and how it authenticates (see kinds.go)
+	Kind string `bson:"kind,omitempty" json:"kind"`
+
+	// The schema version the document was written with (see migrations.go)
+	SchemaVersion int `bson:"schemaVersion" json:"-"`
+
+	// Incremented on every write to the fields of the profile, whoever makes
+	// it, so that updates based on a stale profile are detected (see me.go)
+	Version int `bson:"version" json:"version"`
+
+	// The ID of the client in the provisioning system (see scim.go)
+	ExternalId string `bson:"externalId,omitempty" json:"-"`
+
+	// The tenant the client belongs to, unset for the default tenant (see
+	// tenants.go)
+	TenantId string `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
+
+	// Set while the client is scheduled for deletion or being deleted (see
+	// deletionJob.go)
+	DeletionState string     `bson:"deletionState,omitempty" json:"-"`
+	DeleteAfter   *time.Time `bson:"deleteAfter,omitempty" json:"-"`
+
+	// Custom attributes described by the attribute schema of the tenant, set
+	// by the client and by admins respectively (see attributes.go)
+	Attributes  map[string]interface{} `bson:"attributes,omitempty" json:"attributes,omitempty"`
+	AppMetadata map[string]interface{} `bson:"appMetadata,omitempty" json:"appMetadata,omitempty"`
+
+	// Consents given by the client (e.g. to terms of service or marketing)
+	Consents []Consent `bson:"consents,omitempty" json:"consents,omitempty"`
+
+	// Fields of users (see kinds.go)
+	FirstName string `bson:"firstName,omitempty" json:"firstName"`
+	LastName  string `bson:"lastName,omitempty" json:"lastName"`
+	// Clients registered before login methods were recorded as identities hold
+	// their password hash here until it is migrated (see identities.go)
+	HashedPassword string `bson:"hashedPassword,omitempty" json:"-"`
+
+	// Fields of services, devices and bots (see kinds.go)
+	Name string `bson:"name,omitempty" json:"name"`
+
+	// A service is owned by the user that registered it and optionally by a
+	// team, which is a group whose members can all manage the service (see
+	// services.go)
+	OwnerId   *primitive.ObjectID `bson:"ownerId,omitempty" json:"ownerId,omitempty"`
+	OwnerTeam string              `bson:"ownerTeam,omitempty" json:"ownerTeam,omitempty"`
+
+	// Temporary group memberships, removed from Groups once they expire (see
+	// groupRequests.go)
+	GroupGrants []GroupGrant `bson:"groupGrants,omitempty" json:"groupGrants,omitempty"`
+
+	// TokenVersion is incremented to invalidate every token issued to the
+	// client, e.g. when a service token is rotated
+	TokenVersion int `bson:"tokenVersion,omitempty" json:"-"`
+}
+
+// GroupGrant records that a client is a member of a group until the expiry time
+type GroupGrant struct {
+	Group     string    `bson:"group" json:"group"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
 
-	// If the client is a service, then the following fields are required
-	Name string `bson:"name, omitempty" json:"name"`
+// Consent records that a client agreed to a purpose (e.g. "terms" or
+// "marketing") and when
+type Consent struct {
+	Purpose   string    `bson:"purpose" json:"purpose"`
+	GrantedAt time.Time `bson:"grantedAt" json:"grantedAt"`
 }
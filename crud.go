@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -20,61 +22,165 @@ func hashAndSalt(pwd string) (string, error) {
 	return string(hash), nil
 }
 
-func createNewUserClient(clients *mongo.Collection, email string, password string, firstName string, lastName string, groups []string) error {
-	// Hash user password before storing in database
-	hashedPassword, err := hashAndSalt(password)
-	if err != nil {
-		return err
+// errEmailTaken is returned when an email address is already registered in the
+// tenant
+var errEmailTaken = errors.New("email address already registered")
+
+// emailTakenError maps the duplicate key error of the unique email index (see
+// indexes.go) to errEmailTaken
+func emailTakenError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return errEmailTaken
+	}
+	return err
+}
+
+func createNewUserClient(ctx context.Context, clients *mongo.Collection, tenantId string, email string, password string, firstName string, lastName string, groups []string, consents []string, attributes map[string]interface{}) (*Client, error) {
+	// Record when each consent was given
+	now := time.Now()
+	userConsents := []Consent{}
+	for _, purpose := range consents {
+		userConsents = append(userConsents, Consent{Purpose: purpose, GrantedAt: now})
 	}
 
 	// Create user
 	user := &Client{
-		Id:             primitive.NewObjectID(),
-		Email:          email,
-		FirstName:      firstName,
-		LastName:       lastName,
-		HashedPassword: hashedPassword,
-		Suspended:      false,
-		Groups:         groups,
+		Id:            primitive.NewObjectID(),
+		Kind:          kindUser,
+		SchemaVersion: currentSchemaVersion,
+		Email:         normaliseEmail(email),
+		DisplayEmail:  displayEmail(email),
+		TenantId:      tenantId,
+		FirstName:     firstName,
+		LastName:      lastName,
+		Suspended:     false,
+		Groups:        groups,
+		Consents:      userConsents,
+		Attributes:    attributes,
 	}
 
-	// Insert user into database
-	_, err = clients.InsertOne(context.Background(), user)
-	if err != nil {
-		return err
+	if err := validateClient(user); err != nil {
+		return nil, err
 	}
-	return nil
+
+	// The password is the first login method of the user. Users signing in
+	// through an identity provider have no password. It is hashed before the
+	// user is inserted so that a password that cannot be hashed leaves no user
+	// behind.
+	var hashedPassword string
+	if password != "" {
+		var err error
+		if hashedPassword, err = hashAndSalt(password); err != nil {
+			return nil, err
+		}
+	}
+
+	// Insert user into database, the unique email index rejecting concurrent
+	// registrations with the same email address
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if _, err := clients.InsertOne(dbCtx, user); err != nil {
+		return nil, emailTakenError(err)
+	}
+
+	if password != "" {
+		if err := linkIdentity(ctx, clients, user, &Identity{Method: identityPassword, SecretHash: hashedPassword}); err != nil {
+			// A user left without its password could never log in and would
+			// hold on to its email address, so it is removed even if the
+			// request was cancelled or timed out
+			rollbackCtx, cancelRollback := dbContext(context.Background())
+			defer cancelRollback()
+			if _, rollbackErr := clients.DeleteOne(rollbackCtx, bson.M{"_id": user.Id}); rollbackErr != nil {
+				log.Println("Unable to remove client "+user.Id.Hex()+": ", rollbackErr)
+			}
+			return nil, err
+		}
+	}
+	return user, nil
 }
 
-func createNewServiceClient(clients *mongo.Collection, email string, name string, groups []string) (*Client, error) {
-	groups = append(groups, "service")
+// createNewServiceClient creates a service owned by a user and optionally a team
+func createNewServiceClient(ctx context.Context, clients *mongo.Collection, tenantId string, email string, name string, groups []string, ownerId primitive.ObjectID, team string) (*Client, error) {
+	return createNewMachineClient(ctx, clients, tenantId, kindService, email, name, groups, ownerId, team)
+}
 
-	// Create service
+// createNewMachineClient creates a service, device or bot owned by a user and
+// optionally a team. Services are also members of the "service" group.
+func createNewMachineClient(ctx context.Context, clients *mongo.Collection, tenantId string, kind string, email string, name string, groups []string, ownerId primitive.ObjectID, team string) (*Client, error) {
+	if kind == kindService {
+		groups = append(groups, "service")
+	}
+
+	// Create the client
 	service := &Client{
-		Id:        primitive.NewObjectID(),
-		Email:     email,
-		Name:      name,
-		Suspended: false,
-		Groups:    groups,
+		Id:            primitive.NewObjectID(),
+		Kind:          kind,
+		SchemaVersion: currentSchemaVersion,
+		Email:         normaliseEmail(email),
+		DisplayEmail:  displayEmail(email),
+		TenantId:      tenantId,
+		Name:          name,
+		Suspended:     false,
+		Groups:        groups,
+		OwnerId:       &ownerId,
+		OwnerTeam:     team,
+	}
+	if err := validateClient(service); err != nil {
+		return nil, err
 	}
 
 	// Insert service into database
-	_, err := clients.InsertOne(context.Background(), service)
-	return service, err
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if _, err := clients.InsertOne(dbCtx, service); err != nil {
+		return nil, emailTakenError(err)
+	}
+	return service, nil
 }
 
-func getClientByEmail(clients *mongo.Collection, email string) (*Client, error) {
-	filter := bson.D{{Key: "email", Value: email}}
+// getClientByEmail returns the client of a tenant with the email address, in
+// any form normalising to the same address
+func getClientByEmail(ctx context.Context, clients *mongo.Collection, tenantId string, email string) (*Client, error) {
+	filter := tenantFilter(tenantId)
+	filter["email"] = emailFilter(email)
 	client := &Client{}
-	err := clients.FindOne(context.Background(), filter).Decode(client)
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := clients.FindOne(dbCtx, filter).Decode(client)
 	if err != nil {
 		return nil, err
 	}
+	upgradeClient(ctx, clients, client)
 	return client, nil
 }
 
-func clientExists(clients *mongo.Collection, email string) bool {
-	filter := bson.D{{Key: "email", Value: email}}
-	err := clients.FindOne(context.Background(), filter).Err()
+// clientExists checks if a client of a tenant has the email address, in any
+// form normalising to the same address
+func clientExists(ctx context.Context, clients *mongo.Collection, tenantId string, email string) bool {
+	filter := tenantFilter(tenantId)
+	filter["email"] = emailFilter(email)
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := clients.FindOne(dbCtx, filter).Err()
 	return err == nil
 }
+
+// getClientByIdOrEmail returns a client by its hex ID or, if no ID is given, by
+// its email address in the tenant
+func getClientByIdOrEmail(ctx context.Context, clients *mongo.Collection, tenantId string, id string, email string) (*Client, error) {
+	if id == "" {
+		return getClientByEmail(ctx, clients, tenantId, email)
+	}
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	client := &Client{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err = clients.FindOne(dbCtx, bson.M{"_id": objID}).Decode(client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
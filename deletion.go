@@ -7,19 +7,39 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
 	"github.com/go-redis/redis/v8"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// BUG: User deletion logic and testing incomplete
-// TODO: Document user deletion mechanism
+// restorePurpose is the purpose of the tokens used to restore a client scheduled for deletion
+const restorePurpose = "restore"
+
+// RestoreForm describes the expected JSON payload when a user restores their account
+type RestoreForm struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// DeleteClientForm describes the expected JSON payload when an admin deletes a
+// client. The client is identified by either its ID or email address.
+type DeleteClientForm struct {
+	Id     string `json:"id" validate:"required_without=Email"`
+	Email  string `json:"email" validate:"omitempty,email"`
+	Reason string `json:"reason" validate:"required"`
+}
+
+// RestoreClientForm describes the expected JSON payload when an admin restores a client
+type RestoreClientForm struct {
+	Id string `json:"id" validate:"required"`
+}
 
 // DO NOT DELETE USERS DIRECTLY FROM THE DATABASE. INSTEAD, USE THE DELETE USER HANDLER (NEEDS TO TRICKLE DOWN TO ALL SERVICES)
-// deleteUser handler enables users to request for their data to be deleted. This communicates with the API Gateway
-// through a pubsub 'user-delete' channel. The API Gateway will then communicate with each of the services that
-// required authentication, so they can handle deletion of the user data they contain.
+// deleteUser handler enables users to request for their data to be deleted. The deletion is scheduled for the end of
+// the grace period, during which the restore link emailed to the user can be used to restore the account. Once the grace period
+// elapses a deletion job (see deletionJob.go) publishes a deletion event on the 'user-delete' Redis stream. Each
+// participating service deletes the user data it contains and acknowledges the job, after which the user record is
+// purged.
 func makeDeleteUserHandler(users *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get the JWT token from cookie
@@ -30,31 +50,335 @@ func makeDeleteUserHandler(users *mongo.Collection, rdb *redis.Client) gin.Handl
 			return
 		}
 
-		status, user := authAndAuthorised(users, claim)
-
-		// TODO: Have some feedback system to deal with failed user deletion job requests
-		// Make user deletion request to API Gateway requiring each authenticated service to delete user data
-		if status == http.StatusOK {
-			// Send delete signal to other Gateway (each authenticated service will deal with delete it its own way)
-			// Gateway will listen to this channel and ask each service to delete user data
-			if err := rdb.Publish(context.Background(), "user-delete", user.Id.Hex()).Err(); err != nil {
-				log.Println("Unable to publish to Redis: ", err)
-			}
-		} else {
+		status, user := authAndAuthorised(c.Request.Context(), users, claim)
+		if status != http.StatusOK {
 			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
 			return
 		}
 
 		// Add ID to blacklist until token expires
-		if err := rdb.Set(context.Background(), claim.Id, claim.Id, time.Until(claim.ExpiresAt.Time)).Err(); err != nil {
+		cacheCtx, cancel := cacheContext(c.Request.Context())
+		defer cancel()
+		if err := rdb.Set(cacheCtx, claim.Id, claim.Id, blacklistDuration(claim)).Err(); err != nil {
 			log.Println("Unable to set Redis key: ", err)
 		}
 
+		// Without a grace period the deletion job starts straight away
+		if deletionGracePeriod <= 0 {
+			job, err := startDeletionJob(c.Request.Context(), users, rdb, user, user.Id, "")
+			if err != nil {
+				abortWithStorageError(c, err, "Unable to delete user")
+				return
+			}
+			recordAudit(users, c, AuditEvent{Action: "delete", ActorId: user.Id.Hex(), TargetId: user.Id.Hex(), Outcome: auditSuccess})
+			c.JSON(http.StatusAccepted, gin.H{"message": "User deletion requested", "jobId": job.Id.Hex()})
+			return
+		}
+
+		deleteAfter, err := scheduleDeletion(c.Request.Context(), users, user)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete user")
+			return
+		}
+
+		// The restore link is only sent to the email address of the user, the
+		// deletion is not scheduled without it
+		restoreToken, err := genPurposeToken(user.Id.Hex(), restorePurpose, deleteAfter)
+		if err == nil {
+			err = mailer.Send(user.Email, "Your account is scheduled for deletion",
+				"Your account will be deleted after "+deleteAfter.Format(time.RFC1123)+
+					". Until then you can follow the link below to restore it.\r\n\r\n"+
+					restoreLinkUrl+"?token="+restoreToken)
+		}
+		if err != nil {
+			log.Println("Unable to send restore link: ", err)
+			if err := restoreClient(c.Request.Context(), users, rdb, user.Id, &deleteAfter); err != nil {
+				log.Println("Unable to cancel the deletion of client "+user.Id.Hex()+": ", err)
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to send restore link"})
+			return
+		}
+		recordAudit(users, c, AuditEvent{Action: "delete", ActorId: user.Id.Hex(), TargetId: user.Id.Hex(), Outcome: auditSuccess, Reason: "scheduled"})
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "User deletion scheduled", "deleteAfter": deleteAfter})
+	}
+}
+
+// makeDeleteClientHandler is an admin only handler deleting any user or service
+// client. Unlike self-service deletion there is no grace period, the deletion
+// job starts straight away and records the admin and the reason given.
+func makeDeleteClientHandler(clients *mongo.Collection, rdb *redis.Client, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form DeleteClientForm
+
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		// Authorization policies may depend on the client being deleted
+		client, err := getClientByIdOrEmail(c.Request.Context(), clients, claim.TenantId, form.Id, form.Email)
+		status, admin := authorise(clients, c, claim, permClientsDelete, client)
+		if status != http.StatusOK {
+			recordAudit(clients, c, AuditEvent{Action: "delete-client", ActorId: claim.Id, Outcome: auditFailure, Reason: "not authorised"})
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Client not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get client")
+			return
+		}
+
+		blacklistClient(c.Request.Context(), rdb, client)
+
+		job, err := startDeletionJob(c.Request.Context(), clients, rdb, client, admin.Id, form.Reason)
+		if err == errDeletionInProgress {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "Client deletion already in progress"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete client")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "delete-client", ActorId: admin.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess, Reason: form.Reason})
+		c.JSON(http.StatusAccepted, gin.H{"message": "Client deletion requested", "jobId": job.Id.Hex()})
+	}
+}
+
+// blacklistClient adds a client to the blacklist for as long as any token issued
+// to it may still be valid. Service tokens never expire so services are
+// blacklisted indefinitely, other kinds for their longest token lifetime.
+func blacklistClient(ctx context.Context, rdb *redis.Client, client *Client) {
+	expiration := jwtTokenExpiration
+	if kind := clientKinds[clientKind(client)]; kind.PersistentToken {
+		expiration = 0
+	} else if kind.TokenLifetime > expiration {
+		expiration = kind.TokenLifetime
+	}
+	cacheCtx, cancel := cacheContext(ctx)
+	defer cancel()
+	if err := rdb.Set(cacheCtx, client.Id.Hex(), client.Id.Hex(), expiration).Err(); err != nil {
+		log.Println("Unable to set Redis key: ", err)
+	}
+}
+
+// makeRestoreHandler restores a user scheduled for deletion using the restore
+// token returned when the deletion was requested
+func makeRestoreHandler(clients *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form RestoreForm
+
+		if err := c.ShouldBindJSON(&form); err != nil || form.Token == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		claim, ok := processPurposeToken(form.Token, restorePurpose)
+		if !ok || claim.ExpiresAt == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid or expired restore token"})
+			return
+		}
+
 		objID, _ := primitive.ObjectIDFromHex(claim.Id)
-		_, err := users.DeleteOne(context.Background(), bson.M{"_id": objID})
+		err := restoreClient(c.Request.Context(), clients, rdb, objID, &claim.ExpiresAt.Time)
+		if err == nil {
+			recordAudit(clients, c, AuditEvent{Action: "restore", ActorId: claim.Id, TargetId: claim.Id, Outcome: auditSuccess})
+			dispatchWebhookEvent(clients, webhookClientRestored, gin.H{"clientId": claim.Id})
+		}
+		respondToRestore(c, err)
+	}
+}
+
+// makeAdminRestoreHandler is an admin only handler restoring any client
+// scheduled for deletion
+func makeAdminRestoreHandler(clients *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form RestoreClientForm
+
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil || form.Id == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unable to parse JSON payload"})
+			return
+		}
+
+		// Authorization policies may depend on the client being restored
+		target, _ := getClientByIdOrEmail(c.Request.Context(), clients, "", form.Id, "")
+		status, admin := authorise(clients, c, claim, permClientsRestore, target)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(form.Id)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid client ID"})
+			return
+		}
+
+		err = restoreClient(c.Request.Context(), clients, rdb, objID, nil)
+		if err == nil {
+			recordAudit(clients, c, AuditEvent{Action: "restore", ActorId: admin.Id.Hex(), TargetId: form.Id, Outcome: auditSuccess})
+			dispatchWebhookEvent(clients, webhookClientRestored, gin.H{"clientId": form.Id})
+		}
+		respondToRestore(c, err)
+	}
+}
+
+// respondToRestore writes the response of a client restoration attempt
+func respondToRestore(c *gin.Context, err error) {
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully restored client"})
+	case errNotScheduledForDeletion:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "Client is not scheduled for deletion"})
+	default:
+		abortWithStorageError(c, err, "Unable to restore client")
+	}
+}
+
+// blacklistDuration returns how long a client should remain blacklisted so that
+// the presented token can no longer be used. Tokens without an expiry (service
+// tokens) are blacklisted indefinitely.
+func blacklistDuration(claim *Claim) time.Duration {
+	if claim.ExpiresAt == nil {
+		return 0
+	}
+	return time.Until(claim.ExpiresAt.Time)
+}
+
+// makeDeletionJobStatusHandler is an admin only handler returning the status of
+// a deletion job
+func makeDeletionJobStatusHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permDeletionsRead, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		job, err := getDeletionJob(c.Request.Context(), clients, c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Deletion job not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"job": job})
+	}
+}
+
+// makeDeletionAckHandler lets a participating service acknowledge that it has
+// deleted the client data it holds. Services authenticate with their API token
+// as a bearer token.
+func makeDeletionAckHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code, claim := processClaim(bearerToken(c))
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, service := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK || clientKind(service) != kindService {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		// Services are matched by client ID as anyone can register a service
+		// with a participant's name
+		participant, ok := deletionParticipantOf(service)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "This service does not participate in client deletions"})
+			return
+		}
+
+		job, err := getDeletionJob(c.Request.Context(), clients, c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Deletion job not found"})
+			return
+		}
+
+		if !contains(job.Awaiting, participant) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "Deletion job is not awaiting an acknowledgement from this service"})
+			return
+		}
+
+		job, err = acknowledgeDeletionJob(c.Request.Context(), clients, job, participant)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to acknowledge deletion job")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"job": job})
+	}
+}
+
+// makeForceDeletionHandler is an admin only handler that purges the client of a
+// deletion job without waiting for the remaining acknowledgements
+func makeForceDeletionHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permDeletionsForce, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		job, err := getDeletionJob(c.Request.Context(), clients, c.Param("id"))
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to delete user"})
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Deletion job not found"})
 			return
 		}
+
+		if job.Status == deletionJobCompleted || job.Status == deletionJobForced {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "Deletion job already completed"})
+			return
+		}
+
+		err = completeDeletionJob(c.Request.Context(), clients, job, deletionJobForced)
+		if err == errDeletionJobClosed {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "Deletion job already completed"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to force deletion job")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"job": job})
 	}
 }
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A client deletion is first scheduled for the end of a grace period
+// (DELETION_GRACE_PERIOD_DAYS) during which the client can be restored. Once the
+// grace period elapses the deletion is tracked as a job. The client is marked as
+// pending deletion, then a deletion event is appended to the 'user-delete'
+// Redis stream and its ID is published, on a best-effort basis, on the
+// 'user-delete' Redis pub-sub channel as it always has been. Each participating
+// service (configured with DELETION_PARTICIPANTS as `name=clientId` entries)
+// reads the stream through its own consumer group, deletes the data it holds
+// and acknowledges the job as the service client configured for it. The client
+// record is only purged once every participant has acknowledged or an admin
+// forces the job.
+
+// deletionChannel is the Redis pub-sub channel the IDs of deleted clients are
+// published on
+const deletionChannel = "user-delete"
+
+// deletionStream is the Redis stream deletion events are appended to
+const deletionStream = "user-delete"
+
+// deletionStreamMaxLen is the approximate number of events the deletion stream
+// is trimmed to. Events trimmed before a participant read them are appended
+// again by the retry worker until the job is acknowledged.
+const deletionStreamMaxLen = 100000
+
+// Client deletion states
+const (
+	deletionStateScheduled = "scheduled"
+	deletionStatePending   = "pending"
+)
+
+// errDeletionInProgress is returned when the deletion of a client that is
+// already being deleted is requested
+var errDeletionInProgress = errors.New("client deletion already in progress")
+
+// errNotScheduledForDeletion is returned when restoring a client that is not
+// scheduled for deletion
+var errNotScheduledForDeletion = errors.New("client is not scheduled for deletion")
+
+// Deletion job statuses
+const (
+	deletionJobPending   = "pending"
+	deletionJobCompleted = "completed"
+	deletionJobForced    = "forced"
+	deletionJobFailed    = "failed"
+)
+
+// Retry policy for republishing deletion events that have not been fully
+// acknowledged. The delay doubles with every attempt up to deletionRetryMaxDelay.
+const (
+	deletionRetryBaseDelay   = time.Minute
+	deletionRetryMaxDelay    = 6 * time.Hour
+	deletionRetryMaxAttempts = 10
+	deletionRetryInterval    = 30 * time.Second
+)
+
+// DeletionJob describes the state of a client deletion request
+type DeletionJob struct {
+	Id           primitive.ObjectID `bson:"_id" json:"id"`
+	ClientId     primitive.ObjectID `bson:"clientId" json:"clientId"`
+	Status       string             `bson:"status" json:"status"`
+	Awaiting     []string           `bson:"awaiting" json:"awaiting"`
+	Acknowledged []string           `bson:"acknowledged" json:"acknowledged"`
+	RequestedBy  primitive.ObjectID `bson:"requestedBy" json:"requestedBy"`
+	Reason       string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	Attempts     int                `bson:"attempts" json:"attempts"`
+	NextAttempt  time.Time          `bson:"nextAttempt" json:"nextAttempt"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+	CompletedAt  *time.Time         `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+}
+
+// getDeletionJobCollection returns the collection deletion jobs are stored in,
+// which lives in the same database as the clients collection
+func getDeletionJobCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("deletionJobs")
+}
+
+// deletionRetryDelay returns the delay before the next republish attempt
+func deletionRetryDelay(attempts int) time.Duration {
+	return exponentialBackoff(deletionRetryBaseDelay, deletionRetryMaxDelay, attempts)
+}
+
+// deletionParticipantOf returns the participant a service client acknowledges
+// deletion jobs for, if any
+func deletionParticipantOf(service *Client) (string, bool) {
+	return participantOf(deletionParticipantClients, service)
+}
+
+// ensureDeletionConsumerGroups creates a consumer group on the deletion stream
+// for every participating service so that no deletion event is missed, even if
+// the service has never connected to the stream before.
+func ensureDeletionConsumerGroups(rdb *redis.Client) {
+	for _, service := range deletionParticipants {
+		err := rdb.XGroupCreateMkStream(context.Background(), deletionStream, service, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			log.Println("Unable to create deletion consumer group for "+service+": ", err)
+		}
+	}
+}
+
+// appendDeletionEvent appends a deletion event for the job to the deletion
+// stream, which is capped to about deletionStreamMaxLen events
+func appendDeletionEvent(ctx context.Context, rdb *redis.Client, job *DeletionJob) error {
+	cacheCtx, cancel := cacheContext(ctx)
+	defer cancel()
+	return rdb.XAdd(cacheCtx, &redis.XAddArgs{
+		Stream: deletionStream,
+		MaxLen: deletionStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"jobId":    job.Id.Hex(),
+			"clientId": job.ClientId.Hex(),
+		},
+	}).Err()
+}
+
+// announceDeletion publishes the client ID of the job on the deletion channel.
+// Pub-sub messages are not delivered to services that are not listening, so
+// the announcement is best-effort and never retried: the deletion stream is
+// what participants rely on.
+func announceDeletion(ctx context.Context, rdb *redis.Client, job *DeletionJob) {
+	cacheCtx, cancel := cacheContext(ctx)
+	defer cancel()
+	if err := rdb.Publish(cacheCtx, deletionChannel, job.ClientId.Hex()).Err(); err != nil {
+		log.Println("Unable to announce deletion of client "+job.ClientId.Hex()+": ", err)
+	}
+}
+
+// scheduleDeletion schedules the deletion of a client at the end of the grace
+// period and returns the time after which it will be deleted
+func scheduleDeletion(ctx context.Context, clients *mongo.Collection, client *Client) (time.Time, error) {
+	deleteAfter := time.Now().Add(deletionGracePeriod)
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	result, err := clients.UpdateOne(dbCtx,
+		bson.M{"_id": client.Id, "deletionState": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deletionState": deletionStateScheduled, "deleteAfter": deleteAfter}},
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if result.MatchedCount == 0 {
+		return time.Time{}, errDeletionInProgress
+	}
+	return deleteAfter, nil
+}
+
+// restoreClient cancels the scheduled deletion of a client. Clients whose
+// deletion job has already started cannot be restored. When restoring with a
+// restore token, scheduledFor is the deletion time the token was issued for, so
+// that the token cannot restore the client again once it is used or restore a
+// later deletion of the client.
+func restoreClient(ctx context.Context, clients *mongo.Collection, rdb *redis.Client, id primitive.ObjectID, scheduledFor *time.Time) error {
+	filter := bson.M{"_id": id, "deletionState": deletionStateScheduled}
+	if scheduledFor != nil {
+		// Token expiry times are truncated to the second
+		from := scheduledFor.Truncate(time.Second)
+		filter["deleteAfter"] = bson.M{"$gte": from, "$lt": from.Add(time.Second)}
+	}
+
+	client := &Client{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := clients.FindOneAndUpdate(dbCtx,
+		filter,
+		bson.M{"$unset": bson.M{"deletionState": "", "deleteAfter": ""}},
+	).Decode(client)
+	if err == mongo.ErrNoDocuments {
+		return errNotScheduledForDeletion
+	}
+	if err != nil {
+		return err
+	}
+
+	cacheCtx, cancelCache := cacheContext(ctx)
+	defer cancelCache()
+	// Lift the blacklist set when the deletion was requested unless the client
+	// is suspended
+	if !client.Suspended {
+		if err := rdb.Del(cacheCtx, id.Hex()).Err(); err != nil {
+			log.Println("Unable to delete Redis key: ", err)
+		}
+	}
+	return nil
+}
+
+// startDeletionJob creates a job to track the deletion cascade of a client,
+// recording who requested it and why, then marks the client as pending
+// deletion. The job is inserted first and removed again if the client cannot be
+// marked, so that no client is left pending deletion without a job. If no
+// participating services are configured the client is purged straight away.
+func startDeletionJob(ctx context.Context, clients *mongo.Collection, rdb *redis.Client, client *Client, requestedBy primitive.ObjectID, reason string) (*DeletionJob, error) {
+	now := time.Now()
+	job := &DeletionJob{
+		Id:           primitive.NewObjectID(),
+		ClientId:     client.Id,
+		Status:       deletionJobPending,
+		RequestedBy:  requestedBy,
+		Reason:       reason,
+		Awaiting:     append([]string{}, deletionParticipants...),
+		Acknowledged: []string{},
+		Attempts:     1,
+		NextAttempt:  now.Add(deletionRetryDelay(1)),
+		CreatedAt:    now,
+	}
+
+	insertCtx, cancelInsert := dbContext(ctx)
+	defer cancelInsert()
+	if _, err := getDeletionJobCollection(clients).InsertOne(insertCtx, job); err != nil {
+		return nil, err
+	}
+
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	result, err := clients.UpdateOne(dbCtx,
+		bson.M{"_id": client.Id, "deletionState": bson.M{"$ne": deletionStatePending}},
+		bson.M{"$set": bson.M{"deletionState": deletionStatePending}, "$unset": bson.M{"deleteAfter": ""}},
+	)
+	if err == nil && result.MatchedCount == 0 {
+		err = errDeletionInProgress
+	}
+	if err != nil {
+		// The job is removed even if the request was cancelled or timed out
+		rollbackCtx, cancelRollback := dbContext(context.Background())
+		defer cancelRollback()
+		if _, rollbackErr := getDeletionJobCollection(clients).DeleteOne(rollbackCtx, bson.M{"_id": job.Id}); rollbackErr != nil {
+			log.Println("Unable to remove deletion job "+job.Id.Hex()+": ", rollbackErr)
+		}
+		return nil, err
+	}
+
+	// Once the client is pending deletion the job is seen through even if the
+	// request is cancelled, each operation still being bounded by its timeout
+	ctx = context.Background()
+
+	// The services owned by the client are dealt with as configured
+	if isUser(client) {
+		applyOwnerRemovalPolicy(ctx, clients, rdb, client.Id, requestedBy, true)
+	}
+
+	// A failed append is not fatal as the retry worker will append the event again
+	if err := appendDeletionEvent(ctx, rdb, job); err != nil {
+		log.Println("Unable to append deletion event: ", err)
+	}
+	announceDeletion(ctx, rdb, job)
+
+	if len(job.Awaiting) == 0 {
+		return job, completeDeletionJob(ctx, clients, job, deletionJobCompleted)
+	}
+	return job, nil
+}
+
+// getDeletionJob returns a deletion job by its hex ID
+func getDeletionJob(ctx context.Context, clients *mongo.Collection, id string) (*DeletionJob, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	job := &DeletionJob{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err = getDeletionJobCollection(clients).FindOne(dbCtx, bson.M{"_id": objID}).Decode(job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// acknowledgeDeletionJob records that a participating service has deleted its
+// data for the job. The client is purged once every participant has
+// acknowledged a job that is still pending: a late acknowledgement of a job
+// that failed or was forced or completed in the meantime is only recorded.
+func acknowledgeDeletionJob(ctx context.Context, clients *mongo.Collection, job *DeletionJob, service string) (*DeletionJob, error) {
+	updated := &DeletionJob{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getDeletionJobCollection(clients).FindOneAndUpdate(dbCtx,
+		bson.M{"_id": job.Id},
+		bson.M{"$pull": bson.M{"awaiting": service}, "$addToSet": bson.M{"acknowledged": service}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(updated.Awaiting) == 0 && updated.Status == deletionJobPending {
+		err := completeDeletionJob(ctx, clients, updated, deletionJobCompleted)
+		if err != nil && err != errDeletionJobClosed {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
+// errDeletionJobClosed is returned when completing a deletion job that was
+// completed, forced or failed since it was read
+var errDeletionJobClosed = errors.New("deletion job already closed")
+
+// completeDeletionJob closes the job with the given status, then purges the
+// client record, its login methods, history, email changes, group requests,
+// invitations and data exports. The job is only closed if its status is still
+// the one it was read with, so that a job is purged and announced once, and
+// errDeletionJobClosed is returned otherwise. Once closed the purge is seen
+// through even if the request is cancelled; should it fail the job is marked
+// as failed so that an admin can force it again.
+func completeDeletionJob(ctx context.Context, clients *mongo.Collection, job *DeletionJob, status string) error {
+	jobs := getDeletionJobCollection(clients)
+	now := time.Now()
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	result, err := jobs.UpdateOne(dbCtx,
+		bson.M{"_id": job.Id, "status": job.Status},
+		bson.M{"$set": bson.M{"status": status, "completedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errDeletionJobClosed
+	}
+	job.Status = status
+	job.CompletedAt = &now
+
+	if err := purgeDeletedClient(clients, job.ClientId); err != nil {
+		failCtx, cancelFail := dbContext(context.Background())
+		defer cancelFail()
+		_, failErr := jobs.UpdateOne(failCtx,
+			bson.M{"_id": job.Id},
+			bson.M{"$set": bson.M{"status": deletionJobFailed}, "$unset": bson.M{"completedAt": ""}},
+		)
+		if failErr != nil {
+			log.Println("Unable to mark deletion job "+job.Id.Hex()+" as failed: ", failErr)
+		}
+		job.Status = deletionJobFailed
+		job.CompletedAt = nil
+		return err
+	}
+
+	dispatchWebhookEvent(clients, webhookClientDeleted, gin.H{"clientId": job.ClientId.Hex(), "jobId": job.Id.Hex(), "status": status})
+	return nil
+}
+
+// purgeDeletedClient removes the client record and every record held about the
+// client. Each operation is bounded by its timeout but not cancelled along with
+// the request that closed the job.
+func purgeDeletedClient(clients *mongo.Collection, clientId primitive.ObjectID) error {
+	dbCtx, cancel := dbContext(context.Background())
+	_, err := clients.DeleteOne(dbCtx, bson.M{"_id": clientId})
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	related := []*mongo.Collection{
+		getIdentityCollection(clients),
+		getLoginHistoryCollection(clients),
+		getSuspensionHistoryCollection(clients),
+		getEmailChangeCollection(clients),
+		getGroupRequestCollection(clients),
+		getInvitationCollection(clients),
+		getExportCollection(clients),
+	}
+	for _, collection := range related {
+		deleteCtx, cancelDelete := dbBulkContext(context.Background())
+		_, err := collection.DeleteMany(deleteCtx, bson.M{"clientId": clientId})
+		cancelDelete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryDeletionJobs republishes the events of pending deletion jobs whose retry
+// time has elapsed. Jobs that exhaust their attempts are marked as failed and
+// can only be completed by an admin forcing them.
+func retryDeletionJobs(clients *mongo.Collection, rdb *redis.Client) {
+	jobs := getDeletionJobCollection(clients)
+	now := time.Now()
+
+	dbCtx, cancel := dbBulkContext(context.Background())
+	defer cancel()
+	cursor, err := jobs.Find(dbCtx, bson.M{"status": deletionJobPending, "nextAttempt": bson.M{"$lte": now}})
+	if err != nil {
+		log.Println("Unable to query deletion jobs: ", err)
+		return
+	}
+	var pending []DeletionJob
+	if err := cursor.All(dbCtx, &pending); err != nil {
+		log.Println("Unable to decode deletion jobs: ", err)
+		return
+	}
+
+	for _, job := range pending {
+		retryDeletionJob(jobs, rdb, &job, now)
+	}
+}
+
+// retryDeletionJob republishes the event of a pending deletion job, or marks
+// the job as failed once it exhausts its attempts
+func retryDeletionJob(jobs *mongo.Collection, rdb *redis.Client, job *DeletionJob, now time.Time) {
+	if job.Attempts >= deletionRetryMaxAttempts {
+		log.Println("Deletion job " + job.Id.Hex() + " failed, still awaiting " + strings.Join(job.Awaiting, ", "))
+		dbCtx, cancel := dbContext(context.Background())
+		defer cancel()
+		jobs.UpdateOne(dbCtx, bson.M{"_id": job.Id}, bson.M{"$set": bson.M{"status": deletionJobFailed}})
+		return
+	}
+
+	if err := appendDeletionEvent(context.Background(), rdb, job); err != nil {
+		log.Println("Unable to append deletion event again: ", err)
+	}
+	dbCtx, cancel := dbContext(context.Background())
+	defer cancel()
+	jobs.UpdateOne(dbCtx, bson.M{"_id": job.Id}, bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": bson.M{"nextAttempt": now.Add(deletionRetryDelay(job.Attempts + 1))},
+	})
+}
+
+// startScheduledDeletions starts a deletion job for every client whose grace
+// period has elapsed
+func startScheduledDeletions(clients *mongo.Collection, rdb *redis.Client) {
+	filter := bson.M{"deletionState": deletionStateScheduled, "deleteAfter": bson.M{"$lte": time.Now()}}
+	dbCtx, cancel := dbBulkContext(context.Background())
+	defer cancel()
+	cursor, err := clients.Find(dbCtx, filter)
+	if err != nil {
+		log.Println("Unable to query clients scheduled for deletion: ", err)
+		return
+	}
+	var scheduled []Client
+	if err := cursor.All(dbCtx, &scheduled); err != nil {
+		log.Println("Unable to decode clients scheduled for deletion: ", err)
+		return
+	}
+
+	for _, client := range scheduled {
+		if _, err := startDeletionJob(context.Background(), clients, rdb, &client, client.Id, ""); err != nil {
+			log.Println("Unable to start deletion job for client "+client.Id.Hex()+": ", err)
+		}
+	}
+}
+
+// runDeletionWorker periodically starts the deletion of clients whose grace
+// period has elapsed and retries unacknowledged deletion jobs. This is a
+// blocking call and is expected to be run in its own goroutine.
+func runDeletionWorker(clients *mongo.Collection, rdb *redis.Client) {
+	ticker := time.NewTicker(deletionRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		startScheduledDeletions(clients, rdb)
+		retryDeletionJobs(clients, rdb)
+	}
+}
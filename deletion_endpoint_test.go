@@ -1,9 +1,454 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
 
-// TODO
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
 
 func TestSuccessfulDeletion(t *testing.T) {
+	recorder := httptest.NewRecorder()
 
+	email := genRandomEmail()
+	hashedPass, _ := hashAndSalt("somePassword")
+
+	// Insert a new user into the database
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: email},
+		{Key: "hashedPassword", Value: hashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: []string{""}},
+	})
+	id := result.InsertedID.(primitive.ObjectID)
+
+	token := issueTestToken(t, id.Hex())
+
+	// Create a new request
+	req, _ := http.NewRequest("POST", "/delete", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+	// Send request to service
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	// The restore token is emailed rather than returned
+	assert.NotContains(t, recorder.Body.String(), `"restoreToken"`)
+	assert.NotEmpty(t, mailedToken(email))
+
+	// The user is only scheduled for deletion until the grace period elapses
+	user := &Client{}
+	mongoErr := clients.FindOne(context.Background(), bson.M{"_id": id}).Decode(user)
+	assert.Nil(t, mongoErr)
+	assert.Equal(t, deletionStateScheduled, user.DeletionState)
+
+	// The user is blacklisted until their token expires
+	assert.Equal(t, id.Hex(), rdb.Get(context.Background(), id.Hex()).Val())
+
+	// The user can no longer log in
+	recorder = httptest.NewRecorder()
+	login := `{"email": "` + email + `", "password": "somePassword"}`
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(login))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestRestoreScheduledDeletion(t *testing.T) {
+	email := genRandomEmail()
+	hashedPass, _ := hashAndSalt("somePassword")
+
+	// Insert a new user into the database
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: email},
+		{Key: "hashedPassword", Value: hashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: []string{""}},
+	})
+	id := result.InsertedID.(primitive.ObjectID)
+	token := issueTestToken(t, id.Hex())
+
+	// Request the user deletion
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/delete", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	restoreToken := mailedToken(email)
+
+	// The restore token cannot be used to authenticate
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: restoreToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// Restore the account with the restore token
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/restore", strings.NewReader(`{"token": "`+restoreToken+`"}`))
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"message":"Successfully restored client"}`, recorder.Body.String())
+
+	user := &Client{}
+	clients.FindOne(context.Background(), bson.M{"_id": id}).Decode(user)
+	assert.Equal(t, "", user.DeletionState)
+	assert.Nil(t, user.DeleteAfter)
+
+	// The user is no longer blacklisted
+	assert.Equal(t, int64(0), rdb.Exists(context.Background(), id.Hex()).Val())
+
+	// The restore token cannot be used again
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/restore", strings.NewReader(`{"token": "`+restoreToken+`"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	// Nor can it restore a later deletion of the user
+	clients.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"deletionState": deletionStateScheduled,
+		"deleteAfter":   time.Now().Add(deletionGracePeriod + time.Hour),
+	}})
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/restore", strings.NewReader(`{"token": "`+restoreToken+`"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+}
+
+func TestRestoreKeepsSuspendedClientBlacklisted(t *testing.T) {
+	id, _ := insertTestClient(t, []string{})
+	clients.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"suspended":     true,
+		"deletionState": deletionStateScheduled,
+		"deleteAfter":   time.Now().Add(time.Hour),
+	}})
+	rdb.Set(context.Background(), id.Hex(), id.Hex(), 0)
+
+	assert.NoError(t, restoreClient(context.Background(), clients, rdb, id, nil))
+
+	// The suspension outlives the cancelled deletion
+	assert.Equal(t, id.Hex(), rdb.Get(context.Background(), id.Hex()).Val())
+}
+
+func TestDeletionAwaitsServiceAcknowledgement(t *testing.T) {
+	// Start the deletion job straight away
+	gracePeriod := deletionGracePeriod
+	deletionGracePeriod = 0
+	service, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "billing", []string{}, primitive.NilObjectID, "")
+	deletionParticipants = []string{"billing"}
+	deletionParticipantClients = map[string]string{"billing": service.Id.Hex()}
+	defer func() {
+		deletionGracePeriod = gracePeriod
+		deletionParticipants = []string{}
+		deletionParticipantClients = map[string]string{}
+	}()
+
+	email := genRandomEmail()
+	hashedPass, _ := hashAndSalt("somePassword")
+
+	// Insert a new user into the database
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: email},
+		{Key: "hashedPassword", Value: hashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: []string{""}},
+	})
+	id := result.InsertedID.(primitive.ObjectID)
+	token := issueTestToken(t, id.Hex())
+
+	// Request the user deletion
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/delete", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	// The user must not be purged until the billing service acknowledges
+	user := &Client{}
+	mongoErr := clients.FindOne(context.Background(), bson.M{"_id": id}).Decode(user)
+	assert.Nil(t, mongoErr)
+	assert.Equal(t, deletionStatePending, user.DeletionState)
+
+	job := &DeletionJob{}
+	getDeletionJobCollection(clients).FindOne(context.Background(), bson.M{"clientId": id}).Decode(job)
+	assert.Equal(t, []string{"billing"}, job.Awaiting)
+
+	// The billing service acknowledges the deletion job
+	serviceToken, _ := generateAPIClientToken(context.Background(), clients, service)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/deletion-jobs/"+job.Id.Hex()+"/ack", nil)
+	req.Header.Set("Authorization", "Bearer "+serviceToken)
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"status":"completed"`)
+
+	// Once every participating service has acknowledged the user is purged
+	mongoErr = clients.FindOne(context.Background(), bson.M{"_id": id}).Err()
+	assert.ErrorIs(t, mongoErr, mongo.ErrNoDocuments)
+}
+
+func TestDeletionPublishesClientId(t *testing.T) {
+	// Start the deletion job straight away
+	gracePeriod := deletionGracePeriod
+	deletionGracePeriod = 0
+	defer func() { deletionGracePeriod = gracePeriod }()
+
+	// Services listening on the pub-sub channel receive the client ID
+	subscription := rdb.Subscribe(context.Background(), deletionChannel)
+	defer subscription.Close()
+	_, err := subscription.Receive(context.Background())
+	assert.NoError(t, err)
+
+	id, token := insertTestClient(t, []string{})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/delete", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		message, err := subscription.ReceiveMessage(ctx)
+		if !assert.NoError(t, err) || message.Payload == id.Hex() {
+			break
+		}
+	}
+}
+
+func TestDeletionRetryOnlyAppendsToStream(t *testing.T) {
+	subscription := rdb.Subscribe(context.Background(), deletionChannel)
+	defer subscription.Close()
+	_, err := subscription.Receive(context.Background())
+	assert.NoError(t, err)
+
+	job := &DeletionJob{Id: primitive.NewObjectID(), ClientId: primitive.NewObjectID(), Status: deletionJobPending}
+	getDeletionJobCollection(clients).InsertOne(context.Background(), job)
+	before, _ := rdb.XLen(context.Background(), deletionStream).Result()
+
+	retryDeletionJob(getDeletionJobCollection(clients), rdb, job, time.Now())
+
+	// The event is appended to the stream again
+	after, _ := rdb.XLen(context.Background(), deletionStream).Result()
+	assert.Greater(t, after, before)
+
+	// But the client ID is not announced again on the pub-sub channel
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	for {
+		message, err := subscription.ReceiveMessage(ctx)
+		if err != nil {
+			break
+		}
+		assert.NotEqual(t, job.ClientId.Hex(), message.Payload)
+	}
+}
+
+func TestDeletionInProgressLeavesNoJob(t *testing.T) {
+	deletionParticipants = []string{"billing"}
+	defer func() { deletionParticipants = []string{} }()
+
+	id, _ := insertTestClient(t, []string{})
+	client := &Client{}
+	clients.FindOne(context.Background(), bson.M{"_id": id}).Decode(client)
+
+	_, err := startDeletionJob(context.Background(), clients, rdb, client, id, "")
+	assert.NoError(t, err)
+
+	// Starting the deletion again fails and its job is removed
+	_, err = startDeletionJob(context.Background(), clients, rdb, client, id, "")
+	assert.ErrorIs(t, err, errDeletionInProgress)
+
+	count, _ := getDeletionJobCollection(clients).CountDocuments(context.Background(), bson.M{"clientId": id})
+	assert.Equal(t, int64(1), count)
+}
+
+func TestImpostorServiceCannotAcknowledgeDeletion(t *testing.T) {
+	// Start the deletion job straight away
+	gracePeriod := deletionGracePeriod
+	deletionGracePeriod = 0
+	billing, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "billing", []string{}, primitive.NilObjectID, "")
+	deletionParticipants = []string{"billing"}
+	deletionParticipantClients = map[string]string{"billing": billing.Id.Hex()}
+	defer func() {
+		deletionGracePeriod = gracePeriod
+		deletionParticipants = []string{}
+		deletionParticipantClients = map[string]string{}
+	}()
+
+	id, token := insertTestClient(t, []string{})
+
+	// Request the user deletion
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/delete", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	job := &DeletionJob{}
+	getDeletionJobCollection(clients).FindOne(context.Background(), bson.M{"clientId": id}).Decode(job)
+
+	// Another service registered with the same name is refused
+	impostor, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "billing", []string{}, primitive.NilObjectID, "")
+	impostorToken, _ := generateAPIClientToken(context.Background(), clients, impostor)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/deletion-jobs/"+job.Id.Hex()+"/ack", nil)
+	req.Header.Set("Authorization", "Bearer "+impostorToken)
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// The job is still awaiting the billing service and the user is not purged
+	getDeletionJobCollection(clients).FindOne(context.Background(), bson.M{"_id": job.Id}).Decode(job)
+	assert.Equal(t, []string{"billing"}, job.Awaiting)
+	assert.Nil(t, clients.FindOne(context.Background(), bson.M{"_id": id}).Err())
+}
+
+func TestLateAcknowledgementOfForcedDeletion(t *testing.T) {
+	// Start the deletion job straight away
+	gracePeriod := deletionGracePeriod
+	deletionGracePeriod = 0
+	billing, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "billing", []string{}, primitive.NilObjectID, "")
+	deletionParticipants = []string{"billing"}
+	deletionParticipantClients = map[string]string{"billing": billing.Id.Hex()}
+	defer func() {
+		deletionGracePeriod = gracePeriod
+		deletionParticipants = []string{}
+		deletionParticipantClients = map[string]string{}
+	}()
+
+	id, token := insertTestClient(t, []string{})
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	getGroupRequestCollection(clients).InsertOne(context.Background(), GroupRequest{
+		Id:        primitive.NewObjectID(),
+		ClientId:  id,
+		Group:     "support",
+		Source:    groupRequestJustInTime,
+		Status:    groupRequestPending,
+		CreatedAt: time.Now(),
+	})
+
+	// Request the user deletion
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/delete", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	job := &DeletionJob{}
+	getDeletionJobCollection(clients).FindOne(context.Background(), bson.M{"clientId": id}).Decode(job)
+
+	// An admin forces the job, which purges every record held about the user
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/deletion-jobs/"+job.Id.Hex()+"/force", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.ErrorIs(t, clients.FindOne(context.Background(), bson.M{"_id": id}).Err(), mongo.ErrNoDocuments)
+	assert.ErrorIs(t, getGroupRequestCollection(clients).FindOne(context.Background(), bson.M{"clientId": id}).Err(), mongo.ErrNoDocuments)
+
+	// Forcing it again is refused
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/deletion-jobs/"+job.Id.Hex()+"/force", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	// The billing service acknowledging late is recorded without completing the
+	// job a second time
+	serviceToken, _ := generateAPIClientToken(context.Background(), clients, billing)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/deletion-jobs/"+job.Id.Hex()+"/ack", nil)
+	req.Header.Set("Authorization", "Bearer "+serviceToken)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	getDeletionJobCollection(clients).FindOne(context.Background(), bson.M{"_id": job.Id}).Decode(job)
+	assert.Equal(t, deletionJobForced, job.Status)
+	assert.Equal(t, []string{"billing"}, job.Acknowledged)
+}
+
+func TestAdminDeletesServiceClient(t *testing.T) {
+	recorder := httptest.NewRecorder()
+
+	// Create an admin user
+	adminHashedPass, _ := hashAndSalt("somePassword")
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: genRandomEmail()},
+		{Key: "hashedPassword", Value: adminHashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: []string{"admin"}},
+	})
+	adminId := result.InsertedID.(primitive.ObjectID)
+	adminToken := issueTestToken(t, adminId.Hex())
+
+	// Create a service client, which has no cookie login and cannot delete itself
+	serviceEmail := genRandomEmail()
+	service, _ := createNewServiceClient(context.Background(), clients, "", serviceEmail, "Service A", []string{}, primitive.NilObjectID, "")
+
+	payload := `{"email": "` + serviceEmail + `", "reason": "Service decommissioned"}`
+
+	// Create a new request
+	req, _ := http.NewRequest("POST", "/delete-client", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+
+	// Send request to service
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	// The deletion job records the admin and the reason
+	job := &DeletionJob{}
+	getDeletionJobCollection(clients).FindOne(context.Background(), bson.M{"clientId": service.Id}).Decode(job)
+	assert.Equal(t, adminId, job.RequestedBy)
+	assert.Equal(t, "Service decommissioned", job.Reason)
+
+	// The service is blacklisted indefinitely
+	assert.Equal(t, service.Id.Hex(), rdb.Get(context.Background(), service.Id.Hex()).Val())
+	assert.Equal(t, time.Duration(-1), rdb.TTL(context.Background(), service.Id.Hex()).Val())
+}
+
+func TestFailedAdminDeletionWithoutReason(t *testing.T) {
+	recorder := httptest.NewRecorder()
+
+	// Create an admin user
+	adminHashedPass, _ := hashAndSalt("somePassword")
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: genRandomEmail()},
+		{Key: "hashedPassword", Value: adminHashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: []string{"admin"}},
+	})
+	adminToken := issueTestToken(t, result.InsertedID.(primitive.ObjectID).Hex())
+
+	payload := `{"email": "` + genRandomEmail() + `"}`
+
+	// Create a new request
+	req, _ := http.NewRequest("POST", "/delete-client", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+
+	// Send request to service
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"message":"Key: 'DeleteClientForm.Reason' Error:Field validation for 'Reason' failed on the 'required' tag"}`, recorder.Body.String())
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/idna"
+)
+
+// Email addresses are stored, looked up and kept unique in their normalised
+// form: trimmed, with the domain converted to its lower case ASCII form (so
+// that internationalised domains match their punycode form) and, unless
+// EMAIL_LOCAL_PART_CASE is "sensitive", the local part lower cased. The
+// address as the client typed it is kept as its display email.
+
+// Local part case handling (EMAIL_LOCAL_PART_CASE)
+const (
+	// "Bob@example.com" and "bob@example.com" are the same address (default)
+	localPartInsensitive = "insensitive"
+	// "Bob@example.com" and "bob@example.com" are different addresses
+	localPartSensitive = "sensitive"
+)
+
+// normaliseEmail returns the normalised form of an email address
+func normaliseEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	domain = strings.ToLower(domain)
+	if emailLocalPartCase != localPartSensitive {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + domain
+}
+
+// displayEmail returns the display form of an email address, unset if it is
+// the normalised form
+func displayEmail(email string) string {
+	email = strings.TrimSpace(email)
+	if email == normaliseEmail(email) {
+		return ""
+	}
+	return email
+}
+
+// clientDisplayEmail returns the email address of a client as it typed it
+func clientDisplayEmail(client *Client) string {
+	if client.DisplayEmail != "" {
+		return client.DisplayEmail
+	}
+	return client.Email
+}
+
+// emailFilter returns the filter of an email address. Clients stored before
+// email addresses were normalised also match the address as typed until they
+// are migrated.
+func emailFilter(email string) interface{} {
+	normalised := normaliseEmail(email)
+	if normalised == email {
+		return email
+	}
+	return bson.M{"$in": []string{normalised, email}}
+}
+
+// emailCollisions returns the clients that share an email address once it is
+// normalised, by tenant and normalised address
+func emailCollisions(clients *mongo.Collection) (map[string][]Client, error) {
+	cursor, err := clients.Find(context.Background(), bson.M{},
+		options.Find().SetProjection(bson.M{"email": 1, "tenantId": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	byAddress := map[string][]Client{}
+	for cursor.Next(context.Background()) {
+		client := Client{}
+		if err := cursor.Decode(&client); err != nil {
+			return nil, err
+		}
+		key := groupKey(client.TenantId, normaliseEmail(client.Email))
+		byAddress[key] = append(byAddress[key], client)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	for key, matching := range byAddress {
+		if len(matching) < 2 {
+			delete(byAddress, key)
+		}
+	}
+	return byAddress, nil
+}
+
+// reportEmailCollisions logs the clients that share an email address once it
+// is normalised and returns their IDs. They are left as is for an admin to
+// resolve, e.g. by deleting one of them or changing its email address.
+func reportEmailCollisions(clients *mongo.Collection) (map[string]bool, error) {
+	collisions, err := emailCollisions(clients)
+	if err != nil {
+		return nil, err
+	}
+	colliding := map[string]bool{}
+	for _, matching := range collisions {
+		ids := []string{}
+		for _, client := range matching {
+			ids = append(ids, client.Id.Hex())
+			colliding[client.Id.Hex()] = true
+		}
+		log.Printf("Clients %s of tenant %q share the email address %s once normalised", strings.Join(ids, ", "), matching[0].TenantId, normaliseEmail(matching[0].Email))
+	}
+	return colliding, nil
+}
+
+// normaliseClientEmail stores the normalised email address of a client along
+// with its display form. A client whose normalised address another client
+// already has is logged and left as is.
+func normaliseClientEmail(ctx context.Context, clients *mongo.Collection, client *Client) error {
+	normalised := normaliseEmail(client.Email)
+	if normalised == client.Email {
+		return nil
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := clients.UpdateOne(dbCtx,
+		bson.M{"_id": client.Id, "email": client.Email},
+		bson.M{"$set": bson.M{"email": normalised, "displayEmail": displayEmail(client.Email)}, "$inc": bson.M{"version": 1}},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Printf("Client %s of tenant %q shares the email address %s once normalised", client.Id.Hex(), client.TenantId, normalised)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	client.DisplayEmail = displayEmail(client.Email)
+	client.Email = normalised
+	return nil
+}
+
+// normaliseClientEmails normalises the email address of every client except
+// those that would collide, which are reported
+func normaliseClientEmails(ctx context.Context, clients *mongo.Collection) error {
+	colliding, err := reportEmailCollisions(clients)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := clients.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		client := &Client{}
+		if err := cursor.Decode(client); err != nil {
+			return err
+		}
+		if colliding[client.Id.Hex()] {
+			continue
+		}
+		if err := normaliseClientEmail(ctx, clients, client); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
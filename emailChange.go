@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Users change their email address, which is their login identifier, by
+// re-entering their password. A confirmation link is sent to the new address
+// and a notice with a cancel link to the old one; the address only changes
+// once the link is followed. The change can optionally invalidate every token
+// issued to the user.
+
+// Purposes of the tokens used in email change links
+const (
+	emailChangeConfirmPurpose = "email-change-confirm"
+	emailChangeCancelPurpose  = "email-change-cancel"
+)
+
+// Email change statuses
+const (
+	emailChangePending   = "pending"
+	emailChangeConfirmed = "confirmed"
+	emailChangeCancelled = "cancelled"
+)
+
+// EmailChange describes a requested change of the email address of a user
+type EmailChange struct {
+	Id           primitive.ObjectID `bson:"_id" json:"id"`
+	ClientId     primitive.ObjectID `bson:"clientId" json:"clientId"`
+	TenantId     string             `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
+	OldEmail     string             `bson:"oldEmail" json:"oldEmail"`
+	NewEmail     string             `bson:"newEmail" json:"newEmail"`
+	RevokeTokens bool               `bson:"revokeTokens" json:"revokeTokens"`
+	Status       string             `bson:"status" json:"status"`
+	ExpiresAt    time.Time          `bson:"expiresAt" json:"expiresAt"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+	CompletedAt  *time.Time         `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+}
+
+// EmailChangeForm describes the expected JSON payload when a user requests to
+// change their email address
+type EmailChangeForm struct {
+	NewEmail string `json:"newEmail" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+
+	// RevokeTokens invalidates every token issued to the user, logging out
+	// their other sessions, once the change is confirmed
+	RevokeTokens bool `json:"revokeTokens"`
+}
+
+// getEmailChangeCollection returns the collection email changes are stored in
+func getEmailChangeCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("emailChanges")
+}
+
+// changeClientEmail changes the email address of a client, failing with
+// errEmailTaken if another client has the new address or the email address of
+// the client has changed since it was read.
+func changeClientEmail(ctx context.Context, clients *mongo.Collection, client *Client, email string, revokeTokens bool) error {
+	inc := bson.M{"version": 1}
+	if revokeTokens {
+		inc["tokenVersion"] = 1
+	}
+	update := bson.M{"$set": bson.M{"email": normaliseEmail(email)}, "$inc": inc}
+	if display := displayEmail(email); display != "" {
+		update["$set"].(bson.M)["displayEmail"] = display
+	} else {
+		update["$unset"] = bson.M{"displayEmail": ""}
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	result, err := clients.UpdateOne(dbCtx, bson.M{"_id": client.Id, "email": client.Email}, update)
+	if err != nil {
+		return emailTakenError(err)
+	}
+	if result.MatchedCount == 0 {
+		return errEmailTaken
+	}
+	return nil
+}
+
+// getPendingEmailChange returns the pending, unexpired email change of a link
+// token
+func getPendingEmailChange(ctx context.Context, clients *mongo.Collection, token string, purpose string) (*EmailChange, bool) {
+	claim, ok := processPurposeToken(token, purpose)
+	if !ok {
+		return nil, false
+	}
+	objID, _ := primitive.ObjectIDFromHex(claim.Id)
+	change := &EmailChange{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getEmailChangeCollection(clients).FindOne(dbCtx, bson.M{
+		"_id":       objID,
+		"status":    emailChangePending,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(change)
+	if err != nil {
+		return nil, false
+	}
+	return change, true
+}
+
+// completeEmailChange moves a pending email change to the status. It returns
+// false if the change is no longer pending.
+func completeEmailChange(ctx context.Context, clients *mongo.Collection, change *EmailChange, status string) bool {
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	result, err := getEmailChangeCollection(clients).UpdateOne(dbCtx,
+		bson.M{"_id": change.Id, "status": emailChangePending},
+		bson.M{"$set": bson.M{"status": status, "completedAt": time.Now()}},
+	)
+	return err == nil && result.ModifiedCount == 1
+}
+
+// makeRequestEmailChangeHandler emails a confirmation link to the new email
+// address of the authenticated user and a notice with a cancel link to the old
+// one. Requesting a new change cancels the pending one.
+func makeRequestEmailChangeHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form EmailChangeForm
+
+		client, _, ok := authenticateRequest(c, clients)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if !isUser(client) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Only users can change their email address"})
+			return
+		}
+
+		validPass, err := passwordMatches(c.Request.Context(), clients, client, form.Password)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to check password")
+			return
+		}
+		if !validPass {
+			recordAudit(clients, c, AuditEvent{Action: "change-email", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditFailure, Reason: "invalid password"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid password"})
+			return
+		}
+
+		if normaliseEmail(form.NewEmail) == client.Email {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "The new email address is the current one"})
+			return
+		}
+
+		if clientExists(c.Request.Context(), clients, client.TenantId, form.NewEmail) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A user associated with the email address is already registered"})
+			return
+		}
+
+		now := time.Now()
+		change := &EmailChange{
+			Id:           primitive.NewObjectID(),
+			ClientId:     client.Id,
+			TenantId:     client.TenantId,
+			OldEmail:     client.Email,
+			NewEmail:     form.NewEmail,
+			RevokeTokens: form.RevokeTokens,
+			Status:       emailChangePending,
+			ExpiresAt:    now.Add(emailChangeExpiration),
+			CreatedAt:    now,
+		}
+		confirmToken, err := genPurposeToken(change.Id.Hex(), emailChangeConfirmPurpose, change.ExpiresAt)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create email change links"})
+			return
+		}
+		cancelToken, err := genPurposeToken(change.Id.Hex(), emailChangeCancelPurpose, change.ExpiresAt)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create email change links"})
+			return
+		}
+
+		changes := getEmailChangeCollection(clients)
+		cancelCtx, cancelCancel := dbBulkContext(c.Request.Context())
+		defer cancelCancel()
+		changes.UpdateMany(cancelCtx,
+			bson.M{"clientId": client.Id, "status": emailChangePending},
+			bson.M{"$set": bson.M{"status": emailChangeCancelled, "completedAt": now}},
+		)
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := changes.InsertOne(dbCtx, change); err != nil {
+			abortWithStorageError(c, err, "Unable to request email change")
+			return
+		}
+
+		err = mailer.Send(change.NewEmail, "Confirm your new email address",
+			"Follow the link below to confirm your new email address. It expires at "+change.ExpiresAt.Format(time.RFC1123)+
+				".\r\n\r\n"+emailChangeConfirmUrl+"?token="+confirmToken)
+		if err == nil {
+			err = mailer.Send(change.OldEmail, "Your email address is being changed",
+				"A change of the email address of your account to "+change.NewEmail+" has been requested. "+
+					"If you did not request it, follow the link below to cancel it and change your password.\r\n\r\n"+
+					emailChangeCancelUrl+"?token="+cancelToken)
+		}
+		if err != nil {
+			log.Println("Unable to send email change links: ", err)
+			completeEmailChange(c.Request.Context(), clients, change, emailChangeCancelled)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to send email change links"})
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "request-email-change", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess})
+		c.JSON(http.StatusAccepted, gin.H{"message": "A confirmation link has been sent to the new email address", "expiresAt": change.ExpiresAt})
+	}
+}
+
+// makeConfirmEmailChangeHandler changes the email address of the user of a
+// confirmation link
+func makeConfirmEmailChangeHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		change, ok := getPendingEmailChange(c.Request.Context(), clients, c.Query("token"), emailChangeConfirmPurpose)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "Invalid, expired or already used email change link"})
+			return
+		}
+
+		client, err := getClientByIdOrEmail(c.Request.Context(), clients, change.TenantId, change.ClientId.Hex(), "")
+		if err != nil || client.Email != change.OldEmail {
+			completeEmailChange(c.Request.Context(), clients, change, emailChangeCancelled)
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "The email address has changed since the change was requested"})
+			return
+		}
+
+		// The change is claimed before the swap so that a link opened twice
+		// concurrently only changes the address once
+		if !completeEmailChange(c.Request.Context(), clients, change, emailChangeConfirmed) {
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "Invalid, expired or already used email change link"})
+			return
+		}
+
+		err = changeClientEmail(c.Request.Context(), clients, client, change.NewEmail, change.RevokeTokens)
+		if err != nil {
+			dbCtx, cancel := dbContext(c.Request.Context())
+			defer cancel()
+			getEmailChangeCollection(clients).UpdateOne(dbCtx, bson.M{"_id": change.Id},
+				bson.M{"$set": bson.M{"status": emailChangePending}, "$unset": bson.M{"completedAt": ""}})
+		}
+		if err == errEmailTaken {
+			recordAudit(clients, c, AuditEvent{Action: "change-email", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditFailure, Reason: "email already registered"})
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A user associated with the email address is already registered"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to change email address")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "change-email", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess})
+		c.JSON(http.StatusOK, gin.H{"message": "Email address changed successfully"})
+	}
+}
+
+// makeCancelEmailChangeHandler cancels the pending email change of a cancel
+// link sent to the old email address
+func makeCancelEmailChangeHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		change, ok := getPendingEmailChange(c.Request.Context(), clients, c.Query("token"), emailChangeCancelPurpose)
+		if !ok || !completeEmailChange(c.Request.Context(), clients, change, emailChangeCancelled) {
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "Invalid, expired or already used email change link"})
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "cancel-email-change", TargetId: change.ClientId.Hex(), Outcome: auditSuccess})
+		c.JSON(http.StatusOK, gin.H{"message": "Email change cancelled"})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mailedToken returns the token of the link in the last email sent to the
+// address
+func mailedToken(email string) string {
+	files, _ := filepath.Glob(filepath.Join(mailer.(*fileMailer).dir, mailFilePrefix(email)+"-*.eml"))
+	if len(files) == 0 {
+		return ""
+	}
+	message, _ := os.ReadFile(files[len(files)-1])
+	_, token, _ := strings.Cut(string(message), "?token=")
+	return strings.TrimSpace(token)
+}
+
+// registerForEmailChange registers a user and requests to change its email
+// address, returning the token cookie of the user
+func registerForEmailChange(t *testing.T, email string, newEmail string, revokeTokens string) *http.Cookie {
+	cookie := registerAndLogin(email, `{"email": "`+email+`", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`)
+	payload := `{"newEmail": "` + newEmail + `", "password": "somePassword", "revokeTokens": ` + revokeTokens + `}`
+	recorder := sendWithCookie("POST", "/me/email", payload, cookie)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	return cookie
+}
+
+func TestEmailChange(t *testing.T) {
+	email, newEmail := genRandomEmail(), genRandomEmail()
+	cookie := registerForEmailChange(t, email, newEmail, "true")
+
+	// A notice with a cancel link is sent to the old address
+	assert.NotEmpty(t, mailedToken(email))
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me/email/confirm?token="+mailedToken(newEmail), nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	user, err := getClientByEmail(context.Background(), clients, "", newEmail)
+	assert.Nil(t, err)
+	assert.Equal(t, newEmail, user.Email)
+	assert.False(t, clientExists(context.Background(), clients, "", email))
+
+	// Outstanding tokens were invalidated
+	recorder = sendWithCookie("GET", "/me", "", cookie)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// The confirmation link can only be used once
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/me/email/confirm?token="+mailedToken(newEmail), nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGone, recorder.Code)
+}
+
+func TestCancelledEmailChange(t *testing.T) {
+	email, newEmail := genRandomEmail(), genRandomEmail()
+	registerForEmailChange(t, email, newEmail, "false")
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me/email/cancel?token="+mailedToken(email), nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/me/email/confirm?token="+mailedToken(newEmail), nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGone, recorder.Code)
+	assert.True(t, clientExists(context.Background(), clients, "", email))
+}
+
+func TestEmailChangeToRegisteredAddress(t *testing.T) {
+	email, newEmail := genRandomEmail(), genRandomEmail()
+	registerForEmailChange(t, email, newEmail, "false")
+
+	// The new address is registered by someone else before the change is
+	// confirmed
+	registerAndLogin(newEmail, `{"email": "`+newEmail+`", "password": "somePassword", "firstName": "Jane", "lastName": "Doe", "groups": []}`)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me/email/confirm?token="+mailedToken(newEmail), nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.True(t, clientExists(context.Background(), clients, "", email))
+}
+
+func TestFileMailerKeepsEmailsInItsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	fileMailer := &fileMailer{dir: filepath.Join(dir, "mail")}
+	assert.NoError(t, fileMailer.Send("../../escaped@example.com", "Subject", "Body"))
+
+	// The email is written inside the mail directory only
+	escaped, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.Empty(t, escaped)
+	files, _ := filepath.Glob(filepath.Join(dir, "mail", mailFilePrefix("../../escaped@example.com")+"-*.eml"))
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNormaliseEmail(t *testing.T) {
+	assert.Equal(t, "bob.smith@example.com", normaliseEmail(" Bob.Smith@Example.COM "))
+	assert.Equal(t, "bob@xn--bcher-kva.de", normaliseEmail("Bob@BÜCHER.de"))
+
+	emailLocalPartCase = localPartSensitive
+	defer func() { emailLocalPartCase = localPartInsensitive }()
+	assert.Equal(t, "Bob@example.com", normaliseEmail("Bob@Example.com"))
+}
+
+func TestEmailMatchedCaseInsensitively(t *testing.T) {
+	local := strings.Split(genRandomEmail(), "@")[0]
+	email := strings.ToUpper(local[:1]) + local[1:] + "@Example.COM"
+
+	recorder := httptest.NewRecorder()
+	user := `{"email": "` + email + `", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	// The address is stored normalised along with its display form
+	client, err := getClientByEmail(context.Background(), clients, "", strings.ToLower(email))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.ToLower(email), client.Email)
+	assert.Equal(t, email, client.DisplayEmail)
+
+	// Any form of the address logs in
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+strings.ToLower(email)+`", "password": "somePassword"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Any form of the address is taken
+	recorder = httptest.NewRecorder()
+	user = `{"email": "` + strings.ToUpper(email) + `", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`
+	req, _ = http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+}
+
+func TestEmailCollisionsReported(t *testing.T) {
+	// Clients stored before email addresses were normalised may collide
+	email := genRandomEmail()
+	first, _ := clients.InsertOne(context.Background(), bson.M{"email": strings.ToUpper(email), "groups": []string{}})
+	second, _ := clients.InsertOne(context.Background(), bson.M{"email": email + " ", "groups": []string{}})
+
+	colliding, err := reportEmailCollisions(clients)
+	assert.NoError(t, err)
+	assert.True(t, colliding[first.InsertedID.(primitive.ObjectID).Hex()])
+	assert.True(t, colliding[second.InsertedID.(primitive.ObjectID).Hex()])
+
+	// Colliding clients are left as is by the migration
+	assert.NoError(t, normaliseClientEmails(context.Background(), clients))
+	document := getRawClient(first.InsertedID.(primitive.ObjectID))
+	assert.Equal(t, strings.ToUpper(email), document["email"])
+}
+
+func TestIndexesRequireNormalisedEmails(t *testing.T) {
+	// A database of its own as the indexes are checked against every client
+	database := clients.Database().Client().Database(dbName + "_indexes")
+	defer database.Drop(context.Background())
+	users := database.Collection("users")
+
+	// A client that has not been migrated yet
+	legacy, _ := users.InsertOne(context.Background(), bson.M{"email": "Bob@Example.com", "groups": []string{}})
+	assert.ErrorIs(t, ensureIndexes(users), errEmailsNotNormalised)
+
+	// The unique email index is skipped but the other indexes are created
+	indexes := func() []string {
+		names := []string{}
+		cursor, err := users.Indexes().List(context.Background())
+		assert.NoError(t, err)
+		var specs []bson.M
+		assert.NoError(t, cursor.All(context.Background(), &specs))
+		for _, spec := range specs {
+			names = append(names, spec["name"].(string))
+		}
+		return names
+	}
+	assert.Contains(t, indexes(), "groups")
+	assert.NotContains(t, indexes(), "tenant_email_unique")
+
+	// Once migrated it still collides with a client registered since
+	users.InsertOne(context.Background(), bson.M{"email": "bob@example.com", "groups": []string{}, "schemaVersion": currentSchemaVersion})
+	assert.NoError(t, runMigrations(users, false))
+	assert.ErrorIs(t, ensureIndexes(users), errEmailCollisions)
+
+	// The indexes are created once the collision is resolved
+	users.DeleteOne(context.Background(), bson.M{"_id": legacy.InsertedID})
+	assert.NoError(t, ensureIndexes(users))
+	assert.Contains(t, indexes(), "tenant_email_unique")
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Clients have a right of access to the data held about them. GET /me/export
+// returns the data held by client-auth as JSON. A bundled export can also be
+// requested which publishes an export request on the 'user-export' Redis stream
+// so that each participating service (configured with EXPORT_PARTICIPANTS as
+// `name=clientId` entries) can contribute the data it holds. Once every service has contributed, the bundle
+// can be downloaded as a zip archive through a time-limited link.
+
+// exportStream is the Redis stream export requests are published to
+const exportStream = "user-export"
+
+// exportPurpose is the purpose of the tokens used in export download links
+const exportPurpose = "export"
+
+// Export job statuses
+const (
+	exportCollecting = "collecting"
+	exportReady      = "ready"
+)
+
+// ClientExport describes the data client-auth holds about a client
+type ClientExport struct {
+	Profile           ExportedProfile    `json:"profile"`
+	LoginHistory      []LoginRecord      `json:"loginHistory"`
+	SuspensionHistory []SuspensionRecord `json:"suspensionHistory"`
+	Consents          []Consent          `json:"consents"`
+	LoginMethods      []Identity         `json:"loginMethods"`
+	Activity          []AuditEvent       `json:"activity"`
+}
+
+// ExportedProfile describes the client profile included in a data export. Unlike
+// the JSON representation of a Client it includes the ID, suspension status and
+// every other field held about the client, except its secrets.
+type ExportedProfile struct {
+	Id            string                 `json:"id"`
+	Kind          string                 `json:"kind"`
+	TenantId      string                 `json:"tenantId,omitempty"`
+	Email         string                 `json:"email"`
+	DisplayEmail  string                 `json:"displayEmail,omitempty"`
+	FirstName     string                 `json:"firstName,omitempty"`
+	LastName      string                 `json:"lastName,omitempty"`
+	Name          string                 `json:"name,omitempty"`
+	ExternalId    string                 `json:"externalId,omitempty"`
+	OwnerId       *primitive.ObjectID    `json:"ownerId,omitempty"`
+	OwnerTeam     string                 `json:"ownerTeam,omitempty"`
+	Groups        []string               `json:"groups"`
+	GroupGrants   []GroupGrant           `json:"groupGrants,omitempty"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	AppMetadata   map[string]interface{} `json:"appMetadata,omitempty"`
+	Suspended     bool                   `json:"suspended"`
+	DeletionState string                 `json:"deletionState,omitempty"`
+	DeleteAfter   *time.Time             `json:"deleteAfter,omitempty"`
+}
+
+// ExportJob describes a bundled data export collecting contributions from the
+// participating services
+type ExportJob struct {
+	Id            primitive.ObjectID `bson:"_id" json:"id"`
+	ClientId      primitive.ObjectID `bson:"clientId" json:"-"`
+	Status        string             `bson:"status" json:"status"`
+	Awaiting      []string           `bson:"awaiting" json:"awaiting"`
+	Contributions map[string]string  `bson:"contributions" json:"-"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// getExportCollection returns the collection export jobs are stored in
+func getExportCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("exports")
+}
+
+// exportClientData gathers the data client-auth holds about a client
+func exportClientData(ctx context.Context, clients *mongo.Collection, client *Client) (*ClientExport, error) {
+	loginHistory, err := getLoginHistory(ctx, clients, client.Id)
+	if err != nil {
+		return nil, err
+	}
+	suspensionHistory, err := getSuspensionHistory(ctx, clients, client.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	activity, err := getClientActivity(ctx, clients, client.Id.Hex(), auditMaxLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	identities, err := getIdentities(ctx, clients, client)
+	if err != nil {
+		return nil, err
+	}
+
+	consents := client.Consents
+	if consents == nil {
+		consents = []Consent{}
+	}
+
+	return &ClientExport{
+		Profile: ExportedProfile{
+			Id:            client.Id.Hex(),
+			Kind:          clientKind(client),
+			TenantId:      client.TenantId,
+			Email:         client.Email,
+			DisplayEmail:  client.DisplayEmail,
+			FirstName:     client.FirstName,
+			LastName:      client.LastName,
+			Name:          client.Name,
+			ExternalId:    client.ExternalId,
+			OwnerId:       client.OwnerId,
+			OwnerTeam:     client.OwnerTeam,
+			Groups:        client.Groups,
+			GroupGrants:   client.GroupGrants,
+			Attributes:    client.Attributes,
+			AppMetadata:   client.AppMetadata,
+			Suspended:     client.Suspended,
+			DeletionState: client.DeletionState,
+			DeleteAfter:   client.DeleteAfter,
+		},
+		LoginHistory:      loginHistory,
+		SuspensionHistory: suspensionHistory,
+		Consents:          consents,
+		LoginMethods:      identities,
+		Activity:          activity,
+	}, nil
+}
+
+// startExportJob creates a bundled export job for the client and publishes the
+// export request to the participating services
+func startExportJob(ctx context.Context, clients *mongo.Collection, rdb *redis.Client, client *Client) (*ExportJob, error) {
+	job := &ExportJob{
+		Id:            primitive.NewObjectID(),
+		ClientId:      client.Id,
+		Status:        exportCollecting,
+		Awaiting:      append([]string{}, exportParticipants...),
+		Contributions: map[string]string{},
+		CreatedAt:     time.Now(),
+	}
+	if len(job.Awaiting) == 0 {
+		job.Status = exportReady
+	}
+
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if _, err := getExportCollection(clients).InsertOne(dbCtx, job); err != nil {
+		return nil, err
+	}
+
+	cacheCtx, cancelCache := cacheContext(ctx)
+	defer cancelCache()
+	if len(job.Awaiting) > 0 {
+		err := rdb.XAdd(cacheCtx, &redis.XAddArgs{
+			Stream: exportStream,
+			Values: map[string]interface{}{
+				"exportId": job.Id.Hex(),
+				"clientId": client.Id.Hex(),
+			},
+		}).Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// getExportJob returns an export job by its hex ID
+func getExportJob(ctx context.Context, clients *mongo.Collection, id string) (*ExportJob, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	job := &ExportJob{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err = getExportCollection(clients).FindOne(dbCtx, bson.M{"_id": objID}).Decode(job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// addExportContribution stores the data contributed by a service and marks the
+// export as ready once every participating service has contributed
+func addExportContribution(ctx context.Context, clients *mongo.Collection, job *ExportJob, service string, data string) error {
+	exports := getExportCollection(clients)
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := exports.UpdateOne(dbCtx, bson.M{"_id": job.Id}, bson.M{
+		"$set":  bson.M{"contributions." + service: data},
+		"$pull": bson.M{"awaiting": service},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only mark the export as ready if no other contribution is outstanding
+	readyCtx, cancelReady := dbContext(ctx)
+	defer cancelReady()
+	_, err = exports.UpdateOne(readyCtx,
+		bson.M{"_id": job.Id, "awaiting": bson.M{"$size": 0}},
+		bson.M{"$set": bson.M{"status": exportReady}},
+	)
+	return err
+}
+
+// writeExportArchive writes a zip archive bundling the client-auth data and the
+// contribution of every participating service
+func writeExportArchive(w io.Writer, data *ClientExport, job *ExportJob) error {
+	archive := zip.NewWriter(w)
+
+	file, err := archive.Create("client-auth.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		return err
+	}
+
+	for service, contribution := range job.Contributions {
+		file, err := archive.Create(service + ".json")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(file, contribution); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// makeExportHandler returns the data client-auth holds about the authenticated
+// client
+func makeExportHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		data, err := exportClientData(c.Request.Context(), clients, client)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to export client data")
+			return
+		}
+
+		c.JSON(http.StatusOK, data)
+	}
+}
+
+// makeStartExportHandler starts a bundled data export for the authenticated
+// client
+func makeStartExportHandler(clients *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		job, err := startExportJob(c.Request.Context(), clients, rdb, client)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to start data export")
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "Data export requested", "exportId": job.Id.Hex()})
+	}
+}
+
+// makeExportStatusHandler returns the status of a bundled data export of the
+// authenticated client along with a time-limited download link once it is ready
+func makeExportStatusHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		job, err := getExportJob(c.Request.Context(), clients, c.Param("id"))
+		if err != nil || job.ClientId != client.Id {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Data export not found"})
+			return
+		}
+
+		if job.Status != exportReady {
+			c.JSON(http.StatusOK, gin.H{"export": job})
+			return
+		}
+
+		downloadToken, err := genPurposeToken(job.Id.Hex(), exportPurpose, time.Now().Add(exportLinkExpiration))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create download link"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"export": job, "downloadUrl": "/exports/" + job.Id.Hex() + "/download?token=" + downloadToken})
+	}
+}
+
+// makeExportContributionHandler lets a participating service contribute the
+// data it holds about the client to a bundled export. Services authenticate with
+// their API token as a bearer token and send the data as a JSON body.
+func makeExportContributionHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code, claim := processClaim(bearerToken(c))
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, service := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK || clientKind(service) != kindService {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		// Only the service client configured for a participant contributes on
+		// its behalf, whatever the name of other services
+		participant, ok := participantOf(exportParticipantClients, service)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "The service is not a participant of data exports"})
+			return
+		}
+
+		job, err := getExportJob(c.Request.Context(), clients, c.Param("id"))
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Data export not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get data export")
+			return
+		}
+
+		if !contains(job.Awaiting, participant) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "Data export is not awaiting a contribution from this service"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil || !json.Valid(body) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := addExportContribution(c.Request.Context(), clients, job, participant, string(body)); err != nil {
+			abortWithStorageError(c, err, "Unable to store contribution")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Contribution received"})
+	}
+}
+
+// makeExportDownloadHandler serves a ready bundled export as a zip archive. The
+// download is authorised by the token of the time-limited link rather than the
+// client cookie so that the link can be opened directly.
+func makeExportDownloadHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claim, ok := processPurposeToken(c.Query("token"), exportPurpose)
+		if !ok || claim.Id != c.Param("id") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid or expired download link"})
+			return
+		}
+
+		job, err := getExportJob(c.Request.Context(), clients, claim.Id)
+		if err != nil || job.Status != exportReady {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Data export not found"})
+			return
+		}
+
+		client := &Client{}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if err := clients.FindOne(dbCtx, bson.M{"_id": job.ClientId}).Decode(client); err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Data export not found"})
+			return
+		}
+
+		data, err := exportClientData(c.Request.Context(), clients, client)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to export client data")
+			return
+		}
+
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", `attachment; filename="export-`+job.Id.Hex()+`.zip"`)
+		if err := writeExportArchive(c.Writer, data, job); err != nil {
+			log.Println("Unable to write export archive: ", err)
+		}
+	}
+}
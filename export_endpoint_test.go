@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// registerAndLogin registers a new user through the API and returns the token
+// cookie set on login
+func registerAndLogin(email string, payload string) *http.Cookie {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(payload))
+	handler.ServeHTTP(recorder, req)
+
+	recorder = httptest.NewRecorder()
+	login := `{"email": "` + email + `", "password": "somePassword"}`
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(login))
+	handler.ServeHTTP(recorder, req)
+
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "token" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestSuccessfulExport(t *testing.T) {
+	email := genRandomEmail()
+	typed := strings.ToUpper(email[:1]) + email[1:]
+	user := `{"email": "` + typed + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": [],
+				"consents": ["terms"]}`
+	cookie := registerAndLogin(email, user)
+
+	// Data set by admins and temporary group memberships are held too
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	_, err := clients.UpdateOne(context.Background(), bson.M{"email": email}, bson.M{"$set": bson.M{
+		"attributes":  bson.M{"nickname": "Johnny"},
+		"appMetadata": bson.M{"plan": "pro"},
+		"groupGrants": []GroupGrant{{Group: "beta", ExpiresAt: expiresAt}},
+	}})
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+
+	// Create a new request
+	req, _ := http.NewRequest("GET", "/me/export", nil)
+	req.AddCookie(cookie)
+
+	// Send request to service
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var export ClientExport
+	json.Unmarshal(recorder.Body.Bytes(), &export)
+
+	// The export contains the profile, the login and the consent given at registration
+	assert.Equal(t, email, export.Profile.Email)
+	assert.Equal(t, typed, export.Profile.DisplayEmail)
+	assert.Equal(t, kindUser, export.Profile.Kind)
+	assert.Empty(t, export.Profile.TenantId)
+	assert.Equal(t, map[string]interface{}{"nickname": "Johnny"}, export.Profile.Attributes)
+	assert.Equal(t, map[string]interface{}{"plan": "pro"}, export.Profile.AppMetadata)
+	assert.Equal(t, []GroupGrant{{Group: "beta", ExpiresAt: expiresAt}}, export.Profile.GroupGrants)
+	assert.Len(t, export.LoginHistory, 1)
+	assert.Len(t, export.SuspensionHistory, 0)
+	assert.Equal(t, "terms", export.Consents[0].Purpose)
+}
+
+func TestBundledExportWithServiceContribution(t *testing.T) {
+	service, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "billing", []string{}, primitive.NilObjectID, "")
+	exportParticipants = []string{"billing"}
+	exportParticipantClients = map[string]string{"billing": service.Id.Hex()}
+	defer func() {
+		exportParticipants = []string{}
+		exportParticipantClients = map[string]string{}
+	}()
+
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+	cookie := registerAndLogin(email, user)
+
+	// Request a bundled export
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/me/exports", nil)
+	req.AddCookie(cookie)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	var started struct {
+		ExportId string `json:"exportId"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &started)
+
+	// The billing service contributes the data it holds
+	serviceToken, _ := generateAPIClientToken(context.Background(), clients, service)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/exports/"+started.ExportId+"/contributions", strings.NewReader(`{"invoices": []}`))
+	req.Header.Set("Authorization", "Bearer "+serviceToken)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Once ready the status includes a download link
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/me/exports/"+started.ExportId, nil)
+	req.AddCookie(cookie)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var status struct {
+		DownloadUrl string `json:"downloadUrl"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+	assert.NotEmpty(t, status.DownloadUrl)
+
+	// The archive bundles the client-auth data with the billing contribution
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", status.DownloadUrl, nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+	assert.Nil(t, err)
+
+	files := map[string]string{}
+	for _, file := range archive.File {
+		reader, _ := file.Open()
+		content, _ := io.ReadAll(reader)
+		files[file.Name] = string(content)
+	}
+	assert.Contains(t, files["client-auth.json"], email)
+	assert.Equal(t, `{"invoices": []}`, files["billing.json"])
+}
+
+func TestImpostorServiceCannotContributeToExport(t *testing.T) {
+	billing, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "billing", []string{}, primitive.NilObjectID, "")
+	exportParticipants = []string{"billing"}
+	exportParticipantClients = map[string]string{"billing": billing.Id.Hex()}
+	defer func() {
+		exportParticipants = []string{}
+		exportParticipantClients = map[string]string{}
+	}()
+
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+	cookie := registerAndLogin(email, user)
+
+	// Request a bundled export
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/me/exports", nil)
+	req.AddCookie(cookie)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	var started struct {
+		ExportId string `json:"exportId"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &started)
+
+	// Another client registers a service with the same name, which is refused
+	impostor, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "billing", []string{}, primitive.NewObjectID(), "")
+	impostorToken, _ := generateAPIClientToken(context.Background(), clients, impostor)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/exports/"+started.ExportId+"/contributions", strings.NewReader(`{"invoices": ["forged"]}`))
+	req.Header.Set("Authorization", "Bearer "+impostorToken)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// The export is still awaiting the billing service
+	job, err := getExportJob(context.Background(), clients, started.ExportId)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"billing"}, job.Awaiting)
+	assert.Empty(t, job.Contributions)
+}
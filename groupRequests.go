@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Clients cannot grant themselves privileged groups at registration. The
+// registration policy of the tenant (see tenants.go) gives every new client the
+// default groups and only the self-selectable groups it requests. Any other requested group
+// is recorded as a group request for an admin to approve or reject, unless the
+// registration is made by a client allowed to manage groups.
+//
+// Clients can also request temporary (just-in-time) membership of a group, e.g.
+// the "admin" group during an incident, with a justification. The request is
+// approved or rejected by a member of one of the approver groups of the group
+// or by a client allowed to manage groups. Approved membership expires after
+// the requested duration, at which point the client is removed from the group
+// and the tokens issued to it are invalidated.
+
+// Group request statuses
+const (
+	groupRequestPending  = "pending"
+	groupRequestApproved = "approved"
+	groupRequestRejected = "rejected"
+)
+
+// Group request sources
+const (
+	groupRequestRegistration = "registration"
+	groupRequestJustInTime   = "jit"
+)
+
+// How often expired group memberships are removed
+const groupGrantCheckInterval = time.Minute
+
+// GroupRequest describes a request for a client to become a member of a group.
+// Requests made at registration are for permanent membership, just-in-time
+// requests are for the given number of minutes.
+type GroupRequest struct {
+	Id              primitive.ObjectID  `bson:"_id" json:"id"`
+	ClientId        primitive.ObjectID  `bson:"clientId" json:"clientId"`
+	Group           string              `bson:"group" json:"group"`
+	Source          string              `bson:"source" json:"source"`
+	Justification   string              `bson:"justification,omitempty" json:"justification,omitempty"`
+	DurationMinutes int                 `bson:"durationMinutes,omitempty" json:"durationMinutes,omitempty"`
+	Status          string              `bson:"status" json:"status"`
+	CreatedAt       time.Time           `bson:"createdAt" json:"createdAt"`
+	DecidedBy       *primitive.ObjectID `bson:"decidedBy,omitempty" json:"decidedBy,omitempty"`
+	DecidedAt       *time.Time          `bson:"decidedAt,omitempty" json:"decidedAt,omitempty"`
+	ExpiresAt       *time.Time          `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+}
+
+// GroupRequestForm describes the expected JSON payload when a client requests
+// temporary membership of a group
+type GroupRequestForm struct {
+	Group           string `json:"group" validate:"required"`
+	Justification   string `json:"justification" validate:"required"`
+	DurationMinutes int    `json:"durationMinutes" validate:"required,min=1"`
+}
+
+// getGroupRequestCollection returns the collection group requests are stored in
+func getGroupRequestCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("groupRequests")
+}
+
+// applyRegistrationPolicy splits the groups requested at registration into the
+// groups granted straight away and the groups that need to be approved. A
+// registration made with the token of a client allowed to manage groups is
+// granted every requested group.
+func applyRegistrationPolicy(clients *mongo.Collection, c *gin.Context, tenantId string, settings TenantSettings, requested []string) ([]string, []string) {
+	granted := append([]string{}, settings.DefaultGroups...)
+	denied := []string{}
+
+	privileged := false
+	if token, err := c.Cookie("token"); err == nil {
+		if code, claim := processClaim(token); code == http.StatusOK {
+			status, admin := authorise(clients, c, claim, permGroupsManage, nil)
+			privileged = status == http.StatusOK && (admin.TenantId == "" || admin.TenantId == tenantId)
+		}
+	}
+
+	for _, group := range requested {
+		switch {
+		case contains(granted, group) || contains(denied, group):
+			continue
+		case privileged || contains(settings.SelfSelectableGroups, group):
+			granted = append(granted, group)
+		default:
+			denied = append(denied, group)
+		}
+	}
+	return granted, denied
+}
+
+// recordGroupRequests records a pending request for each group the client was
+// not granted
+func recordGroupRequests(ctx context.Context, clients *mongo.Collection, clientId primitive.ObjectID, groups []string, source string) {
+	now := time.Now()
+	for _, group := range groups {
+		request := &GroupRequest{
+			Id:        primitive.NewObjectID(),
+			ClientId:  clientId,
+			Group:     group,
+			Source:    source,
+			Status:    groupRequestPending,
+			CreatedAt: now,
+		}
+		dbCtx, cancel := dbContext(ctx)
+		_, err := getGroupRequestCollection(clients).InsertOne(dbCtx, request)
+		cancel()
+		if err != nil {
+			log.Println("Unable to record group request: ", err)
+		}
+	}
+}
+
+// approvableGroups returns the groups whose membership requests the client can
+// approve as a member of one of their approver groups
+func approvableGroups(ctx context.Context, clients *mongo.Collection, client *Client) ([]string, error) {
+	groups := []Group{}
+	filter := tenantFilter(client.TenantId)
+	filter["approvers"] = bson.M{"$in": client.Groups}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getGroupCollection(clients).Find(dbCtx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(dbCtx, &groups); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, group := range groups {
+		if group.Name == "" {
+			group.Name = group.Key
+		}
+		names = append(names, group.Name)
+	}
+	return names, nil
+}
+
+// canManageGroups checks if a client is granted the groups:manage permission
+func canManageGroups(clients *mongo.Collection, c *gin.Context, client *Client) (bool, error) {
+	return clientAuthorised(clients, c, client, permGroupsManage, nil)
+}
+
+// grantGroup adds a client to a group. A membership with a duration is recorded
+// as a grant expiring after it, replacing any previous grant of the group, while
+// a permanent membership replaces any grant. A client that is already a
+// permanent member is left as is.
+func grantGroup(ctx context.Context, clients *mongo.Collection, clientId primitive.ObjectID, group string, expiresAt *time.Time) error {
+	client := &Client{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if err := clients.FindOne(dbCtx, bson.M{"_id": clientId}).Decode(client); err != nil {
+		return err
+	}
+
+	granted := false
+	for _, grant := range client.GroupGrants {
+		granted = granted || grant.Group == group
+	}
+	if inGroup(client, group) && !granted {
+		return nil
+	}
+
+	addCtx, cancelAdd := dbContext(ctx)
+	defer cancelAdd()
+	_, err := clients.UpdateOne(addCtx, bson.M{"_id": clientId}, bson.M{
+		"$addToSet": bson.M{"groups": group},
+		"$pull":     bson.M{"groupGrants": bson.M{"group": group}},
+		"$inc":      bson.M{"version": 1},
+	})
+	if err != nil || expiresAt == nil {
+		return err
+	}
+	grantCtx, cancelGrant := dbContext(ctx)
+	defer cancelGrant()
+	_, err = clients.UpdateOne(grantCtx, bson.M{"_id": clientId}, bson.M{
+		"$push": bson.M{"groupGrants": GroupGrant{Group: group, ExpiresAt: *expiresAt}},
+		"$inc":  bson.M{"version": 1},
+	})
+	return err
+}
+
+// decideGroupRequest approves or rejects a pending group request. Approving
+// the request adds the client to the group, until the requested duration has
+// elapsed for just-in-time requests.
+func decideGroupRequest(ctx context.Context, clients *mongo.Collection, id primitive.ObjectID, decidedBy primitive.ObjectID, status string) (*GroupRequest, error) {
+	now := time.Now()
+	update := bson.M{"status": status, "decidedBy": decidedBy, "decidedAt": now}
+
+	pending := &GroupRequest{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getGroupRequestCollection(clients).FindOne(dbCtx, bson.M{"_id": id, "status": groupRequestPending}).Decode(pending)
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt *time.Time
+	if status == groupRequestApproved && pending.DurationMinutes > 0 {
+		expiry := now.Add(time.Duration(pending.DurationMinutes) * time.Minute)
+		expiresAt = &expiry
+		update["expiresAt"] = expiry
+	}
+
+	request := &GroupRequest{}
+	decideCtx, cancelDecide := dbContext(ctx)
+	defer cancelDecide()
+	err = getGroupRequestCollection(clients).FindOneAndUpdate(decideCtx,
+		bson.M{"_id": id, "status": groupRequestPending},
+		bson.M{"$set": update},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == groupRequestApproved {
+		err = grantGroup(ctx, clients, request.ClientId, request.Group, expiresAt)
+	}
+	return request, err
+}
+
+// expireGroupGrants removes clients from the groups whose grant has expired and
+// invalidates the tokens issued to them, which still carry the groups
+func expireGroupGrants(clients *mongo.Collection) {
+	now := time.Now()
+	dbCtx, cancel := dbBulkContext(context.Background())
+	defer cancel()
+	cursor, err := clients.Find(dbCtx, bson.M{"groupGrants.expiresAt": bson.M{"$lte": now}})
+	if err != nil {
+		log.Println("Unable to query expired group grants: ", err)
+		return
+	}
+	var expired []Client
+	if err := cursor.All(dbCtx, &expired); err != nil {
+		log.Println("Unable to decode expired group grants: ", err)
+		return
+	}
+
+	for _, client := range expired {
+		for _, grant := range client.GroupGrants {
+			if grant.ExpiresAt.After(now) {
+				continue
+			}
+			updateCtx, cancelUpdate := dbContext(context.Background())
+			_, err := clients.UpdateOne(updateCtx, bson.M{"_id": client.Id}, bson.M{
+				"$pull": bson.M{"groups": grant.Group, "groupGrants": bson.M{"group": grant.Group, "expiresAt": bson.M{"$lte": now}}},
+				"$inc":  bson.M{"tokenVersion": 1, "version": 1},
+			})
+			cancelUpdate()
+			if err != nil {
+				log.Println("Unable to remove expired group grant of client "+client.Id.Hex()+": ", err)
+			}
+		}
+	}
+}
+
+// runGroupGrantWorker periodically removes expired group memberships. This is
+// a blocking call and is expected to be run in its own goroutine.
+func runGroupGrantWorker(clients *mongo.Collection) {
+	ticker := time.NewTicker(groupGrantCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		expireGroupGrants(clients)
+	}
+}
+
+// findGroupRequests returns the group requests matching the filter, most
+// recent first
+func findGroupRequests(ctx context.Context, clients *mongo.Collection, filter bson.M) ([]GroupRequest, error) {
+	requests := []GroupRequest{}
+	opts := options.Find().SetSort(bson.M{"createdAt": -1})
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getGroupRequestCollection(clients).Find(dbCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &requests)
+	return requests, err
+}
+
+// makeCreateGroupRequestHandler lets the authenticated client request temporary
+// membership of a group
+func makeCreateGroupRequestHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form GroupRequestForm
+
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if time.Duration(form.DurationMinutes)*time.Minute > groupGrantMaxDuration {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Requested duration exceeds the maximum of " + groupGrantMaxDuration.String()})
+			return
+		}
+
+		if !groupExists(c.Request.Context(), clients, client.TenantId, form.Group) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown group: " + form.Group})
+			return
+		}
+
+		if inGroup(client, form.Group) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "You are already a member of the group"})
+			return
+		}
+
+		request := &GroupRequest{
+			Id:              primitive.NewObjectID(),
+			ClientId:        client.Id,
+			Group:           form.Group,
+			Source:          groupRequestJustInTime,
+			Justification:   form.Justification,
+			DurationMinutes: form.DurationMinutes,
+			Status:          groupRequestPending,
+			CreatedAt:       time.Now(),
+		}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := getGroupRequestCollection(clients).InsertOne(dbCtx, request); err != nil {
+			abortWithStorageError(c, err, "Unable to request group membership")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "group-request", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess, Reason: form.Group})
+		c.JSON(http.StatusCreated, gin.H{"request": request})
+	}
+}
+
+// makeListGroupRequestsHandler lists the group requests the client can decide,
+// optionally filtered by status. Clients allowed to manage groups see every
+// request, approvers the requests for the groups they approve.
+func makeListGroupRequestsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		manager, err := canManageGroups(clients, c, client)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list group requests")
+			return
+		}
+		filter := bson.M{}
+		if !manager {
+			groups, err := approvableGroups(c.Request.Context(), clients, client)
+			if err != nil {
+				abortWithStorageError(c, err, "Unable to list group requests")
+				return
+			}
+			if len(groups) == 0 {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+				return
+			}
+			filter["group"] = bson.M{"$in": groups}
+		}
+		if requestStatus := c.Query("status"); requestStatus != "" {
+			filter["status"] = requestStatus
+		}
+
+		requests, err := findGroupRequests(c.Request.Context(), clients, filter)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list group requests")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"requests": requests})
+	}
+}
+
+// makeMyGroupRequestsHandler lists the group requests of the authenticated
+// client
+func makeMyGroupRequestsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		requests, err := findGroupRequests(c.Request.Context(), clients, bson.M{"clientId": client.Id})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list group requests")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"requests": requests})
+	}
+}
+
+// makeDecideGroupRequestHandler approves or rejects a pending group request
+// with the given status. Clients cannot decide their own requests.
+func makeDecideGroupRequestHandler(clients *mongo.Collection, status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		authStatus, approver := authAndAuthorised(c.Request.Context(), clients, claim)
+		if authStatus != http.StatusOK {
+			c.AbortWithStatusJSON(authStatus, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		objID, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		pending := &GroupRequest{}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		err := getGroupRequestCollection(clients).FindOne(dbCtx, bson.M{"_id": objID, "status": groupRequestPending}).Decode(pending)
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Pending group request not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to decide group request")
+			return
+		}
+
+		authorised, err := canManageGroups(clients, c, approver)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to decide group request")
+			return
+		}
+		if !authorised {
+			groups, err := approvableGroups(c.Request.Context(), clients, approver)
+			if err != nil {
+				abortWithStorageError(c, err, "Unable to decide group request")
+				return
+			}
+			authorised = contains(groups, pending.Group)
+		}
+		if !authorised || pending.ClientId == approver.Id {
+			recordAudit(clients, c, AuditEvent{Action: "group-request-" + status, ActorId: approver.Id.Hex(), TargetId: pending.ClientId.Hex(), Outcome: auditFailure, Reason: "not authorised"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		request, err := decideGroupRequest(c.Request.Context(), clients, objID, approver.Id, status)
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Pending group request not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to decide group request")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "group-request-" + status, ActorId: approver.Id.Hex(), TargetId: request.ClientId.Hex(), Outcome: auditSuccess, Reason: request.Group})
+		c.JSON(http.StatusOK, gin.H{"request": request})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPrivilegedGroupRequiresApproval(t *testing.T) {
+	registrationSelfSelectableGroups = []string{"tempProbes"}
+	defer func() { registrationSelfSelectableGroups = []string{} }()
+
+	recorder := httptest.NewRecorder()
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": ["tempProbes", "admin"]}`
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	handler.ServeHTTP(recorder, req)
+
+	// The self-selectable group is granted while the admin group is pending
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, `{"message":"User registered successfully","pendingGroups":["admin"]}`, recorder.Body.String())
+
+	client, _ := getClientByEmail(context.Background(), clients, "", email)
+	assert.Equal(t, []string{"tempProbes"}, client.Groups)
+
+	request := &GroupRequest{}
+	getGroupRequestCollection(clients).FindOne(context.Background(), bson.M{"clientId": client.Id}).Decode(request)
+	assert.Equal(t, "admin", request.Group)
+	assert.Equal(t, groupRequestPending, request.Status)
+
+	// An admin approves the request
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/group-requests/"+request.Id.Hex()+"/approve", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var decided struct {
+		Request GroupRequest `json:"request"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &decided)
+	assert.Equal(t, groupRequestApproved, decided.Request.Status)
+
+	client, _ = getClientByEmail(context.Background(), clients, "", email)
+	assert.Equal(t, []string{"tempProbes", "admin"}, client.Groups)
+
+	// A decided request cannot be decided again
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/group-requests/"+request.Id.Hex()+"/reject", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestGroupRequestsRequirePermission(t *testing.T) {
+	_, token := insertTestClient(t, []string{})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/group-requests", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestJustInTimeGroupMembershipExpires(t *testing.T) {
+	// Members of the oncall-leads group approve requests for the incident group
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/groups/incident", strings.NewReader(`{"roles": ["admin"], "approvers": ["oncall-leads"]}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// An engineer requests membership for an hour
+	engineerId, engineerToken := insertTestClient(t, []string{})
+	recorder = httptest.NewRecorder()
+	payload := `{"group": "incident", "justification": "INC-42", "durationMinutes": 60}`
+	req, _ = http.NewRequest("POST", "/group-requests", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: engineerToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var created struct {
+		Request GroupRequest `json:"request"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &created)
+
+	// The engineer cannot approve their own request
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/group-requests/"+created.Request.Id.Hex()+"/approve", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: engineerToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// An approver lists and approves it
+	_, leadToken := insertTestClient(t, []string{"oncall-leads"})
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/group-requests?status=pending", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: leadToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), created.Request.Id.Hex())
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/group-requests/"+created.Request.Id.Hex()+"/approve", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: leadToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	engineer := &Client{}
+	clients.FindOne(context.Background(), bson.M{"_id": engineerId}).Decode(engineer)
+	assert.Equal(t, []string{"incident"}, engineer.Groups)
+	assert.Len(t, engineer.GroupGrants, 1)
+
+	// Once the grant expires the membership is removed and the tokens issued
+	// before are rejected
+	clients.UpdateOne(context.Background(), bson.M{"_id": engineerId}, bson.M{"$set": bson.M{"groupGrants.0.expiresAt": time.Now().Add(-time.Minute)}})
+	expireGroupGrants(clients)
+
+	engineer = &Client{}
+	clients.FindOne(context.Background(), bson.M{"_id": engineerId}).Decode(engineer)
+	assert.Empty(t, engineer.Groups)
+	assert.Empty(t, engineer.GroupGrants)
+
+	_, claim := processClaim(engineerToken)
+	code, _ := authenticate(context.Background(), clients, claim)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GroupForm describes the expected JSON payload when an admin defines a group
+type GroupForm struct {
+	Description string   `json:"description"`
+	Roles       []string `json:"roles" validate:"required"`
+	Approvers   []string `json:"approvers"`
+}
+
+// RoleForm describes the expected JSON payload when an admin defines a role
+type RoleForm struct {
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions" validate:"required,min=1"`
+}
+
+// MembershipForm describes the expected JSON payload when an admin adds a client
+// to a group
+type MembershipForm struct {
+	Group string `json:"group" validate:"required"`
+}
+
+// authoriseGroupManagement processes the token cookie of the request and checks
+// the client is allowed to manage groups and roles. It aborts the request and
+// returns false if not.
+func authoriseGroupManagement(c *gin.Context, clients *mongo.Collection) (*Client, bool) {
+	token, _ := c.Cookie("token")
+	code, claim := processClaim(token)
+	if code != http.StatusOK {
+		c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+		return nil, false
+	}
+
+	status, admin := authorise(clients, c, claim, permGroupsManage, nil)
+	if status != http.StatusOK {
+		c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+		return nil, false
+	}
+	return admin, true
+}
+
+// makeListGroupsHandler lists the defined and built-in groups of the tenant of
+// the admin
+func makeListGroupsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseGroupManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		groups := []Group{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getGroupCollection(clients).Find(dbCtx, tenantFilter(admin.TenantId))
+		if err == nil {
+			err = cursor.All(dbCtx, &groups)
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list groups")
+			return
+		}
+
+		// Groups defined before tenants were introduced have no name field
+		for i := range groups {
+			if groups[i].Name == "" {
+				groups[i].Name = groups[i].Key
+			}
+		}
+
+		for name, builtin := range builtinGroups {
+			defined := false
+			for _, group := range groups {
+				defined = defined || group.Name == name
+			}
+			if !defined {
+				groups = append(groups, builtin)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"groups": groups})
+	}
+}
+
+// makePutGroupHandler creates or replaces a group of the tenant of the admin.
+// Every role assigned to the group must exist.
+func makePutGroupHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form GroupForm
+
+		admin, ok := authoriseGroupManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		roles, err := getRoles(c.Request.Context(), clients, form.Roles)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get roles")
+			return
+		}
+		for _, name := range form.Roles {
+			found := false
+			for _, role := range roles {
+				found = found || role.Name == name
+			}
+			if !found {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown role: " + name})
+				return
+			}
+		}
+
+		group := &Group{
+			Key:         groupKey(admin.TenantId, c.Param("name")),
+			Name:        c.Param("name"),
+			TenantId:    admin.TenantId,
+			Description: form.Description,
+			Roles:       form.Roles,
+			Approvers:   form.Approvers,
+		}
+		opts := options.Replace().SetUpsert(true)
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := getGroupCollection(clients).ReplaceOne(dbCtx, bson.M{"_id": group.Key}, group, opts); err != nil {
+			abortWithStorageError(c, err, "Unable to save group")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"group": group})
+	}
+}
+
+// makeDeleteGroupHandler deletes a group definition of the tenant of the admin.
+// Clients remain members of the group but no longer get any permission through
+// it.
+func makeDeleteGroupHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseGroupManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := getGroupCollection(clients).DeleteOne(dbCtx, bson.M{"_id": groupKey(admin.TenantId, c.Param("name"))})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete group")
+			return
+		}
+		if result.DeletedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully deleted group"})
+	}
+}
+
+// makeListRolesHandler lists the defined and built-in roles
+func makeListRolesHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authoriseGroupManagement(c, clients); !ok {
+			return
+		}
+
+		roles := []Role{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getRoleCollection(clients).Find(dbCtx, bson.M{})
+		if err == nil {
+			err = cursor.All(dbCtx, &roles)
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list roles")
+			return
+		}
+
+		for name, builtin := range builtinRoles {
+			defined := false
+			for _, role := range roles {
+				defined = defined || role.Name == name
+			}
+			if !defined {
+				roles = append(roles, builtin)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"roles": roles, "permissions": knownPermissions})
+	}
+}
+
+// makePutRoleHandler creates or replaces a role
+func makePutRoleHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form RoleForm
+
+		admin, ok := authoriseGroupManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		// Roles are shared by every tenant and only managed by admins of the
+		// default tenant
+		if admin.TenantId != "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		for _, permission := range form.Permissions {
+			if !validPermission(permission) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown permission: " + permission})
+				return
+			}
+		}
+
+		role := &Role{Name: c.Param("name"), Description: form.Description, Permissions: form.Permissions}
+		opts := options.Replace().SetUpsert(true)
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := getRoleCollection(clients).ReplaceOne(dbCtx, bson.M{"_id": role.Name}, role, opts); err != nil {
+			abortWithStorageError(c, err, "Unable to save role")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"role": role})
+	}
+}
+
+// makeDeleteRoleHandler deletes a role definition. Groups assigned the role no
+// longer grant its permissions.
+func makeDeleteRoleHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseGroupManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		// Roles are shared by every tenant and only managed by admins of the
+		// default tenant
+		if admin.TenantId != "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := getRoleCollection(clients).DeleteOne(dbCtx, bson.M{"_id": c.Param("name")})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete role")
+			return
+		}
+		if result.DeletedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Role not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully deleted role"})
+	}
+}
+
+// makeAddMembershipHandler adds a client of the tenant of the admin to an
+// existing group
+func makeAddMembershipHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form MembershipForm
+
+		admin, ok := authoriseGroupManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if !groupExists(c.Request.Context(), clients, admin.TenantId, form.Group) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown group: " + form.Group})
+			return
+		}
+
+		filter := tenantFilter(admin.TenantId)
+		filter["_id"], _ = primitive.ObjectIDFromHex(c.Param("id"))
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := clients.UpdateOne(dbCtx, filter, bson.M{"$addToSet": bson.M{"groups": form.Group}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to add client to group")
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Client not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully added client to group"})
+	}
+}
+
+// makeRemoveMembershipHandler removes a client of the tenant of the admin from
+// a group
+func makeRemoveMembershipHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseGroupManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		filter := tenantFilter(admin.TenantId)
+		filter["_id"], _ = primitive.ObjectIDFromHex(c.Param("id"))
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := clients.UpdateOne(dbCtx, filter, bson.M{"$pull": bson.M{"groups": c.Param("group")}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to remove client from group")
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Client not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully removed client from group"})
+	}
+}
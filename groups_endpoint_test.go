@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// insertTestClient inserts a user client in the given groups and returns its ID
+// and a valid token. The test fails straight away if the client cannot be
+// inserted.
+func insertTestClient(t *testing.T, groups []string) (primitive.ObjectID, string) {
+	hashedPass, _ := hashAndSalt("somePassword")
+	result, err := clients.InsertOne(context.Background(), bson.D{
+		{Key: "kind", Value: kindUser},
+		{Key: "email", Value: genRandomEmail()},
+		{Key: "hashedPassword", Value: hashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: groups},
+	})
+	require.NoError(t, err)
+	id := result.InsertedID.(primitive.ObjectID)
+	token := issueTestToken(t, id.Hex())
+	return id, token
+}
+
+func TestGroupRoleGrantsPermission(t *testing.T) {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+
+	send := func(method string, url string, payload string, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Define a support role that can only suspend clients and assign it to a
+	// support group
+	recorder := send("PUT", "/roles/support", `{"permissions": ["clients:suspend"]}`, adminToken)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = send("PUT", "/groups/support", `{"description": "Support staff", "roles": ["support"]}`, adminToken)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Add a client to the support group
+	supportId, supportToken := insertTestClient(t, []string{})
+	recorder = send("POST", "/clients/"+supportId.Hex()+"/groups", `{"group": "support"}`, adminToken)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// The support client can suspend another client
+	targetId, _ := insertTestClient(t, []string{})
+	recorder = send("POST", "/suspend", `{"id": "`+targetId.Hex()+`"}`, supportToken)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// But is not granted the permission to delete clients
+	recorder = send("POST", "/delete-client", `{"id": "`+targetId.Hex()+`", "reason": "test"}`, supportToken)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestFailedRoleWithUnknownPermission(t *testing.T) {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/roles/broken", strings.NewReader(`{"permissions": ["clients:fly"]}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"message":"Unknown permission: clients:fly"}`, recorder.Body.String())
+}
+
+func TestPermissionsTokenClaims(t *testing.T) {
+	tokenClaims = claimPermissions
+	defer func() { tokenClaims = claimGroups }()
+
+	// The user is registered in the admin group by an admin
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": ["admin"]}`
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, `{"message":"User registered successfully"}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+email+`", "password": "somePassword"}`))
+	handler.ServeHTTP(recorder, req)
+	var cookie *http.Cookie
+	for _, c := range recorder.Result().Cookies() {
+		if c.Name == "token" {
+			cookie = c
+		}
+	}
+
+	// The token carries the permissions of the user rather than its groups
+	claim := &Claim{}
+	jwt.ParseWithClaims(cookie.Value, claim, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	assert.Empty(t, claim.Groups)
+	assert.Equal(t, []string{"*"}, claim.Permissions)
+}
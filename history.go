@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The login and suspension history of a client is kept so that it can be
+// returned to the client as part of a data export (see export.go).
+
+// LoginRecord describes a successful client login
+type LoginRecord struct {
+	ClientId  primitive.ObjectID `bson:"clientId" json:"-"`
+	Time      time.Time          `bson:"time" json:"time"`
+	IP        string             `bson:"ip" json:"ip"`
+	UserAgent string             `bson:"userAgent" json:"userAgent"`
+}
+
+// SuspensionRecord describes the suspension of a client by an admin
+type SuspensionRecord struct {
+	ClientId    primitive.ObjectID `bson:"clientId" json:"-"`
+	SuspendedBy primitive.ObjectID `bson:"suspendedBy" json:"suspendedBy"`
+	Time        time.Time          `bson:"time" json:"time"`
+}
+
+// getLoginHistoryCollection returns the collection login records are stored in
+func getLoginHistoryCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("loginHistory")
+}
+
+// getSuspensionHistoryCollection returns the collection suspension records are
+// stored in
+func getSuspensionHistoryCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("suspensionHistory")
+}
+
+// recordLogin records a successful login of the client from the request
+func recordLogin(ctx context.Context, clients *mongo.Collection, client *Client, c *gin.Context) {
+	record := &LoginRecord{
+		ClientId:  client.Id,
+		Time:      time.Now(),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if _, err := getLoginHistoryCollection(clients).InsertOne(dbCtx, record); err != nil {
+		log.Println("Unable to record login: ", err)
+	}
+}
+
+// recordSuspension records the suspension of a client by an admin
+func recordSuspension(ctx context.Context, clients *mongo.Collection, clientId primitive.ObjectID, suspendedBy primitive.ObjectID) {
+	record := &SuspensionRecord{
+		ClientId:    clientId,
+		SuspendedBy: suspendedBy,
+		Time:        time.Now(),
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if _, err := getSuspensionHistoryCollection(clients).InsertOne(dbCtx, record); err != nil {
+		log.Println("Unable to record suspension: ", err)
+	}
+}
+
+// getLoginHistory returns the login records of a client, most recent first
+func getLoginHistory(ctx context.Context, clients *mongo.Collection, clientId primitive.ObjectID) ([]LoginRecord, error) {
+	records := []LoginRecord{}
+	opts := options.Find().SetSort(bson.M{"time": -1})
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getLoginHistoryCollection(clients).Find(dbCtx, bson.M{"clientId": clientId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &records)
+	return records, err
+}
+
+// getSuspensionHistory returns the suspension records of a client, most recent
+// first
+func getSuspensionHistory(ctx context.Context, clients *mongo.Collection, clientId primitive.ObjectID) ([]SuspensionRecord, error) {
+	records := []SuspensionRecord{}
+	opts := options.Find().SetSort(bson.M{"time": -1})
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getSuspensionHistoryCollection(clients).Find(dbCtx, bson.M{"clientId": clientId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &records)
+	return records, err
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A client can sign in with several login methods, each recorded as an
+// identity linked to the client: a password, the subject of an upstream
+// identity provider (see oidc.go) or an API key exchanged for a token. Clients
+// list, link and unlink their login methods through /me/identities. Linking
+// requires the client to re-authenticate, either with its password or by having
+// logged in within REAUTH_MAX_AGE_MIN, and the last login method of a client
+// cannot be unlinked.
+
+// Login methods
+const (
+	identityPassword = "password"
+	identityOIDC     = "oidc"
+	identityAPIKey   = "api-key"
+)
+
+// oidcLinkPurpose is the purpose of the tokens binding the sign in with an
+// identity provider to the client linking the identity
+const oidcLinkPurpose = "oidc-link"
+
+// oidcLinkCookie is the cookie holding the link token during the sign in
+const oidcLinkCookie = "oidc_link"
+
+var errIdentityLinked = errors.New("identity already linked to another client")
+var errLastIdentity = errors.New("cannot unlink the last login method")
+
+// Identity describes a login method of a client. Secrets (password and API key
+// hashes) are never returned.
+type Identity struct {
+	Id         primitive.ObjectID `bson:"_id" json:"id"`
+	ClientId   primitive.ObjectID `bson:"clientId" json:"-"`
+	TenantId   string             `bson:"tenantId,omitempty" json:"-"`
+	Method     string             `bson:"method" json:"method"`
+	Provider   string             `bson:"provider,omitempty" json:"provider,omitempty"`
+	Subject    string             `bson:"subject,omitempty" json:"subject,omitempty"`
+	SecretHash string             `bson:"secretHash,omitempty" json:"-"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	LastUsedAt *time.Time         `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+}
+
+// LinkIdentityForm describes the expected JSON payload when a client links a
+// login method. The current password re-authenticates clients that have one
+// and have not logged in recently.
+type LinkIdentityForm struct {
+	Method          string `json:"method" validate:"required,oneof=password oidc api-key"`
+	Password        string `json:"password" validate:"required_if=Method password,max=64"`
+	Provider        string `json:"provider" validate:"required_if=Method oidc"`
+	CurrentPassword string `json:"currentPassword"`
+}
+
+// APIKeyTokenForm describes the expected JSON payload when a client exchanges
+// an API key for a token
+type APIKeyTokenForm struct {
+	APIKey string `json:"apiKey" validate:"required"`
+}
+
+// getIdentityCollection returns the collection identities are stored in
+func getIdentityCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("identities")
+}
+
+// hashAPIKey returns the hash of the secret of an API key
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// migrateLegacyPassword moves the password hash clients held before identities
+// were introduced to a password identity. It is idempotent, a password identity
+// left by an interrupted migration is kept.
+func migrateLegacyPassword(ctx context.Context, clients *mongo.Collection, client *Client) error {
+	if client.HashedPassword == "" {
+		return nil
+	}
+	identity := &Identity{
+		Id:         primitive.NewObjectID(),
+		ClientId:   client.Id,
+		TenantId:   client.TenantId,
+		Method:     identityPassword,
+		SecretHash: client.HashedPassword,
+		CreatedAt:  time.Now(),
+	}
+	identities := getIdentityCollection(clients)
+	findCtx, cancelFind := dbContext(ctx)
+	defer cancelFind()
+	err := identities.FindOne(findCtx, bson.M{"clientId": client.Id, "method": identityPassword}).Err()
+	if err == mongo.ErrNoDocuments {
+		insertCtx, cancelInsert := dbContext(ctx)
+		defer cancelInsert()
+		_, err = identities.InsertOne(insertCtx, identity)
+	}
+	if err != nil {
+		return err
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err = clients.UpdateOne(dbCtx, bson.M{"_id": client.Id}, bson.M{"$unset": bson.M{"hashedPassword": ""}})
+	client.HashedPassword = ""
+	return err
+}
+
+// getIdentities returns the login methods of a client
+func getIdentities(ctx context.Context, clients *mongo.Collection, client *Client) ([]Identity, error) {
+	if err := migrateLegacyPassword(ctx, clients, client); err != nil {
+		return nil, err
+	}
+	identities := []Identity{}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getIdentityCollection(clients).Find(dbCtx, bson.M{"clientId": client.Id})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &identities)
+	return identities, err
+}
+
+// findIdentity returns the identity of a tenant with the method, provider and
+// subject
+func findIdentity(ctx context.Context, clients *mongo.Collection, tenantId string, method string, provider string, subject string) (*Identity, error) {
+	filter := tenantFilter(tenantId)
+	filter["method"] = method
+	filter["provider"] = provider
+	filter["subject"] = subject
+	identity := &Identity{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getIdentityCollection(clients).FindOne(dbCtx, filter).Decode(identity)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// getPasswordIdentity returns the password identity of a client
+func getPasswordIdentity(ctx context.Context, clients *mongo.Collection, client *Client) (*Identity, error) {
+	if err := migrateLegacyPassword(ctx, clients, client); err != nil {
+		return nil, err
+	}
+	identity := &Identity{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getIdentityCollection(clients).FindOne(dbCtx, bson.M{"clientId": client.Id, "method": identityPassword}).Decode(identity)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// linkIdentity links an identity to a client. Identities of an identity
+// provider can only be linked to one client of a tenant, and only login methods
+// the kind of the client allows (see kinds.go) can be linked.
+func linkIdentity(ctx context.Context, clients *mongo.Collection, client *Client, identity *Identity) error {
+	if !kindAllowsMethod(client, identity.Method) {
+		return errMethodNotAllowed
+	}
+	if identity.Method == identityOIDC {
+		existing, err := findIdentity(ctx, clients, client.TenantId, identityOIDC, identity.Provider, identity.Subject)
+		if err == nil && existing.ClientId != client.Id {
+			return errIdentityLinked
+		}
+		if err == nil {
+			*identity = *existing
+			return nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+
+	identity.Id = primitive.NewObjectID()
+	identity.ClientId = client.Id
+	identity.TenantId = client.TenantId
+	identity.CreatedAt = time.Now()
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := getIdentityCollection(clients).InsertOne(dbCtx, identity)
+	return err
+}
+
+// linkPassword links a password identity to a client
+func linkPassword(ctx context.Context, clients *mongo.Collection, client *Client, password string) error {
+	hashedPassword, err := hashAndSalt(password)
+	if err != nil {
+		return err
+	}
+	return linkIdentity(ctx, clients, client, &Identity{Method: identityPassword, SecretHash: hashedPassword})
+}
+
+// setPassword replaces the password of a client, linking a password identity
+// if the client has none, and notifies the webhook subscribers
+func setPassword(ctx context.Context, clients *mongo.Collection, client *Client, password string) error {
+	identity, err := getPasswordIdentity(ctx, clients, client)
+	if err == mongo.ErrNoDocuments {
+		err = linkPassword(ctx, clients, client, password)
+	} else if err == nil {
+		var hashedPassword string
+		hashedPassword, err = hashAndSalt(password)
+		if err == nil {
+			dbCtx, cancel := dbContext(ctx)
+			defer cancel()
+			_, err = getIdentityCollection(clients).UpdateOne(dbCtx, bson.M{"_id": identity.Id}, bson.M{"$set": bson.M{"secretHash": hashedPassword}})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	dispatchWebhookEvent(clients, webhookClientPasswordChanged, gin.H{"clientId": client.Id.Hex()})
+	return nil
+}
+
+// unlinkIdentity unlinks an identity from a client, unless it is the last login
+// method of the client
+func unlinkIdentity(ctx context.Context, clients *mongo.Collection, client *Client, id primitive.ObjectID) error {
+	identities, err := getIdentities(ctx, clients, client)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, identity := range identities {
+		found = found || identity.Id == id
+	}
+	if !found {
+		return mongo.ErrNoDocuments
+	}
+	if len(identities) == 1 {
+		return errLastIdentity
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err = getIdentityCollection(clients).DeleteOne(dbCtx, bson.M{"_id": id, "clientId": client.Id})
+	return err
+}
+
+// touchIdentity records when an identity was last used to sign in
+func touchIdentity(ctx context.Context, clients *mongo.Collection, identity *Identity) {
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	getIdentityCollection(clients).UpdateOne(dbCtx, bson.M{"_id": identity.Id}, bson.M{"$set": bson.M{"lastUsedAt": time.Now()}})
+}
+
+// passwordMatches checks a password against the password identity of a
+// client. A client without a password matches no password.
+func passwordMatches(ctx context.Context, clients *mongo.Collection, client *Client, password string) (bool, error) {
+	identity, err := getPasswordIdentity(ctx, clients, client)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !verifyPassword(identity.SecretHash, password) {
+		return false, nil
+	}
+	touchIdentity(ctx, clients, identity)
+	return true, nil
+}
+
+// reauthenticated checks a client has just proven its identity, either with
+// its current password or by having logged in within REAUTH_MAX_AGE_MIN
+func reauthenticated(ctx context.Context, clients *mongo.Collection, client *Client, claim *Claim, currentPassword string) (bool, error) {
+	if currentPassword != "" {
+		return passwordMatches(ctx, clients, client, currentPassword)
+	}
+	return claim.IssuedAt != nil && time.Since(claim.IssuedAt.Time) <= reauthenticationMaxAge, nil
+}
+
+// authenticateRequest processes the token cookie of the request and
+// authenticates the client. It aborts the request and returns false if not.
+func authenticateRequest(c *gin.Context, clients *mongo.Collection) (*Client, *Claim, bool) {
+	token, _ := c.Cookie("token")
+	code, claim := processClaim(token)
+	if code != http.StatusOK {
+		c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+		return nil, nil, false
+	}
+
+	status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+	if status != http.StatusOK {
+		c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+		return nil, nil, false
+	}
+	return client, claim, true
+}
+
+// makeListIdentitiesHandler lists the login methods of the authenticated client
+func makeListIdentitiesHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, _, ok := authenticateRequest(c, clients)
+		if !ok {
+			return
+		}
+
+		identities, err := getIdentities(c.Request.Context(), clients, client)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list login methods")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"identities": identities})
+	}
+}
+
+// makeLinkIdentityHandler links a login method to the authenticated client. A
+// password is set straight away and an API key is returned once, while linking
+// an identity provider returns the URL starting the sign in with the provider.
+func makeLinkIdentityHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form LinkIdentityForm
+
+		client, claim, ok := authenticateRequest(c, clients)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if !kindAllowsMethod(client, form.Method) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "The login method is not allowed for a " + clientKind(client)})
+			return
+		}
+
+		proven, err := reauthenticated(c.Request.Context(), clients, client, claim, form.CurrentPassword)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to check current password")
+			return
+		}
+		if !proven {
+			recordAudit(clients, c, AuditEvent{Action: "link-identity", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditFailure, Reason: "re-authentication required"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Re-authentication required, log in again or give your current password"})
+			return
+		}
+
+		switch form.Method {
+		case identityPassword:
+			if _, err := getPasswordIdentity(c.Request.Context(), clients, client); err == nil {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A password is already set"})
+				return
+			}
+			settings, err := getTenantSettings(c.Request.Context(), clients, client.TenantId)
+			if err != nil {
+				abortWithStorageError(c, err, "Unable to get tenant settings")
+				return
+			}
+			if err := settings.checkPassword(form.Password); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+			if err := linkPassword(c.Request.Context(), clients, client, form.Password); err != nil {
+				abortWithStorageError(c, err, "Unable to link login method")
+				return
+			}
+			recordAudit(clients, c, AuditEvent{Action: "link-identity", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess, Reason: identityPassword})
+			dispatchWebhookEvent(clients, webhookClientPasswordChanged, gin.H{"clientId": client.Id.Hex()})
+			c.JSON(http.StatusCreated, gin.H{"message": "Login method linked"})
+
+		case identityAPIKey:
+			secret, err := randomHex(32)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to generate API key"})
+				return
+			}
+			identity := &Identity{Method: identityAPIKey, SecretHash: hashAPIKey(secret)}
+			if err := linkIdentity(c.Request.Context(), clients, client, identity); err != nil {
+				abortWithStorageError(c, err, "Unable to link login method")
+				return
+			}
+			recordAudit(clients, c, AuditEvent{Action: "link-identity", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess, Reason: identityAPIKey})
+			c.JSON(http.StatusCreated, gin.H{"message": "Login method linked", "identity": identity, "apiKey": identity.Id.Hex() + "." + secret})
+
+		case identityOIDC:
+			if _, ok := oidcProviders[form.Provider]; !ok {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Identity provider not found"})
+				return
+			}
+			linkToken, err := genPurposeToken(client.Id.Hex(), oidcLinkPurpose, time.Now().Add(10*time.Minute))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to start sign in"})
+				return
+			}
+			c.SetCookie(oidcLinkCookie, linkToken, 600, "/", "localhost", false, true)
+			c.JSON(http.StatusOK, gin.H{"message": "Sign in with the identity provider to link it", "redirectUrl": "/oidc/" + form.Provider + "/login"})
+		}
+	}
+}
+
+// makeUnlinkIdentityHandler unlinks a login method from the authenticated
+// client
+func makeUnlinkIdentityHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, _, ok := authenticateRequest(c, clients)
+		if !ok {
+			return
+		}
+
+		objID, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		err := unlinkIdentity(c.Request.Context(), clients, client, objID)
+		switch err {
+		case nil:
+			recordAudit(clients, c, AuditEvent{Action: "unlink-identity", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess, Reason: c.Param("id")})
+			c.JSON(http.StatusOK, gin.H{"message": "Login method unlinked"})
+		case mongo.ErrNoDocuments:
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Login method not found"})
+		case errLastIdentity:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "The last login method cannot be unlinked"})
+		default:
+			abortWithStorageError(c, err, "Unable to unlink login method")
+		}
+	}
+}
+
+// makeAPIKeyTokenHandler exchanges an API key for a token valid for the token
+// lifetime of the tenant of the client
+func makeAPIKeyTokenHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form APIKeyTokenForm
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		id, secret, _ := strings.Cut(form.APIKey, ".")
+		objID, _ := primitive.ObjectIDFromHex(id)
+		identity := &Identity{}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		err := getIdentityCollection(clients).FindOne(dbCtx, bson.M{"_id": objID, "method": identityAPIKey}).Decode(identity)
+		if err != nil || subtle.ConstantTimeCompare([]byte(identity.SecretHash), []byte(hashAPIKey(secret))) != 1 {
+			recordAudit(clients, c, AuditEvent{Action: "login", Outcome: auditFailure, Reason: "invalid API key"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid API key"})
+			return
+		}
+
+		user, err := getClientByIdOrEmail(c.Request.Context(), clients, identity.TenantId, identity.ClientId.Hex(), "")
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid API key"})
+			return
+		}
+
+		if !loginAllowed(clients, c, user) {
+			return
+		}
+
+		token, expirationTime, err := issueLoginToken(clients, c, user)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create token"})
+			return
+		}
+		touchIdentity(c.Request.Context(), clients, identity)
+
+		c.JSON(http.StatusOK, gin.H{"token": token, "expiresAt": expirationTime})
+	}
+}
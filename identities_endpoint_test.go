@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// sendWithCookie sends a request with the token cookie
+func sendWithCookie(method string, path string, payload string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+	req.AddCookie(cookie)
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// listIdentities lists the login methods of the client of the token cookie
+func listIdentities(cookie *http.Cookie) []Identity {
+	var response struct {
+		Identities []Identity `json:"identities"`
+	}
+	recorder := sendWithCookie("GET", "/me/identities", "", cookie)
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response.Identities
+}
+
+func TestLinkAndUnlinkLoginMethods(t *testing.T) {
+	email := genRandomEmail()
+	cookie := registerAndLogin(email, `{"email": "`+email+`", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`)
+
+	identities := listIdentities(cookie)
+	assert.Len(t, identities, 1)
+	assert.Equal(t, identityPassword, identities[0].Method)
+
+	// The last login method cannot be unlinked
+	recorder := sendWithCookie("DELETE", "/me/identities/"+identities[0].Id.Hex(), "", cookie)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	// Link an API key, which is exchanged for a token
+	recorder = sendWithCookie("POST", "/me/identities", `{"method": "api-key"}`, cookie)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var linked struct {
+		APIKey string `json:"apiKey"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &linked)
+
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/token", strings.NewReader(`{"apiKey": "`+linked.APIKey+`"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// With two login methods the password can be unlinked
+	recorder = sendWithCookie("DELETE", "/me/identities/"+identities[0].Id.Hex(), "", cookie)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+email+`", "password": "somePassword"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestLinkRequiresReauthentication(t *testing.T) {
+	// Tokens without an issue time were not issued by a recent login
+	_, token := insertTestClient(t, []string{})
+	cookie := &http.Cookie{Name: "token", Value: token}
+
+	recorder := sendWithCookie("POST", "/me/identities", `{"method": "api-key"}`, cookie)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// The password held before identities were introduced re-authenticates
+	recorder = sendWithCookie("POST", "/me/identities", `{"method": "api-key", "currentPassword": "somePassword"}`, cookie)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Len(t, listIdentities(cookie), 2)
+}
+
+func TestLinkIdentityOfAnotherClient(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	defer stub.server.Close()
+
+	// The identity signs in as the client with its verified email address
+	owner := genRandomEmail()
+	stub.signIn(jwt.MapClaims{"sub": "subject-" + owner, "email": owner, "email_verified": true})
+
+	email := genRandomEmail()
+	cookie := registerAndLogin(email, `{"email": "`+email+`", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`)
+	recorder := sendWithCookie("POST", "/me/identities", `{"method": "oidc", "provider": "stub"}`, cookie)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var linkCookie *http.Cookie
+	for _, c := range recorder.Result().Cookies() {
+		if c.Name == oidcLinkCookie {
+			linkCookie = c
+		}
+	}
+
+	// Sign in with the identity of the other client to link it
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oidc/stub/login", nil)
+	handler.ServeHTTP(recorder, req)
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+	stateCookie := recorder.Result().Cookies()[0]
+	stub.claims = jwt.MapClaims{"sub": "subject-" + owner, "email": owner, "email_verified": true, "iss": stub.server.URL,
+		"aud": "client-auth", "exp": time.Now().Add(time.Minute).Unix(), "nonce": location.Query().Get("nonce")}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oidc/stub/callback?code=code&state="+location.Query().Get("state"), nil)
+	req.AddCookie(stateCookie)
+	req.AddCookie(linkCookie)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Len(t, listIdentities(cookie), 1)
+}
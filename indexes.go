@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// emailIndex is the unique email index of the client collection. It is what
+// makes registrations and email changes race-free: of concurrent writes with the
+// same email address in a tenant only one succeeds and the others fail with a
+// duplicate key error (see emailTakenError). Clients of the default tenant have
+// no tenant ID and share the null tenant in the index.
+var emailIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "tenantId", Value: 1}, {Key: "email", Value: 1}},
+	Options: options.Index().SetName("tenant_email_unique").SetUnique(true),
+}
+
+// clientIndexes are the other indexes of the client collection
+var clientIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "groups", Value: 1}},
+		Options: options.Index().SetName("groups"),
+	},
+	{
+		Keys:    bson.D{{Key: "suspended", Value: 1}},
+		Options: options.Index().SetName("suspended"),
+	},
+}
+
+// policyIndexes are the indexes of the policy collection. The unique version
+// index makes concurrent saves of a policy claim distinct versions (see
+// savePolicy).
+var policyIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "name", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetName("name_version_unique").SetUnique(true),
+	},
+}
+
+// errEmailsNotNormalised is returned when the unique email index is skipped
+// because the email addresses of some clients are not normalised yet
+var errEmailsNotNormalised = errors.New("the email addresses of some clients are not normalised yet, run the migrations first")
+
+// errEmailCollisions is returned when the unique email index is skipped because
+// clients share an email address once normalised
+var errEmailCollisions = errors.New("some clients share an email address once normalised, resolve the collisions logged above")
+
+// ensureIndexes creates the indexes of the client collection and of the
+// collections stored alongside it that do not exist yet. The unique email index
+// is only created after the email normalisation migration: until then, and
+// while clients share an email address once normalised, a client stored with a
+// legacy mixed case address and a new client registered with its normalised
+// form would both be allowed by it. ensureIndexes then creates the other
+// indexes and returns errEmailsNotNormalised or errEmailCollisions, and the
+// unique email index is created the next time it runs once resolved.
+func ensureIndexes(clients *mongo.Collection) error {
+	if _, err := clients.Indexes().CreateMany(context.Background(), clientIndexes); err != nil {
+		return err
+	}
+	if _, err := getPolicyCollection(clients).Indexes().CreateMany(context.Background(), policyIndexes); err != nil {
+		return err
+	}
+
+	pending, err := clients.CountDocuments(context.Background(), belowSchemaVersion(emailNormalisationVersion))
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return errEmailsNotNormalised
+	}
+	colliding, err := reportEmailCollisions(clients)
+	if err != nil {
+		return err
+	}
+	if len(colliding) > 0 {
+		return errEmailCollisions
+	}
+	_, err = clients.Indexes().CreateOne(context.Background(), emailIndex)
+	return err
+}
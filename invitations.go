@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admins invite users by email address with pre-assigned groups. The invitee
+// receives a signed link that expires and can only be used once to register
+// with the invited email address. With REGISTRATION_MODE set to invite, users
+// can only register through an invitation.
+
+// Registration modes (REGISTRATION_MODE)
+const (
+	// Anyone can register through /register-user (default)
+	registrationOpen = "open"
+	// Users can only register by accepting an invitation
+	registrationInvite = "invite"
+)
+
+// invitationPurpose is the purpose of the tokens used in invite links
+const invitationPurpose = "invitation"
+
+// Invitation statuses
+const (
+	invitationPending  = "pending"
+	invitationAccepted = "accepted"
+	invitationRevoked  = "revoked"
+)
+
+// Invitation describes an email address invited to register to a tenant
+type Invitation struct {
+	Id         primitive.ObjectID  `bson:"_id" json:"id"`
+	TenantId   string              `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
+	Email      string              `bson:"email" json:"email"`
+	Groups     []string            `bson:"groups" json:"groups"`
+	Status     string              `bson:"status" json:"status"`
+	InvitedBy  primitive.ObjectID  `bson:"invitedBy" json:"invitedBy"`
+	CreatedAt  time.Time           `bson:"createdAt" json:"createdAt"`
+	ExpiresAt  time.Time           `bson:"expiresAt" json:"expiresAt"`
+	AcceptedAt *time.Time          `bson:"acceptedAt,omitempty" json:"acceptedAt,omitempty"`
+	ClientId   *primitive.ObjectID `bson:"clientId,omitempty" json:"clientId,omitempty"`
+}
+
+// InvitationForm describes the expected JSON payload when an admin invites an
+// email address. Admins of the default tenant can invite to any tenant.
+type InvitationForm struct {
+	Email    string   `json:"email" validate:"required,email"`
+	Groups   []string `json:"groups"`
+	TenantId string   `json:"tenantId"`
+}
+
+// AcceptInvitationForm describes the expected JSON payload when a user accepts
+// an invitation. The email address is the invited one.
+type AcceptInvitationForm struct {
+	Token     string   `json:"token" validate:"required"`
+	Password  string   `json:"password" validate:"required,min=8,max=64"`
+	FirstName string   `json:"firstName" validate:"required"`
+	LastName  string   `json:"lastName" validate:"required"`
+	Consents  []string `json:"consents"`
+
+	// Custom attributes validated against the attribute schema of the tenant
+	// (see attributes.go)
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// getInvitationCollection returns the collection invitations are stored in
+func getInvitationCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("invitations")
+}
+
+// inviteLink returns the link an invitee follows to accept an invitation
+func inviteLink(token string) string {
+	return invitationLinkUrl + "?token=" + token
+}
+
+// claimInvitation marks a pending, unexpired invitation as accepted so that it
+// cannot be used again, and returns it
+func claimInvitation(ctx context.Context, clients *mongo.Collection, id primitive.ObjectID) (*Invitation, error) {
+	invitation := &Invitation{}
+	now := time.Now()
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getInvitationCollection(clients).FindOneAndUpdate(dbCtx,
+		bson.M{"_id": id, "status": invitationPending, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"status": invitationAccepted, "acceptedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(invitation)
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// releaseInvitation makes a claimed invitation pending again when the invitee
+// could not be registered
+func releaseInvitation(ctx context.Context, clients *mongo.Collection, id primitive.ObjectID) {
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	getInvitationCollection(clients).UpdateOne(dbCtx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"status": invitationPending}, "$unset": bson.M{"acceptedAt": ""}},
+	)
+}
+
+// makeCreateInvitationHandler invites an email address to register with the
+// pre-assigned groups and returns the invite link. Admins without the
+// groups:manage permission can only pre-assign the groups users could select
+// when registering.
+func makeCreateInvitationHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form InvitationForm
+
+		admin, ok := authoriseTenantRequest(c, clients, permInvitationsManage)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		// Admins of a tenant invite to their own tenant
+		tenantId := admin.TenantId
+		if tenantId == "" {
+			tenantId = form.TenantId
+		} else if form.TenantId != "" && form.TenantId != tenantId {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		settings, err := getTenantSettings(c.Request.Context(), clients, tenantId)
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Tenant not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get tenant settings")
+			return
+		}
+
+		groups := append([]string{}, settings.DefaultGroups...)
+		manager, err := clientAuthorised(clients, c, admin, permGroupsManage, nil)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to create invitation")
+			return
+		}
+		for _, group := range form.Groups {
+			if contains(groups, group) {
+				continue
+			}
+			if !groupExists(c.Request.Context(), clients, tenantId, group) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown group " + group})
+				return
+			}
+			if !manager && !contains(settings.SelfSelectableGroups, group) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to assign the group " + group})
+				return
+			}
+			groups = append(groups, group)
+		}
+
+		if clientExists(c.Request.Context(), clients, tenantId, form.Email) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A user associated with the email address is already registered"})
+			return
+		}
+
+		now := time.Now()
+		invitation := &Invitation{
+			Id:        primitive.NewObjectID(),
+			TenantId:  tenantId,
+			Email:     form.Email,
+			Groups:    groups,
+			Status:    invitationPending,
+			InvitedBy: admin.Id,
+			CreatedAt: now,
+			ExpiresAt: now.Add(invitationExpiration),
+		}
+
+		inviteToken, err := genPurposeToken(invitation.Id.Hex(), invitationPurpose, invitation.ExpiresAt)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create invite link"})
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := getInvitationCollection(clients).InsertOne(dbCtx, invitation); err != nil {
+			abortWithStorageError(c, err, "Unable to create invitation")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "create-invitation", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: invitation.Email})
+		c.JSON(http.StatusCreated, gin.H{"invitation": invitation, "inviteToken": inviteToken, "inviteUrl": inviteLink(inviteToken)})
+	}
+}
+
+// makeListInvitationsHandler lists the invitations of the tenant of the admin,
+// optionally filtered by status
+func makeListInvitationsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseTenantRequest(c, clients, permInvitationsManage)
+		if !ok {
+			return
+		}
+
+		filter := tenantFilter(admin.TenantId)
+		if admin.TenantId == "" && c.Query("tenantId") != "" {
+			filter = tenantFilter(c.Query("tenantId"))
+		}
+		if status := c.Query("status"); status != "" {
+			filter["status"] = status
+		}
+
+		invitations := []Invitation{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getInvitationCollection(clients).Find(dbCtx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+		if err == nil {
+			err = cursor.All(dbCtx, &invitations)
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list invitations")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+	}
+}
+
+// makeRevokeInvitationHandler revokes a pending invitation so that its invite
+// link can no longer be used
+func makeRevokeInvitationHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseTenantRequest(c, clients, permInvitationsManage)
+		if !ok {
+			return
+		}
+
+		// Admins of the default tenant can revoke the invitations of any tenant
+		objID, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		filter := bson.M{"_id": objID, "status": invitationPending}
+		if admin.TenantId != "" {
+			filter["tenantId"] = admin.TenantId
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := getInvitationCollection(clients).UpdateOne(dbCtx, filter, bson.M{"$set": bson.M{"status": invitationRevoked}})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to revoke invitation")
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Pending invitation not found"})
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "revoke-invitation", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: c.Param("id")})
+		c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+	}
+}
+
+// makeAcceptInvitationHandler registers the invitee with the invited email
+// address and the pre-assigned groups
+func makeAcceptInvitationHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form AcceptInvitationForm
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		claim, ok := processPurposeToken(form.Token, invitationPurpose)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid or expired invite link"})
+			return
+		}
+
+		// Claiming the invitation makes the link single use
+		objID, _ := primitive.ObjectIDFromHex(claim.Id)
+		invitation, err := claimInvitation(c.Request.Context(), clients, objID)
+		if err == mongo.ErrNoDocuments {
+			recordAudit(clients, c, AuditEvent{Action: "accept-invitation", Outcome: auditFailure, Reason: "invitation used, revoked or expired"})
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "The invitation has already been used, revoked or has expired"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to accept invitation")
+			return
+		}
+
+		settings, err := getTenantSettings(c.Request.Context(), clients, invitation.TenantId)
+		if err != nil {
+			releaseInvitation(c.Request.Context(), clients, invitation.Id)
+			if err == mongo.ErrNoDocuments {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Tenant not found"})
+			} else {
+				abortWithStorageError(c, err, "Unable to accept invitation")
+			}
+			return
+		}
+
+		if err := settings.checkPassword(form.Password); err != nil {
+			releaseInvitation(c.Request.Context(), clients, invitation.Id)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		schema, err := getAttributeSchema(c.Request.Context(), clients, invitation.TenantId)
+		if err == nil {
+			err = validateAttributes(schema.Attributes, form.Attributes)
+		}
+		if err != nil {
+			releaseInvitation(c.Request.Context(), clients, invitation.Id)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		user, err := createNewUserClient(c.Request.Context(), clients, invitation.TenantId, invitation.Email, form.Password, form.FirstName, form.LastName, invitation.Groups, form.Consents, form.Attributes)
+		if err == errEmailTaken {
+			releaseInvitation(c.Request.Context(), clients, invitation.Id)
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A user associated with the email address is already registered"})
+			return
+		}
+		if err != nil {
+			releaseInvitation(c.Request.Context(), clients, invitation.Id)
+			abortWithStorageError(c, err, "Unable to register user")
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		getInvitationCollection(clients).UpdateOne(dbCtx, bson.M{"_id": invitation.Id}, bson.M{"$set": bson.M{"clientId": user.Id}})
+		recordAudit(clients, c, AuditEvent{Action: "accept-invitation", ActorId: user.Id.Hex(), TargetId: user.Id.Hex(), Outcome: auditSuccess, Reason: invitation.Id.Hex()})
+		dispatchWebhookEvent(clients, webhookClientRegistered, gin.H{"clientId": user.Id.Hex(), "tenantId": user.TenantId, "email": user.Email, "groups": user.Groups})
+
+		c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully"})
+	}
+}
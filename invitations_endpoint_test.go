@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// inviteTestUser invites an email address as an admin and returns the invite
+// token
+func inviteTestUser(t *testing.T, email string, groups string) string {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+
+	recorder := httptest.NewRecorder()
+	payload := `{"email": "` + email + `", "groups": ` + groups + `}`
+	req, _ := http.NewRequest("POST", "/invitations", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+
+	var response struct {
+		InviteToken string `json:"inviteToken"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response.InviteToken
+}
+
+func TestAcceptInvitation(t *testing.T) {
+	email := genRandomEmail()
+	inviteToken := inviteTestUser(t, email, `["admin"]`)
+	assert.NotEmpty(t, inviteToken)
+
+	recorder := httptest.NewRecorder()
+	payload := `{"token": "` + inviteToken + `", "password": "somePassword", "firstName": "John", "lastName": "Smith"}`
+	req, _ := http.NewRequest("POST", "/invitations/accept", strings.NewReader(payload))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	// The invitee is registered with the invited email and the pre-assigned groups
+	user, err := getClientByEmail(context.Background(), clients, "", email)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"admin"}, user.Groups)
+
+	// The invite link can only be used once
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/invitations/accept", strings.NewReader(payload))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGone, recorder.Code)
+}
+
+func TestRevokedInvitation(t *testing.T) {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/invitations", strings.NewReader(`{"email": "`+genRandomEmail()+`", "groups": []}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var response struct {
+		Invitation  Invitation `json:"invitation"`
+		InviteToken string     `json:"inviteToken"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/invitations/"+response.Invitation.Id.Hex(), nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	payload := `{"token": "` + response.InviteToken + `", "password": "somePassword", "firstName": "John", "lastName": "Smith"}`
+	req, _ = http.NewRequest("POST", "/invitations/accept", strings.NewReader(payload))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGone, recorder.Code)
+}
+
+func TestInvitationOnlyRegistration(t *testing.T) {
+	registrationMode = registrationInvite
+	defer func() { registrationMode = registrationOpen }()
+
+	recorder := httptest.NewRecorder()
+	user := `{"email": "` + genRandomEmail() + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, `{"message":"Registration is by invitation only"}`, recorder.Body.String())
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// JSONSchema describes the subset of JSON Schema (draft 2020-12) the custom
+// attributes of clients are validated against (see attributes.go): types,
+// properties, required properties, additional properties, enumerations,
+// string lengths, patterns and formats, number ranges and array items.
+// Annotations such as $schema, title and description are accepted and
+// ignored.
+type JSONSchema struct {
+	Schema      string `bson:"schema,omitempty" json:"$schema,omitempty"`
+	Title       string `bson:"title,omitempty" json:"title,omitempty"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+
+	Type string        `bson:"type,omitempty" json:"type,omitempty"`
+	Enum []interface{} `bson:"enum,omitempty" json:"enum,omitempty"`
+
+	Properties           map[string]*JSONSchema `bson:"properties,omitempty" json:"properties,omitempty"`
+	Required             []string               `bson:"required,omitempty" json:"required,omitempty"`
+	AdditionalProperties *bool                  `bson:"additionalProperties,omitempty" json:"additionalProperties,omitempty"`
+
+	MinLength *int   `bson:"minLength,omitempty" json:"minLength,omitempty"`
+	MaxLength *int   `bson:"maxLength,omitempty" json:"maxLength,omitempty"`
+	Pattern   string `bson:"pattern,omitempty" json:"pattern,omitempty"`
+	Format    string `bson:"format,omitempty" json:"format,omitempty"`
+
+	Minimum *float64 `bson:"minimum,omitempty" json:"minimum,omitempty"`
+	Maximum *float64 `bson:"maximum,omitempty" json:"maximum,omitempty"`
+
+	Items    *JSONSchema `bson:"items,omitempty" json:"items,omitempty"`
+	MinItems *int        `bson:"minItems,omitempty" json:"minItems,omitempty"`
+	MaxItems *int        `bson:"maxItems,omitempty" json:"maxItems,omitempty"`
+}
+
+// jsonSchemaTypes lists the supported types
+var jsonSchemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// jsonSchemaFormats checks the values of the supported string formats
+var jsonSchemaFormats = map[string]func(string) bool{
+	"email": func(value string) bool {
+		address, err := mail.ParseAddress(value)
+		return err == nil && address.Address == value
+	},
+	"uri": func(value string) bool {
+		u, err := url.ParseRequestURI(value)
+		return err == nil && u.Scheme != ""
+	},
+	"date": func(value string) bool {
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	},
+	"date-time": func(value string) bool {
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	},
+}
+
+// parseJSONSchema decodes a schema, refusing unsupported keywords so that a
+// schema never silently validates less than its author expects
+func parseJSONSchema(data []byte) (*JSONSchema, error) {
+	schema := &JSONSchema{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(schema); err != nil {
+		return nil, errors.New("invalid schema: " + err.Error())
+	}
+	if err := schema.check(""); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// check checks the keywords of a schema and its subschemas are valid
+func (s *JSONSchema) check(path string) error {
+	if s.Type != "" && !contains(jsonSchemaTypes, s.Type) {
+		return fmt.Errorf("invalid schema: unsupported type %q at %s", s.Type, schemaPath(path))
+	}
+	if s.Pattern != "" {
+		if _, err := regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("invalid schema: invalid pattern at %s", schemaPath(path))
+		}
+	}
+	if s.Format != "" && jsonSchemaFormats[s.Format] == nil {
+		return fmt.Errorf("invalid schema: unsupported format %q at %s", s.Format, schemaPath(path))
+	}
+	for name, property := range s.Properties {
+		if property == nil {
+			return fmt.Errorf("invalid schema: empty property %s", schemaPath(path+"."+name))
+		}
+		if err := property.check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check(path + "[]")
+	}
+	return nil
+}
+
+// schemaPath returns the path of a value for error messages
+func schemaPath(path string) string {
+	if path == "" {
+		return "the root"
+	}
+	return strings.TrimPrefix(path, ".")
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// normaliseJSON converts a value to the types encoding/json decodes into, e.g.
+// the values read from the database
+func normaliseJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalised interface{}
+	err = json.Unmarshal(data, &normalised)
+	return normalised, err
+}
+
+// validate checks a decoded JSON value against the schema, returning the first
+// violation found
+func (s *JSONSchema) validate(value interface{}, path string) error {
+	actual := jsonType(value)
+	if s.Type != "" && s.Type != actual && !(s.Type == "number" && actual == "integer") {
+		return fmt.Errorf("%s must be of type %s", schemaPath(path), s.Type)
+	}
+
+	if len(s.Enum) > 0 {
+		encoded, _ := json.Marshal(value)
+		allowed := false
+		for _, option := range s.Enum {
+			encodedOption, _ := json.Marshal(option)
+			allowed = allowed || string(encoded) == string(encodedOption)
+		}
+		if !allowed {
+			return fmt.Errorf("%s must be one of the allowed values", schemaPath(path))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", schemaPath(path), *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters long", schemaPath(path), *s.MaxLength)
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(v) {
+			return fmt.Errorf("%s must match the pattern %s", schemaPath(path), s.Pattern)
+		}
+		if s.Format != "" && !jsonSchemaFormats[s.Format](v) {
+			return fmt.Errorf("%s must be a valid %s", schemaPath(path), s.Format)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", schemaPath(path), *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s must be at most %v", schemaPath(path), *s.Maximum)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s must have at least %d items", schemaPath(path), *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s must have at most %d items", schemaPath(path), *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s is required", schemaPath(path+"."+name))
+			}
+		}
+		// Properties are checked in order so that the reported violation is
+		// stable
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s is not allowed", schemaPath(path+"."+name))
+				}
+				continue
+			}
+			if err := property.validate(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
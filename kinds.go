@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Every client has a kind, which defines the fields it must have, the login
+// methods it can hold and how long its tokens are valid for:
+// - users are people logging in through the browser
+// - services are other applications, registered and owned by a user, with a
+//   token that never expires
+// - devices (e.g. IoT devices) and bots are registered like services but their
+//   tokens expire after DEVICE_TOKEN_EXP_HOURS and BOT_TOKEN_EXP_MIN
+// Services are also members of the "service" group, which the API gateway
+// relies on.
+
+// Client kinds
+const (
+	kindUser    = "user"
+	kindService = "service"
+	kindDevice  = "device"
+	kindBot     = "bot"
+)
+
+// machineKinds are the kinds of clients registered and owned by a user
+var machineKinds = []string{kindService, kindDevice, kindBot}
+
+// errMethodNotAllowed is returned when linking a login method the kind of the
+// client cannot hold
+var errMethodNotAllowed = errors.New("login method not allowed for the kind of client")
+
+// ClientKind describes the rules applying to the clients of a kind
+type ClientKind struct {
+	// AuthMethods are the login methods (see identities.go) the clients can
+	// hold
+	AuthMethods []string
+
+	// TokenLifetime is how long the tokens issued to the clients are valid
+	// for, the token lifetime of the tenant if unset
+	TokenLifetime time.Duration
+
+	// PersistentToken is set if the token issued at registration never
+	// expires
+	PersistentToken bool
+
+	// validate checks the fields of a client of the kind
+	validate func(client *Client) error
+}
+
+// clientKinds lists the rules of every client kind
+var clientKinds = map[string]*ClientKind{
+	kindUser: {
+		AuthMethods: []string{identityPassword, identityOIDC, identityAPIKey},
+		validate: func(client *Client) error {
+			if client.Name != "" || client.OwnerId != nil {
+				return errors.New("users have a first and last name and no owner")
+			}
+			return nil
+		},
+	},
+	kindService: {
+		AuthMethods:     []string{identityAPIKey},
+		PersistentToken: true,
+		validate:        validateMachineClient,
+	},
+	kindDevice: {
+		AuthMethods:   []string{identityAPIKey},
+		TokenLifetime: deviceTokenExpiration,
+		validate:      validateMachineClient,
+	},
+	kindBot: {
+		AuthMethods:   []string{identityAPIKey},
+		TokenLifetime: botTokenExpiration,
+		validate: func(client *Client) error {
+			if client.OwnerId == nil {
+				return errors.New("bots must have an owner")
+			}
+			return validateMachineClient(client)
+		},
+	},
+}
+
+// validateMachineClient checks the fields of a service, device or bot
+func validateMachineClient(client *Client) error {
+	if client.Name == "" {
+		return errors.New("name is required")
+	}
+	if client.FirstName != "" || client.LastName != "" {
+		return errors.New("only users have a first and last name")
+	}
+	return nil
+}
+
+// clientKind returns the kind of a client. Clients that have not been
+// classified yet are services if they are members of the "service" group and
+// users otherwise.
+func clientKind(client *Client) string {
+	if client.Kind != "" {
+		return client.Kind
+	}
+	if inGroup(client, "service") {
+		return kindService
+	}
+	return kindUser
+}
+
+// isUser checks if a client is a user, as opposed to a service, device or bot
+func isUser(client *Client) bool {
+	return clientKind(client) == kindUser
+}
+
+// validateClient checks a client against the rules of its kind
+func validateClient(client *Client) error {
+	kind, ok := clientKinds[clientKind(client)]
+	if !ok {
+		return errors.New("unknown client kind " + client.Kind)
+	}
+	return kind.validate(client)
+}
+
+// kindAllowsMethod checks if the kind of a client can hold a login method
+func kindAllowsMethod(client *Client, method string) bool {
+	kind, ok := clientKinds[clientKind(client)]
+	return ok && contains(kind.AuthMethods, method)
+}
+
+// clientTokenLifetime returns how long the tokens issued to a client are valid
+// for, given the settings of its tenant
+func clientTokenLifetime(client *Client, settings TenantSettings) time.Duration {
+	if kind, ok := clientKinds[clientKind(client)]; ok && kind.TokenLifetime > 0 {
+		return kind.TokenLifetime
+	}
+	return settings.tokenLifetime()
+}
+
+// classifyClientKinds sets the kind of the clients stored before kinds were
+// introduced, from their membership of the "service" group
+func classifyClientKinds(ctx context.Context, clients *mongo.Collection) error {
+	unclassified := bson.M{"kind": bson.M{"$exists": false}}
+	services := bson.M{"kind": bson.M{"$exists": false}, "groups": "service"}
+	servicesCtx, cancelServices := dbBulkContext(ctx)
+	defer cancelServices()
+	if _, err := clients.UpdateMany(servicesCtx, services, bson.M{"$set": bson.M{"kind": kindService}}); err != nil {
+		return err
+	}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	_, err := clients.UpdateMany(dbCtx, unclassified, bson.M{"$set": bson.M{"kind": kindUser}})
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// registerTestMachine registers a client of the kind on behalf of the owner
+// and returns the claim of its API token
+func registerTestMachine(t *testing.T, ownerToken string, kind string) (string, *Claim) {
+	recorder := httptest.NewRecorder()
+	payload := `{"kind": "` + kind + `", "email": "` + genRandomEmail() + `", "name": "Sensor A", "groups": []}`
+	req, _ := http.NewRequest("POST", "/register-service", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: ownerToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var registered struct {
+		ApiToken string `json:"apiToken"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &registered)
+	claim := &Claim{}
+	jwt.ParseWithClaims(registered.ApiToken, claim, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	return registered.ApiToken, claim
+}
+
+func TestClientKindsInTokens(t *testing.T) {
+	_, ownerToken := insertTestClient(t, []string{})
+
+	// Service tokens never expire
+	_, claim := registerTestMachine(t, ownerToken, kindService)
+	assert.Equal(t, kindService, claim.Kind)
+	assert.Nil(t, claim.ExpiresAt)
+
+	// Device tokens expire
+	_, claim = registerTestMachine(t, ownerToken, kindDevice)
+	assert.Equal(t, kindDevice, claim.Kind)
+	assert.NotNil(t, claim.ExpiresAt)
+
+	recorder := sendWithCookie("POST", "/register-service", `{"kind": "printer", "email": "`+genRandomEmail()+`", "name": "Printer", "groups": []}`, &http.Cookie{Name: "token", Value: ownerToken})
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestLoginMethodsRestrictedByKind(t *testing.T) {
+	_, ownerToken := insertTestClient(t, []string{})
+	deviceToken, _ := registerTestMachine(t, ownerToken, kindDevice)
+
+	// Devices cannot hold a password
+	recorder := sendWithCookie("POST", "/me/identities", `{"method": "password", "password": "somePassword"}`, &http.Cookie{Name: "token", Value: deviceToken})
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
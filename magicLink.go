@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Users can log in without a password by requesting a login link sent to their
+// email address. The link is short-lived and can only be used once, from the
+// browser that requested it: the request sets a nonce cookie whose hash is
+// bound to the link token. Links are only sent to users that could log in, and
+// requests are rate limited per email address and per IP.
+
+// magicLinkPurpose is the purpose of the tokens used in login links
+const magicLinkPurpose = "magic-link"
+
+// magicLinkNonceCookie is the cookie binding a login link to the browser that
+// requested it
+const magicLinkNonceCookie = "magic_link_nonce"
+
+// magicLinkRateWindow is the window over which login link requests are
+// counted against MAGIC_LINK_RATE_LIMIT
+const magicLinkRateWindow = time.Hour
+
+// MagicLinkForm describes the expected JSON payload when a user requests a
+// login link
+type MagicLinkForm struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// hashNonce returns the hash of a nonce as bound to a login link token
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns a random hex encoded string of n bytes
+func randomHex(n int) (string, error) {
+	value := make([]byte, n)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(value), nil
+}
+
+// genMagicLinkToken generates the signed token of a login link for a user,
+// bound to the hash of the nonce of the requesting browser
+func genMagicLinkToken(user *Client, nonce string, expiresAt time.Time) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	claims := &Claim{
+		Id:       user.Id.Hex(),
+		Purpose:  magicLinkPurpose,
+		TenantId: user.TenantId,
+		Nonce:    hashNonce(nonce),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+// rateLimited counts a request against the limit of the key over the window and
+// checks if the limit has been exceeded
+func rateLimited(ctx context.Context, rdb *redis.Client, key string, limit int, window time.Duration) bool {
+	cacheCtx, cancel := cacheContext(ctx)
+	defer cancel()
+	count, err := rdb.Incr(cacheCtx, key).Result()
+	if err != nil {
+		log.Println("Unable to increment rate limit counter: ", err)
+		return false
+	}
+	if count == 1 {
+		expireCtx, cancelExpire := cacheContext(ctx)
+		defer cancelExpire()
+		rdb.Expire(expireCtx, key, window)
+	}
+	return count > int64(limit)
+}
+
+// makeMagicLinkHandler emails a login link to a user of the tenant of the
+// request. The response does not reveal whether the email address is
+// registered.
+func makeMagicLinkHandler(users *mongo.Collection, rdb *redis.Client, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form MagicLinkForm
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		tenantId := requestTenant(c)
+		if rateLimited(c.Request.Context(), rdb, "magic-link:email:"+groupKey(tenantId, normaliseEmail(form.Email)), magicLinkRateLimit, magicLinkRateWindow) ||
+			rateLimited(c.Request.Context(), rdb, "magic-link:ip:"+c.ClientIP(), magicLinkRateLimit*10, magicLinkRateWindow) {
+			recordAudit(users, c, AuditEvent{Action: "magic-link", Outcome: auditFailure, Reason: "rate limited"})
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "Too many login link requests, try again later"})
+			return
+		}
+
+		nonce, err := randomHex(32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create login link"})
+			return
+		}
+		expiresAt := time.Now().Add(magicLinkExpiration)
+		c.SetCookie(magicLinkNonceCookie, nonce, int(magicLinkExpiration.Seconds()), "/", "localhost", false, true)
+
+		// Only users that could log in with a password are sent a link
+		user, err := getClientByEmail(c.Request.Context(), users, tenantId, form.Email)
+		if err == nil && !user.Suspended && user.DeletionState == "" && isUser(user) {
+			token, err := genMagicLinkToken(user, nonce, expiresAt)
+			if err == nil {
+				err = mailer.Send(user.Email, "Your login link",
+					"Follow the link below to log in. It expires at "+expiresAt.Format(time.RFC1123)+
+						" and can only be used once, from the browser you requested it from.\r\n\r\n"+
+						magicLinkUrl+"?token="+token)
+			}
+			if err != nil {
+				log.Println("Unable to send login link: ", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to send login link"})
+				return
+			}
+			recordAudit(users, c, AuditEvent{Action: "magic-link", TargetId: user.Id.Hex(), Outcome: auditSuccess})
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "If the email address is registered, a login link has been sent to it"})
+	}
+}
+
+// makeConsumeMagicLinkHandler logs in the user of a login link, setting the
+// same token cookie as makeLoginHandler
+func makeConsumeMagicLinkHandler(users *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claim, ok := processPurposeToken(c.Query("token"), magicLinkPurpose)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid or expired login link"})
+			return
+		}
+
+		// The link can only be used from the browser that requested it
+		nonce, _ := c.Cookie(magicLinkNonceCookie)
+		if nonce == "" || subtle.ConstantTimeCompare([]byte(hashNonce(nonce)), []byte(claim.Nonce)) != 1 {
+			recordAudit(users, c, AuditEvent{Action: "login", TargetId: claim.Id, Outcome: auditFailure, Reason: "login link used from another browser"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "The login link must be opened in the browser it was requested from"})
+			return
+		}
+
+		// The link can only be used once
+		cacheCtx, cancel := cacheContext(c.Request.Context())
+		defer cancel()
+		used, err := rdb.SetNX(cacheCtx, "magic-link:used:"+claim.ID, claim.Id, time.Until(claim.ExpiresAt.Time)).Result()
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to use login link")
+			return
+		}
+		if !used {
+			recordAudit(users, c, AuditEvent{Action: "login", TargetId: claim.Id, Outcome: auditFailure, Reason: "login link already used"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "The login link has already been used"})
+			return
+		}
+
+		user, err := getClientByIdOrEmail(c.Request.Context(), users, claim.TenantId, claim.Id, "")
+		if err != nil || user.TenantId != claim.TenantId {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+			return
+		}
+
+		if !loginAllowed(users, c, user) {
+			return
+		}
+
+		if err := setLoginCookie(users, c, user); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create token"})
+			return
+		}
+
+		c.SetCookie(magicLinkNonceCookie, "", -1, "/", "localhost", false, true)
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully logged in"})
+	}
+}
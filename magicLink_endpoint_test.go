@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// requestMagicLink requests a login link for the email address and returns the
+// nonce cookie set on the browser and the token of the emailed link
+func requestMagicLink(t *testing.T, email string) (*http.Cookie, string) {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/magic-link", strings.NewReader(`{"email": "`+email+`"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	var nonce *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == magicLinkNonceCookie {
+			nonce = cookie
+		}
+	}
+
+	// Read the link from the file sink of the mailer
+	files, _ := filepath.Glob(filepath.Join(mailer.(*fileMailer).dir, mailFilePrefix(email)+"-*.eml"))
+	if len(files) == 0 {
+		return nonce, ""
+	}
+	message, _ := os.ReadFile(files[len(files)-1])
+	_, token, _ := strings.Cut(string(message), "?token=")
+	return nonce, strings.TrimSpace(token)
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	email := genRandomEmail()
+	registerAndLogin(email, `{"email": "`+email+`", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`)
+
+	nonce, token := requestMagicLink(t, email)
+	assert.NotEmpty(t, token)
+
+	// The link cannot be used from another browser
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/magic-link/consume?token="+token, nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/magic-link/consume?token="+token, nil)
+	req.AddCookie(nonce)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	loggedIn := false
+	for _, cookie := range recorder.Result().Cookies() {
+		loggedIn = loggedIn || (cookie.Name == "token" && cookie.Value != "")
+	}
+	assert.True(t, loggedIn)
+
+	// The link can only be used once
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/magic-link/consume?token="+token, nil)
+	req.AddCookie(nonce)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `{"message":"The login link has already been used"}`, recorder.Body.String())
+}
+
+func TestMagicLinkUnknownEmail(t *testing.T) {
+	email := genRandomEmail()
+
+	// The response does not reveal the email is not registered
+	_, token := requestMagicLink(t, email)
+	assert.Empty(t, token)
+}
+
+func TestMagicLinkRateLimit(t *testing.T) {
+	email := genRandomEmail()
+	for i := 0; i < magicLinkRateLimit; i++ {
+		requestMagicLink(t, email)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/magic-link", strings.NewReader(`{"email": "`+email+`"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+}
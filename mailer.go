@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Emails are sent through a pluggable mailer selected by MAILER: "smtp" sends
+// them through the SMTP_HOST server, "file" writes them to MAIL_DIR so that they
+// can be read in development and tests. MAILER has no default so that a
+// deployment cannot silently write login links to disk instead of sending them.
+
+// Mailers (MAILER)
+const (
+	mailerFile = "file"
+	mailerSmtp = "smtp"
+)
+
+// Mailer sends emails to clients
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// fileMailer writes every email to its own file of the directory, named after
+// the hash of the recipient so that addresses cannot reach outside of it
+type fileMailer struct {
+	dir string
+}
+
+// smtpMailer sends emails through an SMTP server
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// newMailer creates the mailer configured by the env variables. It fails unless
+// MAILER is explicitly set to a known mailer.
+func newMailer() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case mailerSmtp:
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, errors.New("SMTP_HOST must be set when MAILER is smtp")
+		}
+		return &smtpMailer{
+			addr: host + ":" + envString("SMTP_PORT", "587"),
+			auth: smtp.PlainAuth("", os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), host),
+			from: envString("MAIL_FROM", "no-reply@localhost"),
+		}, nil
+	case mailerFile:
+		return &fileMailer{dir: envString("MAIL_DIR", filepath.Join(os.TempDir(), "client-auth-mail"))}, nil
+	case "":
+		return nil, errors.New("MAILER must be set to smtp, or to file for development and tests")
+	default:
+		return nil, errors.New("unknown MAILER " + os.Getenv("MAILER"))
+	}
+}
+
+// formatMessage formats an email as an RFC 822 message
+func formatMessage(from string, to string, subject string, body string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body + "\r\n")
+}
+
+// mailFilePrefix returns the prefix of the names of the files the emails to a
+// recipient are written to
+func mailFilePrefix(to string) string {
+	sum := sha256.Sum256([]byte(to))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *fileMailer) Send(to string, subject string, body string) error {
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	name := mailFilePrefix(to) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10) + ".eml"
+	return os.WriteFile(filepath.Join(m.dir, name), formatMessage("no-reply@localhost", to, subject, body), 0600)
+}
+
+func (m *smtpMailer) Send(to string, subject string, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, formatMessage(m.from, to, subject, body))
+}
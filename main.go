@@ -4,6 +4,8 @@ import (
 	"context"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +23,112 @@ var dbPassword = os.Getenv("DB_PASSWORD")
 var dbName = os.Getenv("DB_NAME")
 var jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
 var jwtTokenExpiration, _ = time.ParseDuration(os.Getenv("JWT_TOKEN_EXP_MIN") + "m")
+var deletionParticipants, deletionParticipantClients = parseParticipants("DELETION_PARTICIPANTS")
+var deletionGracePeriod = time.Duration(envInt("DELETION_GRACE_PERIOD_DAYS", 14)) * 24 * time.Hour
+var tokenClaims = envString("TOKEN_CLAIMS", claimGroups)
+var exportParticipants, exportParticipantClients = parseParticipants("EXPORT_PARTICIPANTS")
+var exportLinkExpiration = time.Duration(envInt("EXPORT_LINK_EXP_MIN", 15)) * time.Minute
+var registrationDefaultGroups = splitList(os.Getenv("REGISTRATION_DEFAULT_GROUPS"))
+var registrationSelfSelectableGroups = splitList(os.Getenv("REGISTRATION_SELF_SELECTABLE_GROUPS"))
+var ownerRemovalPolicy = envString("OWNER_REMOVAL_POLICY", ownerRemovalSuspend)
+var groupGrantMaxDuration = time.Duration(envInt("GROUP_GRANT_MAX_HOURS", 72)) * time.Hour
+var registrationMode = envString("REGISTRATION_MODE", registrationOpen)
+var invitationExpiration = time.Duration(envInt("INVITATION_EXP_HOURS", 168)) * time.Hour
+var invitationLinkUrl = envString("INVITATION_LINK_URL", "/invitations/accept")
+var magicLinkExpiration = time.Duration(envInt("MAGIC_LINK_EXP_MIN", 15)) * time.Minute
+var magicLinkRateLimit = envInt("MAGIC_LINK_RATE_LIMIT", 5)
+var magicLinkUrl = envString("MAGIC_LINK_URL", "/magic-link/consume")
+var restoreLinkUrl = envString("RESTORE_LINK_URL", "/restore")
+var mailer Mailer
+var oidcProviders = loadOIDCProviders()
+var oidcRedirectBaseUrl = envString("OIDC_REDIRECT_BASE_URL", "http://localhost:8000")
+var oidcPostLoginUrl = os.Getenv("OIDC_POST_LOGIN_URL")
+var reauthenticationMaxAge = time.Duration(envInt("REAUTH_MAX_AGE_MIN", 5)) * time.Minute
+var emailChangeExpiration = time.Duration(envInt("EMAIL_CHANGE_EXP_HOURS", 24)) * time.Hour
+var emailChangeConfirmUrl = envString("EMAIL_CHANGE_CONFIRM_URL", "/me/email/confirm")
+var emailChangeCancelUrl = envString("EMAIL_CHANGE_CANCEL_URL", "/me/email/cancel")
+var attributeClaimNames = splitList(os.Getenv("ATTRIBUTE_CLAIMS"))
+var deviceTokenExpiration = time.Duration(envInt("DEVICE_TOKEN_EXP_HOURS", 720)) * time.Hour
+var botTokenExpiration = time.Duration(envInt("BOT_TOKEN_EXP_MIN", 60)) * time.Minute
+var migrationsMode = envString("MIGRATIONS_MODE", migrationsStartup)
+var emailLocalPartCase = envString("EMAIL_LOCAL_PART_CASE", localPartInsensitive)
+var dbOperationTimeout = time.Duration(envInt("DB_TIMEOUT_MS", 5000)) * time.Millisecond
+var dbBulkOperationTimeout = time.Duration(envInt("DB_BULK_TIMEOUT_MS", 30000)) * time.Millisecond
+var cacheOperationTimeout = time.Duration(envInt("CACHE_TIMEOUT_MS", 1000)) * time.Millisecond
+
+// exponentialBackoff returns the delay before the given attempt, doubling the
+// base delay with every attempt up to the max delay
+func exponentialBackoff(base time.Duration, max time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// envString returns an env variable or the default value if it is unset
+func envString(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// envInt returns an integer env variable or the default value if it is unset
+// or invalid
+func envInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// splitList splits a comma separated env variable into its trimmed, non-empty
+// values
+func splitList(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// parseParticipants parses the comma separated `name=clientId` entries of an
+// env variable listing participating services into their names, in order, and
+// the client ID of the service allowed to act on behalf of each. Participants
+// configured without a client ID can only have their jobs completed by an admin.
+func parseParticipants(key string) ([]string, map[string]string) {
+	names := []string{}
+	clientIds := map[string]string{}
+	for _, entry := range splitList(os.Getenv(key)) {
+		name, clientId, _ := strings.Cut(entry, "=")
+		name, clientId = strings.TrimSpace(name), strings.TrimSpace(clientId)
+		if clientId == "" {
+			log.Println(key + " entry " + name + " has no client ID, no service can act on its behalf")
+		} else {
+			clientIds[name] = clientId
+		}
+		names = append(names, name)
+	}
+	return names, clientIds
+}
+
+// participantOf returns the participant a service client acts on behalf of, if
+// any
+func participantOf(participantClients map[string]string, service *Client) (string, bool) {
+	for name, clientId := range participantClients {
+		if clientId == service.Id.Hex() {
+			return name, true
+		}
+	}
+	return "", false
+}
 
 // getClientCollection returns a MongoDB collection for the client collection.
 // This is a blocking call that will retry every 5 seconds until a connection
@@ -91,26 +199,160 @@ func createHandler(clients *mongo.Collection, rdb *redis.Client) *gin.Engine {
 	handler.POST("/register-user", makeUserRegistrationHandler(clients, validate))
 	handler.POST("/register-service", makeServiceRegistrationHandler(clients, validate))
 
+	// Invitations to register with pre-assigned groups
+	handler.POST("/invitations", makeCreateInvitationHandler(clients, validate))
+	handler.GET("/invitations", makeListInvitationsHandler(clients))
+	handler.DELETE("/invitations/:id", makeRevokeInvitationHandler(clients))
+	handler.POST("/invitations/accept", makeAcceptInvitationHandler(clients, validate))
+
+	// SCIM 2.0 provisioning by HR systems and identity providers
+	handler.POST("/scim-credentials", makeCreateScimCredentialHandler(clients, validate))
+	handler.GET("/scim-credentials", makeListScimCredentialsHandler(clients))
+	handler.DELETE("/scim-credentials/:id", makeDeleteScimCredentialHandler(clients))
+	scim := handler.Group("/scim/v2")
+	scim.GET("/ServiceProviderConfig", makeScimServiceProviderConfigHandler())
+	scim.GET("/Users", makeScimListUsersHandler(clients))
+	scim.POST("/Users", makeScimCreateUserHandler(clients, rdb, validate))
+	scim.GET("/Users/:id", makeScimGetUserHandler(clients))
+	scim.PUT("/Users/:id", makeScimReplaceUserHandler(clients, rdb, validate))
+	scim.PATCH("/Users/:id", makeScimPatchUserHandler(clients, rdb, validate))
+	scim.DELETE("/Users/:id", makeScimDeleteUserHandler(clients, rdb))
+	scim.GET("/Groups", makeScimListGroupsHandler(clients))
+	scim.POST("/Groups", makeScimCreateGroupHandler(clients))
+	scim.GET("/Groups/:id", makeScimGetGroupHandler(clients))
+	scim.PUT("/Groups/:id", makeScimReplaceGroupHandler(clients))
+	scim.PATCH("/Groups/:id", makeScimPatchGroupHandler(clients))
+	scim.DELETE("/Groups/:id", makeScimDeleteGroupHandler(clients))
+
+	// Services owned by the authenticated user or its teams
+	handler.GET("/services", makeListServicesHandler(clients))
+	handler.POST("/services/:id/rotate", makeRotateServiceHandler(clients))
+	handler.DELETE("/services/:id", makeDeleteServiceHandler(clients, rdb))
+
 	// User browser login specific routes
 	handler.POST("/login", makeLoginHandler(clients, validate))
 	handler.GET("/refresh-user-token", makeRefreshHandler(clients))
-	handler.POST("/logout", makeLogoutHandler()) // https://stackoverflow.com/questions/3521290/logout-get-or-post
+	handler.POST("/magic-link", makeMagicLinkHandler(clients, rdb, validate))
+	handler.GET("/magic-link/consume", makeConsumeMagicLinkHandler(clients, rdb))
+	handler.GET("/oidc/:provider/login", makeOIDCLoginHandler())
+	handler.GET("/oidc/:provider/callback", makeOIDCCallbackHandler(clients))
+	handler.POST("/token", makeAPIKeyTokenHandler(clients, validate))
+	handler.POST("/logout", makeLogoutHandler(clients)) // https://stackoverflow.com/questions/3521290/logout-get-or-post
 
 	// These routes have to authenticate and authorize the client
 	handler.GET("/me", makeMeHandler(clients))
+	handler.PATCH("/me", makeUpdateMeHandler(clients, validate))
+	handler.POST("/me/email", makeRequestEmailChangeHandler(clients, validate))
+	handler.GET("/me/email/confirm", makeConfirmEmailChangeHandler(clients))
+	handler.GET("/me/email/cancel", makeCancelEmailChangeHandler(clients))
+	handler.GET("/me/export", makeExportHandler(clients))
+	handler.POST("/me/exports", makeStartExportHandler(clients, rdb))
+	handler.GET("/me/exports/:id", makeExportStatusHandler(clients))
+	handler.GET("/me/activity", makeActivityHandler(clients))
+	handler.GET("/me/identities", makeListIdentitiesHandler(clients))
+	handler.POST("/me/identities", makeLinkIdentityHandler(clients, validate))
+	handler.DELETE("/me/identities/:id", makeUnlinkIdentityHandler(clients))
 	handler.POST("/delete", makeDeleteUserHandler(clients, rdb))
 	handler.POST("/suspend", makeSuspendClient(clients, rdb))
+	handler.POST("/delete-client", makeDeleteClientHandler(clients, rdb, validate))
+	handler.GET("/audit", makeAuditQueryHandler(clients))
+	handler.GET("/audit/verify", makeAuditVerifyHandler(clients))
+
+	// Groups, the roles assigned to them and the permissions granted by roles
+	handler.GET("/groups", makeListGroupsHandler(clients))
+	handler.PUT("/groups/:name", makePutGroupHandler(clients, validate))
+	handler.DELETE("/groups/:name", makeDeleteGroupHandler(clients))
+	handler.GET("/roles", makeListRolesHandler(clients))
+	handler.PUT("/roles/:name", makePutRoleHandler(clients, validate))
+	handler.DELETE("/roles/:name", makeDeleteRoleHandler(clients))
+	handler.POST("/clients/:id/groups", makeAddMembershipHandler(clients, validate))
+	handler.DELETE("/clients/:id/groups/:group", makeRemoveMembershipHandler(clients))
+
+	// Requests for group membership, made at registration or just in time
+	handler.POST("/group-requests", makeCreateGroupRequestHandler(clients, validate))
+	handler.GET("/group-requests", makeListGroupRequestsHandler(clients))
+	handler.GET("/me/group-requests", makeMyGroupRequestsHandler(clients))
+	handler.POST("/group-requests/:id/approve", makeDecideGroupRequestHandler(clients, groupRequestApproved))
+	handler.POST("/group-requests/:id/reject", makeDecideGroupRequestHandler(clients, groupRequestRejected))
+
+	// Schemas of the custom attributes of clients
+	handler.GET("/attribute-schema", makeGetAttributeSchemaHandler(clients))
+	handler.PUT("/attribute-schema", makePutAttributeSchemaHandler(clients))
+	handler.PUT("/clients/:id/app-metadata", makePutAppMetadataHandler(clients))
+
+	// Tenants and their settings
+	handler.POST("/tenants", makeCreateTenantHandler(clients, validate))
+	handler.GET("/tenants", makeListTenantsHandler(clients))
+	handler.PUT("/tenants/:id/settings", makePutTenantSettingsHandler(clients, validate))
+
+	// Authorization policies granting permissions through CEL expressions
+	handler.GET("/policies", makeListPoliciesHandler(clients))
+	handler.POST("/policies/evaluate", makeEvaluatePolicyHandler(clients, validate))
+	handler.GET("/policies/:name/versions", makePolicyVersionsHandler(clients))
+	handler.PUT("/policies/:name", makePutPolicyHandler(clients, validate))
+	handler.DELETE("/policies/:name", makeDeletePolicyHandler(clients))
+
+	// Admin managed webhook subscriptions to client lifecycle events
+	handler.POST("/webhooks", makeCreateWebhookHandler(clients, validate))
+	handler.GET("/webhooks", makeListWebhooksHandler(clients))
+	handler.DELETE("/webhooks/:id", makeDeleteWebhookHandler(clients))
+	handler.GET("/webhooks/:id/deliveries", makeWebhookDeliveriesHandler(clients))
+	handler.GET("/webhook-dead-letters", makeDeadLettersHandler(clients))
+	handler.POST("/webhook-dead-letters/:id/redeliver", makeRedeliverWebhookHandler(clients))
+
+	// Restore a client scheduled for deletion, either with the restore token
+	// returned on deletion or by an admin
+	handler.POST("/restore", makeRestoreHandler(clients, rdb))
+	handler.POST("/restore-client", makeAdminRestoreHandler(clients, rdb))
+
+	// Deletion job tracking, participating services acknowledge with their API
+	// token once they have deleted the client data they hold
+	handler.GET("/deletion-jobs/:id", makeDeletionJobStatusHandler(clients))
+	handler.POST("/deletion-jobs/:id/ack", makeDeletionAckHandler(clients))
+	handler.POST("/deletion-jobs/:id/force", makeForceDeletionHandler(clients))
+
+	// Participating services contribute to bundled data exports with their API
+	// token, the bundle is downloaded with the token of a time-limited link
+	handler.POST("/exports/:id/contributions", makeExportContributionHandler(clients))
+	handler.GET("/exports/:id/download", makeExportDownloadHandler(clients))
 
 	return handler
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
+	var err error
+	if mailer, err = newMailer(); err != nil {
+		log.Fatal("Unable to create mailer: ", err)
+	}
+
 	log.Println("Connecting to user database...")
 	users := getClientCollection()
 
 	log.Println("Connecting to user cache...")
 	rdb := getCache()
 
+	// Upgrade the clients stored with an older schema version and create the
+	// database indexes, which depend on the upgraded clients
+	startMigrations(users)
+
+	// Start the deletion of clients whose grace period has elapsed and retry
+	// deletion cascades that have not been acknowledged by every participating
+	// service
+	ensureDeletionConsumerGroups(rdb)
+	go runDeletionWorker(users, rdb)
+
+	// Append audit events outside of the requests recording them
+	go runAuditWorker()
+
+	// Retry failed webhook deliveries
+	go runWebhookWorker(users)
+	go runGroupGrantWorker(users)
+
 	handler := createHandler(users, rdb)
 
 	log.Println("Starting server on port 8000...")
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/brianvoe/gofakeit"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -13,18 +19,56 @@ var clients *mongo.Collection
 var rdb *redis.Client
 var handler *gin.Engine
 
+// testDatabaseSuffix is the suffix of the database the tests run against
+const testDatabaseSuffix = "_test"
+
 func genRandomEmail() string {
 	gofakeit.Seed(0)
 	return gofakeit.Email()
 }
 
+// issueTestToken issues a login token to the client of the ID as logging in
+// does, for tests that insert their clients directly
+func issueTestToken(t *testing.T, id string) string {
+	client, err := getClientByIdOrEmail(context.Background(), clients, "", id, "")
+	require.NoError(t, err)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/login", nil)
+	token, _, err := issueLoginToken(clients, c, client)
+	require.NoError(t, err)
+	return token
+}
+
 func TestMain(m *testing.M) {
+	// Tests read the emails sent from their files
+	os.Setenv("MAILER", mailerFile)
+	var err error
+	if mailer, err = newMailer(); err != nil {
+		log.Fatal("Unable to create mailer: ", err)
+	}
+
+	// Tests run against a database of their own, suffixed with _test, as it is
+	// dropped below: never against the database DB_NAME names
+	if !strings.HasSuffix(dbName, testDatabaseSuffix) {
+		dbName += testDatabaseSuffix
+	}
+
 	// Get MongoDB collection and Redis client
 	clients = getClientCollection()
 	rdb = getCache()
 
+	// Start from an empty database so that data left by previous runs cannot
+	// break the unique indexes
+	if err := clients.Database().Drop(context.Background()); err != nil {
+		log.Fatal("Unable to drop the test database: ", err)
+	}
+	if err := ensureIndexes(clients); err != nil {
+		log.Fatal("Unable to create database indexes: ", err)
+	}
+
 	// Get handler object
 	handler = createHandler(clients, rdb)
+	go runAuditWorker()
 
 	// Run tests
 	m.Run()
@@ -1,12 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// UpdateMeForm describes the expected JSON payload when a client updates its
+// profile. Unset fields are left unchanged. Users update their first and last
+// names and services, devices and bots their name; the email address, groups and status cannot
+// be changed here. Custom attributes are merged into the current ones, those
+// set to null being removed.
+type UpdateMeForm struct {
+	FirstName  *string                `json:"firstName" validate:"omitempty,min=1,max=64"`
+	LastName   *string                `json:"lastName" validate:"omitempty,min=1,max=64"`
+	Name       *string                `json:"name" validate:"omitempty,min=1,max=64"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// clientETag returns the entity tag of the profile of a client, which changes
+// with every write to its fields: the profile update below, and the admin,
+// SCIM, group and email address changes all increment the version
+func clientETag(client *Client) string {
+	return `"` + strconv.Itoa(client.Version) + `"`
+}
+
 // me handler for user details
 func makeMeHandler(users *mongo.Collection) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -23,13 +47,130 @@ func makeMeHandler(users *mongo.Collection) gin.HandlerFunc {
 			return
 		}
 
-		status, user := authAndAuthorised(users, claim)
+		status, user := authAndAuthorised(c.Request.Context(), users, claim)
 		if status != http.StatusOK {
 			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
 			return
 		}
 
-		// Return the user details
+		// Return the user details along with the version to send back in
+		// If-Match when updating them
+		c.Header("ETag", clientETag(user))
 		c.JSON(http.StatusOK, gin.H{"user": user})
 	}
 }
+
+// makeUpdateMeHandler updates the profile of the authenticated client. The
+// If-Match header must hold the ETag of the profile being updated so that
+// concurrent updates (e.g. from two browser tabs) do not overwrite each other.
+func makeUpdateMeHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form UpdateMeForm
+
+		client, _, ok := authenticateRequest(c, clients)
+		if !ok {
+			return
+		}
+
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch == "" {
+			c.AbortWithStatusJSON(http.StatusPreconditionRequired, gin.H{"message": "The If-Match header is required"})
+			return
+		}
+
+		// Unknown fields are refused rather than ignored so that attempts to
+		// change the email address, groups or status are not mistaken for
+		// successful updates
+		decoder := json.NewDecoder(c.Request.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Only firstName, lastName, name and attributes can be updated"})
+			return
+		}
+
+		for _, field := range []*string{form.FirstName, form.LastName, form.Name} {
+			if field != nil {
+				*field = strings.TrimSpace(*field)
+			}
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		set := bson.M{}
+		if !isUser(client) {
+			if form.FirstName != nil || form.LastName != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Services, devices and bots only have a name"})
+				return
+			}
+			if form.Name != nil {
+				set["name"] = *form.Name
+			}
+		} else {
+			if form.Name != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Users have a first and last name"})
+				return
+			}
+			if form.FirstName != nil {
+				set["firstName"] = *form.FirstName
+			}
+			if form.LastName != nil {
+				set["lastName"] = *form.LastName
+			}
+		}
+
+		if form.Attributes != nil {
+			attributes := mergeAttributes(client.Attributes, form.Attributes)
+			schema, err := getAttributeSchema(c.Request.Context(), clients, client.TenantId)
+			if err != nil {
+				abortWithStorageError(c, err, "Unable to get attribute schema")
+				return
+			}
+			if err := validateAttributes(schema.Attributes, attributes); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+			set["attributes"] = attributes
+		}
+
+		if ifMatch != "*" && ifMatch != clientETag(client) && ifMatch != "W/"+clientETag(client) {
+			c.Header("ETag", clientETag(client))
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "The profile has been modified since it was retrieved"})
+			return
+		}
+
+		// The update only applies to the version the client retrieved, so a
+		// concurrent update between the check and the write is detected too
+		filter := bson.M{"_id": client.Id, "version": client.Version}
+		if client.Version == 0 {
+			filter["version"] = bson.M{"$in": []interface{}{0, nil}}
+		}
+		update := bson.M{"$inc": bson.M{"version": 1}}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := clients.UpdateOne(dbCtx, filter, update)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to update profile")
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "The profile has been modified since it was retrieved"})
+			return
+		}
+
+		updated, err := getClientByIdOrEmail(c.Request.Context(), clients, client.TenantId, client.Id.Hex(), "")
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get updated profile")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "update-profile", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess})
+		c.Header("ETag", clientETag(updated))
+		c.JSON(http.StatusOK, gin.H{"user": updated})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,7 +32,7 @@ func TestSuccessfulMe(t *testing.T) {
 	// Get user valid token to append to request
 	id := result.InsertedID.(primitive.ObjectID).Hex()
 
-	token, _ := genToken(id, []string{""})
+	token := issueTestToken(t, id)
 
 	// Create a new request
 	req, _ := http.NewRequest("GET", "/me", nil)
@@ -47,3 +48,85 @@ func TestSuccessfulMe(t *testing.T) {
 	// Check that the user details are returned
 	assert.Contains(t, recorder.Body.String(), email)
 }
+
+// patchMe sends a profile update with the If-Match header
+func patchMe(token string, payload string, ifMatch string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/me", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestUpdateMe(t *testing.T) {
+	_, token := insertTestClient(t, []string{})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// Updates require the ETag of the profile
+	recorder = patchMe(token, `{"firstName": "Jane"}`, "")
+	assert.Equal(t, http.StatusPreconditionRequired, recorder.Code)
+
+	// The email address, groups and status cannot be changed
+	recorder = patchMe(token, `{"groups": ["admin"]}`, etag)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = patchMe(token, `{"firstName": "Jane", "lastName": "Doe"}`, etag)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Jane")
+	assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+}
+
+func TestUpdateMeWithStaleETag(t *testing.T) {
+	_, token := insertTestClient(t, []string{})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	etag := recorder.Header().Get("ETag")
+
+	// Two tabs update the profile retrieved at the same version: the second
+	// update does not overwrite the first
+	recorder = patchMe(token, `{"firstName": "Jane"}`, etag)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = patchMe(token, `{"firstName": "Joan"}`, etag)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+}
+
+func TestUpdateMeAfterAdminChange(t *testing.T) {
+	id, token := insertTestClient(t, []string{})
+	_, adminToken := insertTestClient(t, []string{"admin"})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	handler.ServeHTTP(recorder, req)
+	etag := recorder.Header().Get("ETag")
+
+	// An admin adds the user to a group after the profile was retrieved
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/groups/editors", strings.NewReader(`{"description": "Editors"}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/clients/"+id.Hex()+"/groups", strings.NewReader(`{"group": "editors"}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// The update based on the profile retrieved before is refused
+	recorder = patchMe(token, `{"firstName": "Jane"}`, etag)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every client document records the schema version it was written with. When
+// the Client document changes in a way existing documents need upgrading, a
+// migration is appended to the migrations below, which bumps the current schema
+// version. Migrations are idempotent and run in order:
+// - at startup before serving requests (MIGRATIONS_MODE=startup, the default)
+// - in the background once the server is up (MIGRATIONS_MODE=lazy), for large
+//   collections that would delay startup
+// - only through the migrate command (MIGRATIONS_MODE=manual), e.g.
+//   `client-auth migrate -dry-run` to list the clients each migration would
+//   upgrade without writing anything
+// Whatever the mode, clients below the current schema version are upgraded as
+// they are read when authenticating. Each migration run is recorded in the
+// migrations collection.
+
+// Migration modes (MIGRATIONS_MODE)
+const (
+	migrationsStartup = "startup"
+	migrationsLazy    = "lazy"
+	migrationsManual  = "manual"
+)
+
+// Migration describes an upgrade of the client documents to a schema version
+type Migration struct {
+	Version     int
+	Description string
+
+	// Migrate upgrades every client below the version
+	Migrate func(ctx context.Context, clients *mongo.Collection) error
+
+	// Upgrade upgrades a single client below the version as it is read
+	Upgrade func(ctx context.Context, clients *mongo.Collection, client *Client) error
+
+	// Report optionally logs what the migration would change on a dry run,
+	// beyond the number of clients to upgrade
+	Report func(clients *mongo.Collection) error
+}
+
+// migrations lists the migrations in order of version
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Set the kind of every client",
+		Migrate:     classifyClientKinds,
+		Upgrade: func(ctx context.Context, clients *mongo.Collection, client *Client) error {
+			if client.Kind != "" {
+				return nil
+			}
+			client.Kind = clientKind(client)
+			dbCtx, cancel := dbContext(ctx)
+			defer cancel()
+			_, err := clients.UpdateOne(dbCtx, bson.M{"_id": client.Id}, bson.M{"$set": bson.M{"kind": client.Kind}})
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "Move legacy password hashes to password identities",
+		Migrate: func(ctx context.Context, clients *mongo.Collection) error {
+			cursor, err := clients.Find(ctx, bson.M{"hashedPassword": bson.M{"$nin": []interface{}{nil, ""}}})
+			if err != nil {
+				return err
+			}
+			defer cursor.Close(ctx)
+			for cursor.Next(ctx) {
+				client := &Client{}
+				if err := cursor.Decode(client); err != nil {
+					return err
+				}
+				if err := migrateLegacyPassword(ctx, clients, client); err != nil {
+					return err
+				}
+			}
+			return cursor.Err()
+		},
+		Upgrade: migrateLegacyPassword,
+	},
+	{
+		Version:     3,
+		Description: "Remove the empty name and password fields stored by malformed tags",
+		Migrate: func(ctx context.Context, clients *mongo.Collection) error {
+			for _, field := range emptyClientFields {
+				dbCtx, cancel := dbBulkContext(ctx)
+				_, err := clients.UpdateMany(dbCtx, bson.M{field: ""}, bson.M{"$unset": bson.M{field: ""}})
+				cancel()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Upgrade: func(ctx context.Context, clients *mongo.Collection, client *Client) error {
+			for _, field := range emptyClientFields {
+				dbCtx, cancel := dbContext(ctx)
+				_, err := clients.UpdateOne(dbCtx, bson.M{"_id": client.Id, field: ""}, bson.M{"$unset": bson.M{field: ""}})
+				cancel()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     emailNormalisationVersion,
+		Description: "Normalise email addresses, reporting the clients that would collide",
+		Migrate:     normaliseClientEmails,
+		Upgrade:     normaliseClientEmail,
+		Report: func(clients *mongo.Collection) error {
+			_, err := reportEmailCollisions(clients)
+			return err
+		},
+	},
+}
+
+// emailNormalisationVersion is the version of the migration normalising email
+// addresses, which the unique email index depends on (see ensureIndexes)
+const emailNormalisationVersion = 4
+
+// emptyClientFields are the fields stored as empty strings before their
+// omitempty tags were fixed
+var emptyClientFields = []string{"firstName", "lastName", "name", "hashedPassword"}
+
+// currentSchemaVersion is the schema version new clients are written with
+var currentSchemaVersion = migrations[len(migrations)-1].Version
+
+// getMigrationCollection returns the collection migration runs are recorded in,
+// one document per version with its description, the number of clients it
+// migrated and when it last ran
+func getMigrationCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("migrations")
+}
+
+// belowSchemaVersion returns the filter of the clients below a schema version,
+// including those stored before schema versions were recorded
+func belowSchemaVersion(version int) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"schemaVersion": bson.M{"$lt": version}},
+		{"schemaVersion": bson.M{"$exists": false}},
+	}}
+}
+
+// runMigrations runs the migrations of the clients below their version in
+// order. A dry run only logs how many clients each migration would upgrade.
+func runMigrations(clients *mongo.Collection, dryRun bool) error {
+	for _, migration := range migrations {
+		filter := belowSchemaVersion(migration.Version)
+		pending, err := clients.CountDocuments(context.Background(), filter)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			log.Printf("Migration %d (%s): %d clients to upgrade", migration.Version, migration.Description, pending)
+			if migration.Report != nil && pending > 0 {
+				if err := migration.Report(clients); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if pending == 0 {
+			continue
+		}
+
+		log.Printf("Running migration %d (%s) on %d clients...", migration.Version, migration.Description, pending)
+		if err := migration.Migrate(context.Background(), clients); err != nil {
+			return err
+		}
+		result, err := clients.UpdateMany(context.Background(), filter, bson.M{"$set": bson.M{"schemaVersion": migration.Version}})
+		if err != nil {
+			return err
+		}
+
+		_, err = getMigrationCollection(clients).UpdateOne(context.Background(),
+			bson.M{"_id": migration.Version},
+			bson.M{
+				"$set": bson.M{"description": migration.Description, "appliedAt": time.Now()},
+				"$inc": bson.M{"migrated": result.ModifiedCount},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeClient runs the migrations of a client read below the current schema
+// version. Failures are logged and left to the next read or migration run.
+func upgradeClient(ctx context.Context, clients *mongo.Collection, client *Client) {
+	if client.SchemaVersion >= currentSchemaVersion {
+		return
+	}
+	for _, migration := range migrations {
+		if client.SchemaVersion >= migration.Version {
+			continue
+		}
+		if err := migration.Upgrade(ctx, clients, client); err != nil {
+			log.Println("Unable to upgrade client "+client.Id.Hex()+": ", err)
+			return
+		}
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := clients.UpdateOne(dbCtx, bson.M{"_id": client.Id}, bson.M{"$max": bson.M{"schemaVersion": currentSchemaVersion}})
+	if err != nil {
+		log.Println("Unable to upgrade client "+client.Id.Hex()+": ", err)
+		return
+	}
+	client.SchemaVersion = currentSchemaVersion
+}
+
+// startMigrations runs the migrations as configured by MIGRATIONS_MODE, then
+// creates the database indexes. The unique email index can only be created once
+// every email address is normalised, so in lazy mode the indexes are created
+// once the migrations complete in the background, and in manual mode the unique
+// email index is skipped until the migrate command has been run.
+func startMigrations(clients *mongo.Collection) {
+	switch migrationsMode {
+	case migrationsManual:
+		logEnsureIndexes(clients)
+	case migrationsLazy:
+		go func() {
+			if err := runMigrations(clients, false); err != nil {
+				log.Println("Unable to run migrations: ", err)
+				return
+			}
+			logEnsureIndexes(clients)
+		}()
+	default:
+		if err := runMigrations(clients, false); err != nil {
+			log.Fatal("Unable to run migrations: ", err)
+		}
+		logEnsureIndexes(clients)
+	}
+}
+
+// logEnsureIndexes creates the database indexes, logging rather than failing
+// on the indexes that cannot be created so that the server keeps serving
+// without them
+func logEnsureIndexes(clients *mongo.Collection) {
+	log.Println("Ensuring database indexes...")
+	switch err := ensureIndexes(clients); err {
+	case nil:
+	case errEmailsNotNormalised, errEmailCollisions:
+		log.Println("Skipping the unique email index, concurrent registrations with the same email address are not prevented: ", err)
+	default:
+		log.Println("Unable to create database indexes: ", err)
+	}
+}
+
+// runMigrateCommand runs the migrations from the command line:
+// `client-auth migrate [-dry-run]`
+func runMigrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only log how many clients each migration would upgrade")
+	flags.Parse(args)
+
+	clients := getClientCollection()
+	if err := runMigrations(clients, *dryRun); err != nil {
+		log.Fatal("Unable to run migrations: ", err)
+	}
+	if !*dryRun {
+		logEnsureIndexes(clients)
+	}
+}
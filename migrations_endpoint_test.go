@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// insertLegacyClient inserts a client as stored before schema versions, kinds
+// and identities were introduced
+func insertLegacyClient(email string) primitive.ObjectID {
+	hashedPass, _ := hashAndSalt("somePassword")
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: email},
+		{Key: "hashedPassword", Value: hashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "name", Value: ""},
+		{Key: "groups", Value: []string{}},
+	})
+	return result.InsertedID.(primitive.ObjectID)
+}
+
+// getRawClient returns the stored document of a client
+func getRawClient(id primitive.ObjectID) bson.M {
+	document := bson.M{}
+	clients.FindOne(context.Background(), bson.M{"_id": id}).Decode(&document)
+	return document
+}
+
+func TestMigrationsUpgradeLegacyClients(t *testing.T) {
+	id := insertLegacyClient(genRandomEmail())
+
+	// A dry run leaves the client as is
+	assert.NoError(t, runMigrations(clients, true))
+	document := getRawClient(id)
+	assert.NotContains(t, document, "kind")
+	assert.NotContains(t, document, "schemaVersion")
+
+	assert.NoError(t, runMigrations(clients, false))
+	document = getRawClient(id)
+	assert.Equal(t, kindUser, document["kind"])
+	assert.EqualValues(t, currentSchemaVersion, document["schemaVersion"])
+	assert.NotContains(t, document, "hashedPassword")
+	assert.NotContains(t, document, "name")
+
+	count, _ := getIdentityCollection(clients).CountDocuments(context.Background(), bson.M{"clientId": id, "method": identityPassword})
+	assert.EqualValues(t, 1, count)
+
+	// Migrations are idempotent
+	assert.NoError(t, runMigrations(clients, false))
+	count, _ = getIdentityCollection(clients).CountDocuments(context.Background(), bson.M{"clientId": id, "method": identityPassword})
+	assert.EqualValues(t, 1, count)
+}
+
+func TestLegacyClientUpgradedOnLogin(t *testing.T) {
+	email := genRandomEmail()
+	id := insertLegacyClient(email)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+email+`", "password": "somePassword"}`))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	document := getRawClient(id)
+	assert.Equal(t, kindUser, document["kind"])
+	assert.EqualValues(t, currentSchemaVersion, document["schemaVersion"])
+	assert.NotContains(t, document, "name")
+}
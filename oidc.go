@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Users can sign in through upstream OpenID Connect identity providers (e.g.
+// Google, Microsoft or a corporate IdP) listed in OIDC_PROVIDERS. Each provider
+// is configured by the OIDC_<NAME>_* env variables:
+//   - ISSUER, CLIENT_ID and CLIENT_SECRET of the registered application
+//   - TENANT the users of the provider belong to (default tenant if unset)
+//   - GROUPS_CLAIM, the ID token claim listing the groups of the user at the
+//     provider ("groups" by default), and GROUP_MAPPING mapping them to the
+//     groups of new clients, e.g. "engineering=developers,ops=admin"
+//
+// The login endpoint redirects to the provider with a state and a nonce stored
+// in a cookie, which the callback checks before exchanging the code for an ID
+// token. The federated identity is linked to the client with the verified email
+// address of the token, or a client is created just in time.
+
+// oidcStateCookie is the cookie holding the state and nonce of a sign in
+const oidcStateCookie = "oidc_state"
+
+// oidcHttpClient is used for the requests made to identity providers
+var oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// OIDCProvider describes an upstream OpenID Connect identity provider
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	TenantId     string
+	GroupsClaim  string
+	GroupMapping map[string]string
+
+	// Discovered endpoints and signing keys of the provider
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// oidcDiscovery describes the provider metadata the sign in uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// oidcClaims describes the claims of an ID token the sign in uses
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Nonce         string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// loadOIDCProviders loads the identity providers configured by the env
+// variables
+func loadOIDCProviders() map[string]*OIDCProvider {
+	providers := map[string]*OIDCProvider{}
+	for _, name := range splitList(os.Getenv("OIDC_PROVIDERS")) {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		mapping := map[string]string{}
+		for _, pair := range splitList(os.Getenv(prefix + "GROUP_MAPPING")) {
+			if from, to, found := strings.Cut(pair, "="); found {
+				mapping[strings.TrimSpace(from)] = strings.TrimSpace(to)
+			}
+		}
+		providers[name] = &OIDCProvider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientId:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			TenantId:     os.Getenv(prefix + "TENANT"),
+			GroupsClaim:  envString(prefix+"GROUPS_CLAIM", "groups"),
+			GroupMapping: mapping,
+		}
+	}
+	return providers
+}
+
+// redirectUri returns the callback URL registered at the provider
+func (p *OIDCProvider) redirectUri() string {
+	return oidcRedirectBaseUrl + "/oidc/" + p.Name + "/callback"
+}
+
+// getJSON decodes the JSON response of a GET request
+func getJSON(url string, value interface{}) error {
+	resp, err := oidcHttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status + " from " + url)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// getDiscovery returns the metadata of the provider, fetched once
+func (p *OIDCProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	discovery := &oidcDiscovery{}
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.Issuer {
+		return nil, errors.New("issuer mismatch in provider metadata")
+	}
+	p.discovery = discovery
+	return discovery, nil
+}
+
+// getKey returns the signing key of the provider with the key ID. The keys are
+// fetched again when the key ID is unknown as providers rotate their keys.
+func (p *OIDCProvider) getKey(kid string) (*rsa.PublicKey, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key " + kid)
+	}
+	return key, nil
+}
+
+// exchangeCode exchanges an authorization code for the ID token of the user
+func (p *OIDCProvider) exchangeCode(code string) (string, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectUri()},
+	}
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.ClientSecret))
+
+	resp, err := oidcHttpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("unexpected status " + resp.Status + " from token endpoint")
+	}
+
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IdToken == "" {
+		return "", errors.New("no ID token in token response")
+	}
+	return tokens.IdToken, nil
+}
+
+// verifyIdToken verifies the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims along with the groups claim
+func (p *OIDCProvider) verifyIdToken(idToken string, nonce string) (*oidcClaims, []string, error) {
+	claims := &oidcClaims{}
+	tkn, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("unexpected signing method " + token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(kid)
+	})
+	if err != nil || !tkn.Valid {
+		return nil, nil, errors.New("invalid ID token")
+	}
+	if !claims.VerifyIssuer(p.Issuer, true) || !claims.VerifyAudience(p.ClientId, true) {
+		return nil, nil, errors.New("ID token issued by another provider or for another client")
+	}
+	if claims.Subject == "" || nonce == "" || claims.Nonce != nonce {
+		return nil, nil, errors.New("ID token nonce mismatch")
+	}
+
+	// The groups claim is read separately as its name is configurable
+	groups := []string{}
+	var raw map[string]interface{}
+	parts := strings.Split(idToken, ".")
+	if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil && json.Unmarshal(payload, &raw) == nil {
+		if values, ok := raw[p.GroupsClaim].([]interface{}); ok {
+			for _, value := range values {
+				if group, ok := value.(string); ok {
+					groups = append(groups, group)
+				}
+			}
+		}
+	}
+	return claims, groups, nil
+}
+
+// mapGroups maps the groups of a user at the provider to client groups
+func (p *OIDCProvider) mapGroups(providerGroups []string) []string {
+	groups := []string{}
+	for _, providerGroup := range providerGroups {
+		if group, ok := p.GroupMapping[providerGroup]; ok && !contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// linkFederatedClient returns the client of the federated identity. The
+// identity is linked to the client with the verified email address of the
+// provider tenant, or a client is created with the mapped groups.
+func linkFederatedClient(ctx context.Context, clients *mongo.Collection, p *OIDCProvider, claims *oidcClaims, providerGroups []string) (*Client, bool, error) {
+	identity, err := findIdentity(ctx, clients, p.TenantId, identityOIDC, p.Name, claims.Subject)
+	if err == nil {
+		touchIdentity(ctx, clients, identity)
+		client, err := getClientByIdOrEmail(ctx, clients, p.TenantId, identity.ClientId.Hex(), "")
+		return client, false, err
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	// Email addresses the provider has not verified cannot be trusted to
+	// identify a client
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, false, errors.New("email address not verified by the provider")
+	}
+
+	identity = &Identity{Method: identityOIDC, Provider: p.Name, Subject: claims.Subject}
+	client, err := getClientByEmail(ctx, clients, p.TenantId, claims.Email)
+	if err == nil {
+		return client, false, linkIdentity(ctx, clients, client, identity)
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	settings, err := getTenantSettings(ctx, clients, p.TenantId)
+	if err != nil {
+		return nil, false, err
+	}
+	groups := append([]string{}, settings.DefaultGroups...)
+	for _, group := range p.mapGroups(providerGroups) {
+		if !contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+
+	client, err = createNewUserClient(ctx, clients, p.TenantId, claims.Email, "", claims.GivenName, claims.FamilyName, groups, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return client, true, linkIdentity(ctx, clients, client, identity)
+}
+
+// linkProviderIdentity links the federated identity to the client that started
+// linking it through /me/identities
+func linkProviderIdentity(ctx context.Context, c *gin.Context, clients *mongo.Collection, p *OIDCProvider, claims *oidcClaims, linkToken string) {
+	linkClaim, ok := processPurposeToken(linkToken, oidcLinkPurpose)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid or expired link request"})
+		return
+	}
+
+	objID, _ := primitive.ObjectIDFromHex(linkClaim.Id)
+	client := &Client{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if err := clients.FindOne(dbCtx, bson.M{"_id": objID}).Decode(client); err != nil || client.Suspended || client.DeletionState != "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Unable to authenticate and authorise user"})
+		return
+	}
+	if client.TenantId != p.TenantId {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "The identity provider belongs to another tenant"})
+		return
+	}
+
+	err := linkIdentity(c.Request.Context(), clients, client, &Identity{Method: identityOIDC, Provider: p.Name, Subject: claims.Subject})
+	if err == errIdentityLinked {
+		recordAudit(clients, c, AuditEvent{Action: "link-identity", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditFailure, Reason: "identity linked to another client"})
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "The identity is already linked to another account"})
+		return
+	}
+	if err != nil {
+		abortWithStorageError(c, err, "Unable to link login method")
+		return
+	}
+
+	recordAudit(clients, c, AuditEvent{Action: "link-identity", ActorId: client.Id.Hex(), TargetId: client.Id.Hex(), Outcome: auditSuccess, Reason: identityOIDC + ":" + p.Name})
+	c.JSON(http.StatusCreated, gin.H{"message": "Login method linked"})
+}
+
+// makeOIDCLoginHandler redirects the browser to the identity provider
+func makeOIDCLoginHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := oidcProviders[c.Param("provider")]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Identity provider not found"})
+			return
+		}
+
+		discovery, err := provider.getDiscovery()
+		if err != nil {
+			log.Println("Unable to discover identity provider "+provider.Name+": ", err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"message": "Identity provider unavailable"})
+			return
+		}
+
+		state, err := randomHex(16)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to start sign in"})
+			return
+		}
+		nonce, err := randomHex(16)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to start sign in"})
+			return
+		}
+		c.SetCookie(oidcStateCookie, state+"."+nonce, 600, "/", "localhost", false, true)
+
+		query := url.Values{
+			"response_type": {"code"},
+			"client_id":     {provider.ClientId},
+			"redirect_uri":  {provider.redirectUri()},
+			"scope":         {"openid email profile"},
+			"state":         {state},
+			"nonce":         {nonce},
+		}
+		c.Redirect(http.StatusFound, discovery.AuthorizationEndpoint+"?"+query.Encode())
+	}
+}
+
+// makeOIDCCallbackHandler completes the sign in with the authorization code
+// returned by the identity provider and sets the same token cookie as
+// makeLoginHandler
+func makeOIDCCallbackHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := oidcProviders[c.Param("provider")]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Identity provider not found"})
+			return
+		}
+
+		// The state must be the one set on the browser that started the sign in
+		cookie, _ := c.Cookie(oidcStateCookie)
+		state, nonce, _ := strings.Cut(cookie, ".")
+		c.SetCookie(oidcStateCookie, "", -1, "/", "localhost", false, true)
+		if state == "" || c.Query("state") != state {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid sign in state"})
+			return
+		}
+		if c.Query("error") != "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Sign in refused by the identity provider"})
+			return
+		}
+
+		idToken, err := provider.exchangeCode(c.Query("code"))
+		if err != nil {
+			log.Println("Unable to exchange code with identity provider "+provider.Name+": ", err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"message": "Unable to complete sign in with the identity provider"})
+			return
+		}
+
+		claims, providerGroups, err := provider.verifyIdToken(idToken, nonce)
+		if err != nil {
+			recordAudit(clients, c, AuditEvent{Action: "login", Outcome: auditFailure, Reason: provider.Name + ": " + err.Error()})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid ID token"})
+			return
+		}
+
+		// The sign in links the identity when started through /me/identities
+		if linkToken, _ := c.Cookie(oidcLinkCookie); linkToken != "" {
+			c.SetCookie(oidcLinkCookie, "", -1, "/", "localhost", false, true)
+			linkProviderIdentity(c.Request.Context(), c, clients, provider, claims, linkToken)
+			return
+		}
+
+		user, created, err := linkFederatedClient(c.Request.Context(), clients, provider, claims, providerGroups)
+		if err != nil {
+			recordAudit(clients, c, AuditEvent{Action: "login", Outcome: auditFailure, Reason: provider.Name + ": " + err.Error()})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Unable to sign in with the identity provider"})
+			return
+		}
+		if created {
+			recordAudit(clients, c, AuditEvent{Action: "register-user", ActorId: user.Id.Hex(), TargetId: user.Id.Hex(), Outcome: auditSuccess, Reason: provider.Name})
+			dispatchWebhookEvent(clients, webhookClientRegistered, gin.H{"clientId": user.Id.Hex(), "tenantId": user.TenantId, "email": user.Email, "groups": user.Groups})
+		}
+
+		if !loginAllowed(clients, c, user) {
+			return
+		}
+
+		if err := setLoginCookie(clients, c, user); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create token"})
+			return
+		}
+
+		if oidcPostLoginUrl != "" {
+			c.Redirect(http.StatusFound, oidcPostLoginUrl)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully logged in"})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubOIDCProvider is an in-process identity provider issuing ID tokens with
+// the configured claims for any authorization code
+type stubOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+}
+
+func newStubOIDCProvider(t *testing.T) *stubOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	stub := &stubOIDCProvider{key: key}
+
+	mux := http.NewServeMux()
+	stub.server = httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.server.URL,
+			"authorization_endpoint": stub.server.URL + "/authorize",
+			"token_endpoint":         stub.server.URL + "/token",
+			"jwks_uri":               stub.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "stub",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, stub.claims)
+		token.Header["kid"] = "stub"
+		idToken, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+
+	oidcProviders["stub"] = &OIDCProvider{
+		Name:         "stub",
+		Issuer:       stub.server.URL,
+		ClientId:     "client-auth",
+		ClientSecret: "secret",
+		GroupsClaim:  "groups",
+		GroupMapping: map[string]string{"engineering": "developers"},
+	}
+	return stub
+}
+
+// signIn starts a sign in with the stub provider, which then issues an ID
+// token with the claims, and completes it through the callback
+func (stub *stubOIDCProvider) signIn(claims jwt.MapClaims) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oidc/stub/login", nil)
+	handler.ServeHTTP(recorder, req)
+
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+	state := location.Query().Get("state")
+	var stateCookie *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			stateCookie = cookie
+		}
+	}
+
+	claims["iss"] = stub.server.URL
+	claims["aud"] = "client-auth"
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	if _, ok := claims["nonce"]; !ok {
+		claims["nonce"] = location.Query().Get("nonce")
+	}
+	stub.claims = claims
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oidc/stub/callback?code=code&state="+state, nil)
+	req.AddCookie(stateCookie)
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestOIDCJustInTimeClient(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	defer stub.server.Close()
+
+	email := genRandomEmail()
+	recorder := stub.signIn(jwt.MapClaims{"sub": "subject-" + email, "email": email, "email_verified": true, "groups": []string{"engineering", "sales"}})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// The client is created with the mapped groups and linked to the identity
+	client, err := getClientByEmail(context.Background(), clients, "", email)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"developers"}, client.Groups)
+	identities, _ := getIdentities(context.Background(), clients, client)
+	assert.Equal(t, "subject-"+email, identities[0].Subject)
+}
+
+func TestOIDCLinksExistingClient(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	defer stub.server.Close()
+
+	email := genRandomEmail()
+	registerAndLogin(email, `{"email": "`+email+`", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`)
+
+	// An unverified email address is not linked
+	recorder := stub.signIn(jwt.MapClaims{"sub": "subject-" + email, "email": email, "email_verified": false})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = stub.signIn(jwt.MapClaims{"sub": "subject-" + email, "email": email, "email_verified": true})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	client, err := getClientByEmail(context.Background(), clients, "", email)
+	assert.Nil(t, err)
+	identities, _ := getIdentities(context.Background(), clients, client)
+	assert.Len(t, identities, 2)
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	defer stub.server.Close()
+
+	email := genRandomEmail()
+	recorder := stub.signIn(jwt.MapClaims{"sub": "subject-" + email, "email": email, "email_verified": true, "nonce": "replayed"})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `{"message":"Invalid ID token"}`, recorder.Body.String())
+}
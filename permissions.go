@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Authorization is based on permissions. Clients are members of groups, groups
+// are assigned roles and roles grant permissions. Groups and roles are managed
+// by admins (see groups.go). Permissions can also be granted by authorization
+// policies (see policies.go). A permission is written "resource:action", a role
+// can also be granted every action on a resource ("resource:*") or every
+// permission ("*").
+
+// Permissions guarding the admin handlers
+const (
+	permClientsSuspend    = "clients:suspend"
+	permClientsDelete     = "clients:delete"
+	permClientsRestore    = "clients:restore"
+	permDeletionsRead     = "deletions:read"
+	permDeletionsForce    = "deletions:force"
+	permAuditRead         = "audit:read"
+	permWebhooksManage    = "webhooks:manage"
+	permGroupsManage      = "groups:manage"
+	permKeysRotate        = "keys:rotate"
+	permPoliciesManage    = "policies:manage"
+	permTenantsManage     = "tenants:manage"
+	permSettingsManage    = "settings:manage"
+	permInvitationsManage = "invitations:manage"
+	permScimManage        = "scim:manage"
+	permClientsMetadata   = "clients:metadata"
+)
+
+// knownPermissions lists the permissions a role can be granted
+var knownPermissions = []string{
+	permClientsSuspend,
+	permClientsDelete,
+	permClientsRestore,
+	permDeletionsRead,
+	permDeletionsForce,
+	permAuditRead,
+	permWebhooksManage,
+	permGroupsManage,
+	permKeysRotate,
+	permPoliciesManage,
+	permTenantsManage,
+	permSettingsManage,
+	permInvitationsManage,
+	permScimManage,
+	permClientsMetadata,
+}
+
+// tenantPermissions lists the permissions admins of a tenant other than the
+// default tenant can be granted, on the clients of their tenant only. The other
+// permissions concern the whole deployment.
+var tenantPermissions = []string{
+	permClientsSuspend,
+	permClientsDelete,
+	permClientsRestore,
+	permGroupsManage,
+	permKeysRotate,
+	permSettingsManage,
+	permInvitationsManage,
+	permScimManage,
+	permClientsMetadata,
+}
+
+// Built-in groups and roles are used when no group or role of the same name has
+// been defined, so that members of the "admin" group keep every permission
+// until an admin decides otherwise.
+var builtinGroups = map[string]Group{
+	"admin": {Key: "admin", Name: "admin", Description: "Administrators", Roles: []string{"admin"}},
+}
+var builtinRoles = map[string]Role{
+	"admin": {Name: "admin", Description: "Every permission", Permissions: []string{"*"}},
+}
+
+// Token claim modes (TOKEN_CLAIMS). Tokens carry the groups of the client by
+// default, which is what the api-gateway expects.
+const (
+	claimGroups      = "groups"
+	claimPermissions = "permissions"
+	claimBoth        = "both"
+)
+
+// Group describes a group clients of a tenant can be members of. Groups of the
+// default tenant are stored under their name, groups of other tenants under
+// their tenant ID and name (see groupKey).
+type Group struct {
+	Key         string   `bson:"_id" json:"-"`
+	Name        string   `bson:"name" json:"name"`
+	TenantId    string   `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
+	Description string   `bson:"description" json:"description"`
+	Roles       []string `bson:"roles" json:"roles"`
+
+	// Approvers are the groups whose members can approve requests for
+	// membership of the group (see groupRequests.go)
+	Approvers []string `bson:"approvers,omitempty" json:"approvers,omitempty"`
+}
+
+// Role describes a set of permissions that can be assigned to groups
+type Role struct {
+	Name        string   `bson:"_id" json:"name"`
+	Description string   `bson:"description" json:"description"`
+	Permissions []string `bson:"permissions" json:"permissions"`
+}
+
+// getGroupCollection returns the collection groups are stored in
+func getGroupCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("groups")
+}
+
+// getRoleCollection returns the collection roles are stored in
+func getRoleCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("roles")
+}
+
+// validPermission checks if a permission can be granted to a role
+func validPermission(permission string) bool {
+	if permission == "*" || contains(knownPermissions, permission) {
+		return true
+	}
+	resource, action, found := strings.Cut(permission, ":")
+	if !found || action != "*" {
+		return false
+	}
+	for _, known := range knownPermissions {
+		if strings.HasPrefix(known, resource+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPermission checks if a set of granted permissions includes the permission
+func hasPermission(granted []string, permission string) bool {
+	resource, _, _ := strings.Cut(permission, ":")
+	for _, p := range granted {
+		if p == "*" || p == permission || p == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// groupKey returns the document ID of a group of a tenant
+func groupKey(tenantId string, name string) string {
+	if tenantId == "" {
+		return name
+	}
+	return tenantId + "/" + name
+}
+
+// getGroups returns the groups of a tenant of the given names, falling back on
+// the built-in groups for names that have not been defined. Unknown names are
+// ignored.
+func getGroups(ctx context.Context, clients *mongo.Collection, tenantId string, names []string) ([]Group, error) {
+	keys := []string{}
+	for _, name := range names {
+		keys = append(keys, groupKey(tenantId, name))
+	}
+
+	groups := []Group{}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getGroupCollection(clients).Find(dbCtx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(dbCtx, &groups); err != nil {
+		return nil, err
+	}
+
+	// Groups defined before tenants were introduced have no name field
+	for i := range groups {
+		if groups[i].Name == "" {
+			groups[i].Name = groups[i].Key
+		}
+	}
+
+	for _, name := range names {
+		builtin, ok := builtinGroups[name]
+		if !ok {
+			continue
+		}
+		defined := false
+		for _, group := range groups {
+			defined = defined || group.Name == name
+		}
+		if !defined {
+			builtin.Key = groupKey(tenantId, name)
+			builtin.TenantId = tenantId
+			groups = append(groups, builtin)
+		}
+	}
+	return groups, nil
+}
+
+// getRoles returns the roles of the given names, falling back on the built-in
+// roles for names that have not been defined. Unknown names are ignored.
+func getRoles(ctx context.Context, clients *mongo.Collection, names []string) ([]Role, error) {
+	roles := []Role{}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getRoleCollection(clients).Find(dbCtx, bson.M{"_id": bson.M{"$in": names}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(dbCtx, &roles); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		builtin, ok := builtinRoles[name]
+		if !ok {
+			continue
+		}
+		defined := false
+		for _, role := range roles {
+			defined = defined || role.Name == name
+		}
+		if !defined {
+			roles = append(roles, builtin)
+		}
+	}
+	return roles, nil
+}
+
+// groupExists checks if a group has been defined in a tenant or is a built-in
+// group
+func groupExists(ctx context.Context, clients *mongo.Collection, tenantId string, name string) bool {
+	groups, err := getGroups(ctx, clients, tenantId, []string{name})
+	return err == nil && len(groups) == 1
+}
+
+// clientPermissions resolves the permissions granted to a client through the
+// roles of its groups
+func clientPermissions(ctx context.Context, clients *mongo.Collection, client *Client) ([]string, error) {
+	groups, err := getGroups(ctx, clients, client.TenantId, client.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	roleNames := []string{}
+	for _, group := range groups {
+		roleNames = append(roleNames, group.Roles...)
+	}
+	roles, err := getRoles(ctx, clients, roleNames)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := []string{}
+	for _, role := range roles {
+		for _, permission := range role.Permissions {
+			if !contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions, nil
+}
+
+// setClaimGroups sets the groups and/or permissions of the client on a token
+// claim as configured by TOKEN_CLAIMS, along with its kind and the custom
+// attributes listed in ATTRIBUTE_CLAIMS
+func setClaimGroups(ctx context.Context, clients *mongo.Collection, client *Client, claim *Claim) error {
+	claim.Kind = clientKind(client)
+	claim.Attributes = attributeClaims(client)
+	if tokenClaims != claimPermissions {
+		claim.Groups = client.Groups
+	}
+	if tokenClaims == claimPermissions || tokenClaims == claimBoth {
+		permissions, err := clientPermissions(ctx, clients, client)
+		if err != nil {
+			return err
+		}
+		claim.Permissions = permissions
+	}
+	return nil
+}
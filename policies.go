@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/cel-go/cel"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Besides permissions granted through roles, admins can define authorization
+// policies as CEL expressions (https://github.com/google/cel-spec). A policy
+// grants a permission whenever its expression evaluates to true for the caller,
+// the target client and the request, e.g. members of the support group may
+// suspend clients that are not admins:
+//
+//	permission: clients:suspend
+//	expression: "support" in caller.groups && !("admin" in target.groups)
+//
+// The expression has access to:
+//   - caller: id, email, kind, groups, permissions, service and tenant of the
+//     client making the request
+//   - target: id, email, kind, groups, suspended, service, ownerId and tenant of
+//     the client the action is performed on, empty when there is none
+//   - request: method, path, ip and userAgent of the request
+//
+// Policies are versioned, saving a policy adds a new version and only the
+// latest version of a policy is enforced. Deleting a policy adds a disabled
+// version so that its history is kept.
+
+// PolicyForm describes the expected JSON payload when an admin saves a policy
+type PolicyForm struct {
+	Permission  string `json:"permission" validate:"required"`
+	Expression  string `json:"expression" validate:"required"`
+	Description string `json:"description"`
+}
+
+// PolicyEvaluationForm describes the expected JSON payload of a dry-run policy
+// evaluation. A draft expression is evaluated on its own, otherwise the
+// enforced policies of the permission are evaluated.
+type PolicyEvaluationForm struct {
+	Permission string            `json:"permission" validate:"required_without=Expression"`
+	Expression string            `json:"expression"`
+	CallerId   string            `json:"callerId" validate:"required"`
+	TargetId   string            `json:"targetId"`
+	Request    map[string]string `json:"request"`
+}
+
+// Policy describes a version of an authorization policy
+type Policy struct {
+	Id          primitive.ObjectID `bson:"_id" json:"id"`
+	Name        string             `bson:"name" json:"name"`
+	Version     int                `bson:"version" json:"version"`
+	Permission  string             `bson:"permission" json:"permission"`
+	Expression  string             `bson:"expression" json:"expression"`
+	Description string             `bson:"description" json:"description"`
+	Disabled    bool               `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	CreatedBy   primitive.ObjectID `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// PolicyResult describes the outcome of evaluating a policy
+type PolicyResult struct {
+	Name    string `json:"name,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+}
+
+var errPolicyNotBool = errors.New("policy expression must evaluate to a bool")
+
+// policyEnv declares the variables policy expressions have access to
+var policyEnv *cel.Env
+
+// policyPrograms caches the compiled expression of each policy version, which
+// never changes once saved
+var policyPrograms sync.Map
+
+func init() {
+	env, err := cel.NewEnv(
+		cel.Variable("caller", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("target", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		log.Fatal("Unable to create policy environment: ", err)
+	}
+	policyEnv = env
+}
+
+// getPolicyCollection returns the collection policy versions are stored in
+func getPolicyCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("policies")
+}
+
+// compilePolicy type-checks a policy expression and returns the program
+// evaluating it
+func compilePolicy(expression string) (cel.Program, error) {
+	ast, issues := policyEnv.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if !cel.BoolType.IsAssignableType(ast.OutputType()) {
+		return nil, errPolicyNotBool
+	}
+	return policyEnv.Program(ast)
+}
+
+// evaluatePolicy evaluates a compiled expression against the given variables.
+// Errors, such as accessing a field of a missing target, deny the action.
+func evaluatePolicy(program cel.Program, vars map[string]interface{}) (bool, error) {
+	out, _, err := program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		return false, errPolicyNotBool
+	}
+	return allowed, nil
+}
+
+// policyVars builds the variables of a policy evaluation
+func policyVars(ctx context.Context, clients *mongo.Collection, caller *Client, target *Client, request map[string]interface{}) map[string]interface{} {
+	permissions, _ := clientPermissions(ctx, clients, caller)
+	vars := map[string]interface{}{
+		"caller": map[string]interface{}{
+			"id":          caller.Id.Hex(),
+			"email":       caller.Email,
+			"kind":        clientKind(caller),
+			"groups":      caller.Groups,
+			"permissions": permissions,
+			"service":     inGroup(caller, "service"),
+			"tenant":      caller.TenantId,
+		},
+		"target":  map[string]interface{}{},
+		"request": request,
+	}
+	if target != nil {
+		ownerId := ""
+		if target.OwnerId != nil {
+			ownerId = target.OwnerId.Hex()
+		}
+		vars["target"] = map[string]interface{}{
+			"id":        target.Id.Hex(),
+			"email":     target.Email,
+			"kind":      clientKind(target),
+			"groups":    target.Groups,
+			"suspended": target.Suspended,
+			"service":   inGroup(target, "service"),
+			"ownerId":   ownerId,
+			"tenant":    target.TenantId,
+		}
+	}
+	return vars
+}
+
+// requestVars returns the request attributes policies have access to
+func requestVars(c *gin.Context) map[string]interface{} {
+	return map[string]interface{}{
+		"method":    c.Request.Method,
+		"path":      c.FullPath(),
+		"ip":        c.ClientIP(),
+		"userAgent": c.Request.UserAgent(),
+	}
+}
+
+// getLatestPolicies returns the latest version of every policy, including
+// disabled ones
+func getLatestPolicies(ctx context.Context, clients *mongo.Collection) ([]Policy, error) {
+	versions := []Policy{}
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "version", Value: -1}})
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getPolicyCollection(clients).Find(dbCtx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(dbCtx, &versions); err != nil {
+		return nil, err
+	}
+
+	latest := []Policy{}
+	for _, policy := range versions {
+		if len(latest) == 0 || latest[len(latest)-1].Name != policy.Name {
+			latest = append(latest, policy)
+		}
+	}
+	return latest, nil
+}
+
+// evaluatePolicies evaluates the enforced policies granting a permission
+func evaluatePolicies(ctx context.Context, clients *mongo.Collection, permission string, vars map[string]interface{}) ([]PolicyResult, error) {
+	policies, err := getLatestPolicies(ctx, clients)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []PolicyResult{}
+	for _, policy := range policies {
+		if policy.Disabled || policy.Permission != permission {
+			continue
+		}
+		result := PolicyResult{Name: policy.Name, Version: policy.Version}
+
+		var program cel.Program
+		var err error
+		if cached, ok := policyPrograms.Load(policy.Id); ok {
+			program = cached.(cel.Program)
+		} else if program, err = compilePolicy(policy.Expression); err == nil {
+			policyPrograms.Store(policy.Id, program)
+		}
+		if err == nil {
+			result.Allowed, err = evaluatePolicy(program, vars)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// clientAuthorised checks if a client is granted a permission, on the target
+// client if any, through its roles or an authorization policy. Clients of a
+// tenant other than the default tenant can only be granted tenant permissions
+// on clients of their tenant. A storage error is returned rather than taken as
+// the permission being denied.
+func clientAuthorised(clients *mongo.Collection, c *gin.Context, client *Client, permission string, target *Client) (bool, error) {
+	// Admins of a tenant only act on the clients of their tenant
+	if client.TenantId != "" {
+		if !contains(tenantPermissions, permission) || (target != nil && target.TenantId != client.TenantId) {
+			return false, nil
+		}
+	}
+
+	permissions, err := clientPermissions(c.Request.Context(), clients, client)
+	if err != nil {
+		return false, err
+	}
+	if hasPermission(permissions, permission) {
+		return true, nil
+	}
+
+	results, err := evaluatePolicies(c.Request.Context(), clients, permission, policyVars(c.Request.Context(), clients, client, target, requestVars(c)))
+	if err != nil {
+		log.Println("Unable to evaluate policies: ", err)
+		return false, err
+	}
+	for _, result := range results {
+		if result.Allowed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorise authenticates the client of the claim and checks it is granted
+// the permission, on the target client if any
+func authorise(clients *mongo.Collection, c *gin.Context, claim *Claim, permission string, target *Client) (int, *Client) {
+	code, client := authAndAuthorised(c.Request.Context(), clients, claim)
+	if code != http.StatusOK {
+		return code, nil
+	}
+	authorised, err := clientAuthorised(clients, c, client, permission, target)
+	if err != nil {
+		return storageErrorStatus(err), nil
+	}
+	if !authorised {
+		return http.StatusUnauthorized, nil
+	}
+	return http.StatusOK, client
+}
+
+// savePolicy adds a new version of a policy. If a concurrent save claimed the
+// same version the policy is saved as the next version instead.
+func savePolicy(ctx context.Context, clients *mongo.Collection, policy *Policy) error {
+	for {
+		latest := &Policy{}
+		opts := options.FindOne().SetSort(bson.M{"version": -1})
+		findCtx, cancelFind := dbContext(ctx)
+		err := getPolicyCollection(clients).FindOne(findCtx, bson.M{"name": policy.Name}, opts).Decode(latest)
+		cancelFind()
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		policy.Id = primitive.NewObjectID()
+		policy.Version = latest.Version + 1
+		policy.CreatedAt = time.Now()
+		insertCtx, cancelInsert := dbContext(ctx)
+		_, err = getPolicyCollection(clients).InsertOne(insertCtx, policy)
+		cancelInsert()
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+}
+
+// authorisePolicyManagement processes the token cookie of the request and
+// checks the client is allowed to manage policies. It aborts the request and
+// returns false if not.
+func authorisePolicyManagement(c *gin.Context, clients *mongo.Collection) (*Client, bool) {
+	token, _ := c.Cookie("token")
+	code, claim := processClaim(token)
+	if code != http.StatusOK {
+		c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+		return nil, false
+	}
+
+	status, admin := authorise(clients, c, claim, permPoliciesManage, nil)
+	if status != http.StatusOK {
+		c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+		return nil, false
+	}
+	return admin, true
+}
+
+// makeListPoliciesHandler lists the latest version of every policy
+func makeListPoliciesHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authorisePolicyManagement(c, clients); !ok {
+			return
+		}
+
+		policies, err := getLatestPolicies(c.Request.Context(), clients)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list policies")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"policies": policies})
+	}
+}
+
+// makePolicyVersionsHandler lists every version of a policy, most recent first
+func makePolicyVersionsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authorisePolicyManagement(c, clients); !ok {
+			return
+		}
+
+		versions := []Policy{}
+		opts := options.Find().SetSort(bson.M{"version": -1})
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getPolicyCollection(clients).Find(dbCtx, bson.M{"name": c.Param("name")}, opts)
+		if err == nil {
+			err = cursor.All(dbCtx, &versions)
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list policy versions")
+			return
+		}
+		if len(versions) == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Policy not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"versions": versions})
+	}
+}
+
+// makePutPolicyHandler saves a new version of a policy once its expression
+// compiles
+func makePutPolicyHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form PolicyForm
+
+		admin, ok := authorisePolicyManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if !contains(knownPermissions, form.Permission) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown permission: " + form.Permission})
+			return
+		}
+
+		if _, err := compilePolicy(form.Expression); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid expression: " + err.Error()})
+			return
+		}
+
+		policy := &Policy{
+			Name:        c.Param("name"),
+			Permission:  form.Permission,
+			Expression:  form.Expression,
+			Description: form.Description,
+			CreatedBy:   admin.Id,
+		}
+		if err := savePolicy(c.Request.Context(), clients, policy); err != nil {
+			abortWithStorageError(c, err, "Unable to save policy")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "save-policy", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: policy.Name})
+		c.JSON(http.StatusOK, gin.H{"policy": policy})
+	}
+}
+
+// makeDeletePolicyHandler disables a policy by saving a disabled version of it
+func makeDeletePolicyHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authorisePolicyManagement(c, clients)
+		if !ok {
+			return
+		}
+
+		latest := &Policy{}
+		opts := options.FindOne().SetSort(bson.M{"version": -1})
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		err := getPolicyCollection(clients).FindOne(dbCtx, bson.M{"name": c.Param("name")}, opts).Decode(latest)
+		if err == mongo.ErrNoDocuments || latest.Disabled {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Policy not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete policy")
+			return
+		}
+
+		latest.Disabled = true
+		latest.CreatedBy = admin.Id
+		if err := savePolicy(c.Request.Context(), clients, latest); err != nil {
+			abortWithStorageError(c, err, "Unable to delete policy")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "delete-policy", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: latest.Name})
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully deleted policy"})
+	}
+}
+
+// makeEvaluatePolicyHandler evaluates a draft expression or the enforced
+// policies of a permission for the given caller, target and request without
+// performing any action
+func makeEvaluatePolicyHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form PolicyEvaluationForm
+
+		if _, ok := authorisePolicyManagement(c, clients); !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		caller, err := getClientByIdOrEmail(c.Request.Context(), clients, "", form.CallerId, "")
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Caller not found"})
+			return
+		}
+		var target *Client
+		if form.TargetId != "" {
+			if target, err = getClientByIdOrEmail(c.Request.Context(), clients, "", form.TargetId, ""); err != nil {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Target not found"})
+				return
+			}
+		}
+
+		request := map[string]interface{}{}
+		for key, value := range form.Request {
+			request[key] = value
+		}
+		vars := policyVars(c.Request.Context(), clients, caller, target, request)
+
+		if form.Expression != "" {
+			program, err := compilePolicy(form.Expression)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid expression: " + err.Error()})
+				return
+			}
+			result := PolicyResult{}
+			if result.Allowed, err = evaluatePolicy(program, vars); err != nil {
+				result.Error = err.Error()
+			}
+			c.JSON(http.StatusOK, gin.H{"allowed": result.Allowed, "results": []PolicyResult{result}})
+			return
+		}
+
+		results, err := evaluatePolicies(c.Request.Context(), clients, form.Permission, vars)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to evaluate policies")
+			return
+		}
+		allowed := false
+		for _, result := range results {
+			allowed = allowed || result.Allowed
+		}
+		c.JSON(http.StatusOK, gin.H{"allowed": allowed, "results": results})
+	}
+}
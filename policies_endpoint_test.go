@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPolicyGrantsSuspension(t *testing.T) {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+
+	// Members of the support group may suspend clients that are not admins
+	policy := `{"permission": "clients:suspend",
+				"expression": "\"support\" in caller.groups && !(\"admin\" in target.groups)"}`
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/policies/support-suspend", strings.NewReader(policy))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	_, supportToken := insertTestClient(t, []string{"support"})
+	userId, _ := insertTestClient(t, []string{})
+	adminId, _ := insertTestClient(t, []string{"admin"})
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/suspend", strings.NewReader(`{"id": "`+userId.Hex()+`"}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: supportToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/suspend", strings.NewReader(`{"id": "`+adminId.Hex()+`"}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: supportToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// Once deleted the policy is no longer enforced but its versions are kept
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/policies/support-suspend", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/suspend", strings.NewReader(`{"id": "`+userId.Hex()+`"}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: supportToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/policies/support-suspend/versions", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+
+	var listed struct {
+		Versions []Policy `json:"versions"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &listed)
+	assert.True(t, listed.Versions[0].Disabled)
+	assert.Equal(t, listed.Versions[1].Version+1, listed.Versions[0].Version)
+}
+
+func TestPolicyDryRunEvaluation(t *testing.T) {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	supportId, _ := insertTestClient(t, []string{"support"})
+	userId, _ := insertTestClient(t, []string{})
+
+	recorder := httptest.NewRecorder()
+	payload := `{"expression": "\"support\" in caller.groups && !target.service",
+				"callerId": "` + supportId.Hex() + `", "targetId": "` + userId.Hex() + `"}`
+	req, _ := http.NewRequest("POST", "/policies/evaluate", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"allowed":true`)
+
+	// Expressions that do not compile are rejected
+	recorder = httptest.NewRecorder()
+	payload = `{"expression": "caller.groups +", "callerId": "` + supportId.Hex() + `"}`
+	req, _ = http.NewRequest("POST", "/policies/evaluate", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestConcurrentPolicySavesGetDistinctVersions(t *testing.T) {
+	const saves = 10
+	name := "concurrent-" + primitive.NewObjectID().Hex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < saves; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			policy := &Policy{Name: name, Permission: permClientsSuspend, Expression: "false"}
+			assert.NoError(t, savePolicy(context.Background(), clients, policy))
+		}()
+	}
+	wg.Wait()
+
+	versions := map[int]bool{}
+	cursor, _ := getPolicyCollection(clients).Find(context.Background(), bson.M{"name": name})
+	var saved []Policy
+	cursor.All(context.Background(), &saved)
+	for _, policy := range saved {
+		versions[policy.Version] = true
+	}
+	assert.Len(t, saved, saves)
+	assert.Len(t, versions, saves)
+}
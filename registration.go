@@ -21,12 +21,22 @@ type UserRegistrationForm struct {
 	FirstName string   `json:"firstName" validate:"required"`
 	LastName  string   `json:"lastName" validate:"required"`
 	Groups    []string `json:"groups" validate:"required"`
+	Consents  []string `json:"consents"`
+
+	// Custom attributes validated against the attribute schema of the tenant
+	// (see attributes.go)
+	Attributes map[string]interface{} `json:"attributes"`
 }
 
+// ServiceRegistrationForm describes the expected json payload when a user
+// registers a service, device or bot (a service by default). The service can
+// also be owned by a team the user is a member of.
 type ServiceRegistrationForm struct {
+	Kind   string   `json:"kind" validate:"omitempty,oneof=service device bot"`
 	Email  string   `json:"email" validate:"required,email"`
 	Name   string   `json:"name" validate:"required"`
 	Groups []string `json:"groups" validate:"required"`
+	Team   string   `json:"team"`
 }
 
 // makeUserRegistrationHandler for user registration endpoint. Checks valid
@@ -35,6 +45,12 @@ func makeUserRegistrationHandler(clients *mongo.Collection, validate *validator.
 	return func(c *gin.Context) {
 		var form UserRegistrationForm
 
+		// Closed deployments only register users through invitations
+		if registrationMode == registrationInvite {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Registration is by invitation only"})
+			return
+		}
+
 		// Bind the JSON payload to the form
 		if err := c.ShouldBindJSON(&form); err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
@@ -47,27 +63,81 @@ func makeUserRegistrationHandler(clients *mongo.Collection, validate *validator.
 			return
 		}
 
-		// Check if user already exists
-		if clientExists(clients, form.Email) {
-			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A user associated with the email address is already registered"})
+		// The user registers to the tenant of the request
+		tenantId := requestTenant(c)
+		settings, err := getTenantSettings(c.Request.Context(), clients, tenantId)
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Tenant not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get tenant settings")
+			return
+		}
+
+		if err := settings.checkPassword(form.Password); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 			return
 		}
 
-		if err := createNewUserClient(clients, form.Email, form.Password, form.FirstName, form.LastName, form.Groups); err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to register user"})
+		schema, err := getAttributeSchema(c.Request.Context(), clients, tenantId)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get attribute schema")
+			return
+		}
+		if err := validateAttributes(schema.Attributes, form.Attributes); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		// Privileged groups are not granted straight away but need approval
+		groups, pending := applyRegistrationPolicy(clients, c, tenantId, settings, form.Groups)
+
+		user, err := createNewUserClient(c.Request.Context(), clients, tenantId, form.Email, form.Password, form.FirstName, form.LastName, groups, form.Consents, form.Attributes)
+		if err == errEmailTaken {
+			recordAudit(clients, c, AuditEvent{Action: "register-user", Outcome: auditFailure, Reason: "email already registered"})
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A user associated with the email address is already registered"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to register user")
+			return
 		}
 
+		recordGroupRequests(c.Request.Context(), clients, user.Id, pending, groupRequestRegistration)
+		recordAudit(clients, c, AuditEvent{Action: "register-user", ActorId: user.Id.Hex(), TargetId: user.Id.Hex(), Outcome: auditSuccess})
+		dispatchWebhookEvent(clients, webhookClientRegistered, gin.H{"clientId": user.Id.Hex(), "tenantId": user.TenantId, "email": user.Email, "groups": user.Groups})
+
+		if len(pending) > 0 {
+			c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully", "pendingGroups": pending})
+			return
+		}
 		c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully"})
 	}
 }
 
-// makeServiceRegistrationHandler for service registration endpoint. The handler
-// returns a JWT token that does not expire and is used to authenticate the
-// service.
+// makeServiceRegistrationHandler for service registration endpoint. Only an
+// authenticated user can register a service, device or bot, which it then owns.
+// The handler returns a JWT token used to authenticate the client, which does
+// not expire for services.
 func makeServiceRegistrationHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var form ServiceRegistrationForm
 
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, owner := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			recordAudit(clients, c, AuditEvent{Action: "register-service", ActorId: claim.Id, Outcome: auditFailure, Reason: "not authorised"})
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
 		// Bind the JSON payload to the form
 		if err := c.ShouldBindJSON(&form); err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
@@ -80,25 +150,54 @@ func makeServiceRegistrationHandler(clients *mongo.Collection, validate *validat
 			return
 		}
 
-		// Check if service already registered
-		if clientExists(clients, form.Email) {
-			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A service associated with the email address is already registered"})
+		// A service can only be owned by a team the user is a member of
+		if form.Team != "" && !inGroup(owner, form.Team) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not a member of the team"})
+			return
+		}
+
+		// The service belongs to the tenant of its owner
+		settings, err := getTenantSettings(c.Request.Context(), clients, owner.TenantId)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get tenant settings")
 			return
 		}
 
+		// Privileged groups are not granted straight away but need approval
+		groups, pending := applyRegistrationPolicy(clients, c, owner.TenantId, settings, form.Groups)
+
 		// Create new client
-		service, err := createNewServiceClient(clients, form.Email, form.Name, form.Groups)
+		kind := form.Kind
+		if kind == "" {
+			kind = kindService
+		}
+		service, err := createNewMachineClient(c.Request.Context(), clients, owner.TenantId, kind, form.Email, form.Name, groups, owner.Id, form.Team)
+		if err == errEmailTaken {
+			recordAudit(clients, c, AuditEvent{Action: "register-service", Outcome: auditFailure, Reason: "email already registered"})
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A service associated with the email address is already registered"})
+			return
+		}
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to register service"})
+			abortWithStorageError(c, err, "Unable to register service")
+			return
 		}
 
-		// Return a JWT token (that doesn't expire) to the client so that it
-		// can be used to authenticate the service
-		apiToken, err := generateAPIClientToken(service)
+		recordGroupRequests(c.Request.Context(), clients, service.Id, pending, groupRequestRegistration)
+		recordAudit(clients, c, AuditEvent{Action: "register-service", ActorId: owner.Id.Hex(), TargetId: service.Id.Hex(), Outcome: auditSuccess})
+		dispatchWebhookEvent(clients, webhookClientRegistered, gin.H{"clientId": service.Id.Hex(), "tenantId": service.TenantId, "email": service.Email, "groups": service.Groups})
+
+		// Return a JWT token (that doesn't expire for services) to the client
+		// so that it can be used to authenticate it
+		apiToken, err := generateAPIClientToken(c.Request.Context(), clients, service)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to generate API token"})
+			abortWithStorageError(c, err, "Unable to generate API token")
+			return
 		}
 
+		if len(pending) > 0 {
+			c.JSON(http.StatusCreated, gin.H{"message": "Service registered successfully", "apiToken": apiToken, "pendingGroups": pending})
+			return
+		}
 		c.JSON(http.StatusCreated, gin.H{"message": "Service registered successfully", "apiToken": apiToken})
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -31,7 +32,7 @@ func TestSuccessfulUserRegistration(t *testing.T) {
 
 	// Register new user client JSON
 	user := `{"email": "` + newUserEmail + `", "password": "somePassword", 
-				"firstName": "John", "lastName": "Smith", "groups": ["admin"]}`
+				"firstName": "John", "lastName": "Smith", "groups": []}`
 
 	// Create a new request
 	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
@@ -68,8 +69,10 @@ func TestSuccessfulServiceRegistration(t *testing.T) {
 	servicePayload := `{"email": "` + newServiceEmail + `", "name": "Service A",
 						"groups": ["tempProbes"]}`
 
-	// Create a new request
+	// Create a new request made by an authenticated user
+	_, ownerToken := insertTestClient(t, []string{})
 	req, _ := http.NewRequest("POST", "/register-service", strings.NewReader(servicePayload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: ownerToken})
 
 	// Send request to service
 	handler.ServeHTTP(recorder, req)
@@ -151,3 +154,52 @@ func TestFailedInvalidJson(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, recorder.Code)
 	assert.Equal(t, `{"message":"Invalid JSON payload"}`, recorder.Body.String())
 }
+
+// Test case for concurrent registrations with the same email, of which only one
+// must succeed
+func TestConcurrentUserRegistration(t *testing.T) {
+	newUserEmail := genRandomEmail()
+	user := `{"email": "` + newUserEmail + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+
+	const attempts = 10
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+			handler.ServeHTTP(recorder, req)
+			codes <- recorder.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
+	}
+	assert.Equal(t, 1, created)
+
+	count, _ := clients.CountDocuments(context.Background(), bson.M{"email": newUserEmail})
+	assert.EqualValues(t, 1, count)
+}
+
+func TestFailedRegistrationLeavesNoUser(t *testing.T) {
+	email := genRandomEmail()
+
+	// A password too long to be hashed fails the registration before the user
+	// is inserted
+	_, err := createNewUserClient(context.Background(), clients, "", email, strings.Repeat("p", 80), "John", "Smith", []string{}, nil, nil)
+	assert.Error(t, err)
+
+	err = clients.FindOne(context.Background(), bson.M{"email": normaliseEmail(email)}).Err()
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+}
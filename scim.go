@@ -0,0 +1,1183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// HR systems and identity providers provision users and groups through the
+// SCIM 2.0 API (RFC 7643 and RFC 7644) under /scim/v2. SCIM users are the user
+// clients of a tenant and SCIM groups are the groups defined in the tenant.
+// Deactivating a user suspends it and deleting a user starts the deletion
+// cascade.
+//
+// Provisioning systems authenticate with a SCIM credential, a bearer token
+// created by an admin with the scim:manage permission, which can only
+// provision the tenant of the admin.
+
+// SCIM schemas and content type
+const (
+	scimUserSchema        = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema       = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema        = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema       = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema       = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema      = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimContentType       = "application/scim+json"
+	scimMaxResults        = 200
+	scimDeprovisionReason = "deprovisioned through SCIM"
+)
+
+var errScimInvalidValue = errors.New("invalid value")
+
+// ScimCredential describes a bearer credential provisioning a tenant
+type ScimCredential struct {
+	Id         primitive.ObjectID `bson:"_id" json:"id"`
+	TenantId   string             `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
+	Name       string             `bson:"name" json:"name"`
+	SecretHash string             `bson:"secretHash" json:"-"`
+	CreatedBy  primitive.ObjectID `bson:"createdBy" json:"createdBy"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	LastUsedAt *time.Time         `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+}
+
+// ScimCredentialForm describes the expected JSON payload when an admin creates
+// a SCIM credential
+type ScimCredentialForm struct {
+	Name string `json:"name" validate:"required"`
+}
+
+// ScimName describes the name of a SCIM user
+type ScimName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// ScimMultiValue describes an element of a multi-valued attribute (emails,
+// groups and members)
+type ScimMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// ScimMeta describes the metadata of a SCIM resource
+type ScimMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	Location     string     `json:"location"`
+}
+
+// ScimUser describes a SCIM user. The password can only be written.
+type ScimUser struct {
+	Schemas    []string         `json:"schemas"`
+	Id         string           `json:"id,omitempty"`
+	ExternalId string           `json:"externalId,omitempty"`
+	UserName   string           `json:"userName"`
+	Name       *ScimName        `json:"name,omitempty"`
+	Emails     []ScimMultiValue `json:"emails,omitempty"`
+	Active     *bool            `json:"active,omitempty"`
+	Password   string           `json:"password,omitempty"`
+	Groups     []ScimMultiValue `json:"groups,omitempty"`
+	Meta       *ScimMeta        `json:"meta,omitempty"`
+}
+
+// ScimGroup describes a SCIM group
+type ScimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []ScimMultiValue `json:"members"`
+	Meta        *ScimMeta        `json:"meta,omitempty"`
+}
+
+// ScimPatch describes a SCIM PATCH request
+type ScimPatch struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []ScimPatchOperation `json:"Operations"`
+}
+
+// ScimPatchOperation describes an operation of a SCIM PATCH request
+type ScimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimUserChanges describes the changes made to a user by a replace or a PATCH
+// request. Unset fields are left unchanged.
+type scimUserChanges struct {
+	email      *string
+	givenName  *string
+	familyName *string
+	externalId *string
+	active     *bool
+	password   *string
+}
+
+// getScimCredentialCollection returns the collection SCIM credentials are
+// stored in
+func getScimCredentialCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("scimCredentials")
+}
+
+// scimError aborts the request with a SCIM error response
+func scimError(c *gin.Context, status int, scimType string, detail string) {
+	body := gin.H{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(status), "detail": detail}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	c.Header("Content-Type", scimContentType)
+	c.AbortWithStatusJSON(status, body)
+}
+
+// scimJSON writes a SCIM response
+func scimJSON(c *gin.Context, status int, body interface{}) {
+	c.Header("Content-Type", scimContentType)
+	c.JSON(status, body)
+}
+
+// authenticateScim checks the bearer credential of a SCIM request. It aborts the
+// request and returns false if it is invalid.
+func authenticateScim(c *gin.Context, clients *mongo.Collection) (*ScimCredential, bool) {
+	id, secret, _ := strings.Cut(bearerToken(c), ".")
+	objID, _ := primitive.ObjectIDFromHex(id)
+	credential := &ScimCredential{}
+	dbCtx, cancel := dbContext(c.Request.Context())
+	defer cancel()
+	err := getScimCredentialCollection(clients).FindOne(dbCtx, bson.M{"_id": objID}).Decode(credential)
+	if err != nil || !strings.EqualFold(credential.SecretHash, hashAPIKey(secret)) {
+		scimError(c, http.StatusUnauthorized, "", "Invalid SCIM credential")
+		return nil, false
+	}
+	usedCtx, cancelUsed := dbContext(c.Request.Context())
+	defer cancelUsed()
+	getScimCredentialCollection(clients).UpdateOne(usedCtx, bson.M{"_id": credential.Id}, bson.M{"$set": bson.M{"lastUsedAt": time.Now()}})
+	return credential, true
+}
+
+// scimActor returns the audit actor of a SCIM credential
+func scimActor(credential *ScimCredential) string {
+	return "scim:" + credential.Id.Hex()
+}
+
+// scimUserResource returns the SCIM representation of a user
+func scimUserResource(client *Client) ScimUser {
+	active := !client.Suspended
+	created := client.Id.Timestamp()
+	groups := []ScimMultiValue{}
+	for _, group := range client.Groups {
+		groups = append(groups, ScimMultiValue{Value: group, Display: group})
+	}
+	return ScimUser{
+		Schemas:    []string{scimUserSchema},
+		Id:         client.Id.Hex(),
+		ExternalId: client.ExternalId,
+		UserName:   clientDisplayEmail(client),
+		Name:       &ScimName{GivenName: client.FirstName, FamilyName: client.LastName},
+		Emails:     []ScimMultiValue{{Value: clientDisplayEmail(client), Type: "work", Primary: true}},
+		Active:     &active,
+		Groups:     groups,
+		Meta:       &ScimMeta{ResourceType: "User", Created: &created, Location: "/scim/v2/Users/" + client.Id.Hex()},
+	}
+}
+
+// scimGroupResource returns the SCIM representation of a group and its members
+func scimGroupResource(group *Group, members []Client) ScimGroup {
+	values := []ScimMultiValue{}
+	for _, member := range members {
+		values = append(values, ScimMultiValue{Value: member.Id.Hex(), Display: member.Email})
+	}
+	return ScimGroup{
+		Schemas:     []string{scimGroupSchema},
+		Id:          group.Name,
+		DisplayName: group.Name,
+		Members:     values,
+		Meta:        &ScimMeta{ResourceType: "Group", Location: "/scim/v2/Groups/" + group.Name},
+	}
+}
+
+// scimUsersFilter returns the filter matching the user clients of a tenant
+func scimUsersFilter(tenantId string) bson.M {
+	filter := tenantFilter(tenantId)
+	filter["kind"] = kindUser
+	filter["deletionState"] = bson.M{"$exists": false}
+	return filter
+}
+
+// getScimUser returns a user client of the tenant by its ID
+func getScimUser(ctx context.Context, clients *mongo.Collection, tenantId string, id string) (*Client, error) {
+	filter := scimUsersFilter(tenantId)
+	filter["_id"], _ = primitive.ObjectIDFromHex(id)
+	client := &Client{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := clients.FindOne(dbCtx, filter).Decode(client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// getScimGroup returns a group defined in the tenant by its name. Built-in
+// groups cannot be provisioned until they are defined.
+func getScimGroup(ctx context.Context, clients *mongo.Collection, tenantId string, name string) (*Group, error) {
+	group := &Group{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getGroupCollection(clients).FindOne(dbCtx, bson.M{"_id": groupKey(tenantId, name)}).Decode(group)
+	if err != nil {
+		return nil, err
+	}
+	if group.Name == "" {
+		group.Name = group.Key
+	}
+	return group, nil
+}
+
+// getGroupMembers returns the user clients of the tenant that are members of a
+// group
+func getGroupMembers(ctx context.Context, clients *mongo.Collection, tenantId string, name string) ([]Client, error) {
+	filter := scimUsersFilter(tenantId)
+	filter["groups"] = name
+	members := []Client{}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := clients.Find(dbCtx, filter)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &members)
+	return members, err
+}
+
+// setGroupMembership adds (or removes) the users of the tenant with the IDs to
+// (or from) a group
+func setGroupMembership(ctx context.Context, clients *mongo.Collection, tenantId string, name string, ids []string, member bool) error {
+	objIDs := []primitive.ObjectID{}
+	for _, id := range ids {
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objIDs = append(objIDs, objID)
+		}
+	}
+	if len(objIDs) == 0 {
+		return nil
+	}
+	filter := scimUsersFilter(tenantId)
+	filter["_id"] = bson.M{"$in": objIDs}
+	update := bson.M{"$pull": bson.M{"groups": name}, "$inc": bson.M{"version": 1}}
+	if member {
+		update = bson.M{"$addToSet": bson.M{"groups": name}, "$inc": bson.M{"version": 1}}
+	}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	_, err := clients.UpdateMany(dbCtx, filter, update)
+	return err
+}
+
+// replaceGroupMembers makes the users with the IDs the only members of a group
+func replaceGroupMembers(ctx context.Context, clients *mongo.Collection, tenantId string, name string, ids []string) error {
+	current, err := getGroupMembers(ctx, clients, tenantId, name)
+	if err != nil {
+		return err
+	}
+	removed := []string{}
+	for _, member := range current {
+		if !contains(ids, member.Id.Hex()) {
+			removed = append(removed, member.Id.Hex())
+		}
+	}
+	if err := setGroupMembership(ctx, clients, tenantId, name, removed, false); err != nil {
+		return err
+	}
+	return setGroupMembership(ctx, clients, tenantId, name, ids, true)
+}
+
+// scimListResponse filters the resources, sorted by ID, and returns the page
+// of the startIndex and count query parameters
+func scimListResponse(c *gin.Context, resources []interface{}) (gin.H, error) {
+	filtered := resources
+	if query := c.Query("filter"); query != "" {
+		filter, err := parseScimFilter(query)
+		if err != nil {
+			return nil, err
+		}
+		filtered = []interface{}{}
+		for _, resource := range resources {
+			var values map[string]interface{}
+			encoded, _ := json.Marshal(resource)
+			if json.Unmarshal(encoded, &values) == nil && filter.matches(values) {
+				filtered = append(filtered, resource)
+			}
+		}
+	}
+
+	startIndex, err := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(scimMaxResults)))
+	if err != nil || count < 0 || count > scimMaxResults {
+		count = scimMaxResults
+	}
+
+	page := []interface{}{}
+	for i := startIndex - 1; i < len(filtered) && len(page) < count; i++ {
+		page = append(page, filtered[i])
+	}
+	return gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(filtered),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	}, nil
+}
+
+// scimPatchPath normalises the path of a PATCH operation, stripping the schema
+// and the filter of value paths (e.g. `emails[type eq "work"].value`)
+func scimPatchPath(path string) string {
+	if open := strings.Index(path, "["); open >= 0 {
+		if end := strings.Index(path, "]"); end > open {
+			path = path[:open] + path[end+1:]
+		}
+	}
+	return strings.ToLower(strings.Join(scimAttributePath(path), "."))
+}
+
+// scimString decodes a string value
+func scimString(value json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return "", errScimInvalidValue
+	}
+	return s, nil
+}
+
+// scimBool decodes a boolean value, which some identity providers send as a
+// string
+func scimBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	s, err := scimString(value)
+	if err != nil {
+		return false, err
+	}
+	b, err = strconv.ParseBool(strings.ToLower(s))
+	if err != nil {
+		return false, errScimInvalidValue
+	}
+	return b, nil
+}
+
+// setUserAttribute records the change of a user attribute of a PATCH request
+func (changes *scimUserChanges) setUserAttribute(path string, value json.RawMessage) error {
+	switch path {
+	case "active":
+		active, err := scimBool(value)
+		changes.active = &active
+		return err
+	case "name":
+		var name ScimName
+		if err := json.Unmarshal(value, &name); err != nil {
+			return errScimInvalidValue
+		}
+		changes.givenName, changes.familyName = &name.GivenName, &name.FamilyName
+		return nil
+	case "emails":
+		var emails []ScimMultiValue
+		if err := json.Unmarshal(value, &emails); err != nil || len(emails) == 0 {
+			return errScimInvalidValue
+		}
+		changes.email = &emails[0].Value
+		for _, email := range emails {
+			if email.Primary {
+				changes.email = &email.Value
+			}
+		}
+		return nil
+	case "schemas", "id", "meta", "groups":
+		// Read only attributes are ignored
+		return nil
+	}
+
+	s, err := scimString(value)
+	if err != nil {
+		return err
+	}
+	switch path {
+	case "username", "emails.value":
+		changes.email = &s
+	case "name.givenname":
+		changes.givenName = &s
+	case "name.familyname":
+		changes.familyName = &s
+	case "externalid":
+		changes.externalId = &s
+	case "password":
+		changes.password = &s
+	default:
+		return errors.New("unsupported attribute " + path)
+	}
+	return nil
+}
+
+// userChangesFromPatch returns the changes made to a user by a PATCH request
+func userChangesFromPatch(patch *ScimPatch) (*scimUserChanges, error) {
+	changes := &scimUserChanges{}
+	empty := ""
+	for _, operation := range patch.Operations {
+		path := scimPatchPath(operation.Path)
+		switch strings.ToLower(operation.Op) {
+		case "add", "replace":
+			if path != "" {
+				if err := changes.setUserAttribute(path, operation.Value); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			// Without a path the value holds the attributes to change
+			var attributes map[string]json.RawMessage
+			if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+				return nil, errScimInvalidValue
+			}
+			for attribute, value := range attributes {
+				if err := changes.setUserAttribute(scimPatchPath(attribute), value); err != nil {
+					return nil, err
+				}
+			}
+		case "remove":
+			switch path {
+			case "externalid":
+				changes.externalId = &empty
+			case "name.givenname":
+				changes.givenName = &empty
+			case "name.familyname":
+				changes.familyName = &empty
+			default:
+				return nil, errors.New("attribute " + path + " cannot be removed")
+			}
+		default:
+			return nil, errors.New("unsupported operation " + operation.Op)
+		}
+	}
+	return changes, nil
+}
+
+// userChangesFromResource returns the changes made to a user by replacing it
+func userChangesFromResource(user *ScimUser) *scimUserChanges {
+	changes := &scimUserChanges{email: &user.UserName, externalId: &user.ExternalId, active: user.Active}
+	for _, email := range user.Emails {
+		if email.Primary {
+			changes.email = &email.Value
+		}
+	}
+	if user.Name != nil {
+		changes.givenName, changes.familyName = &user.Name.GivenName, &user.Name.FamilyName
+	}
+	if user.Password != "" {
+		changes.password = &user.Password
+	}
+	return changes
+}
+
+// applyUserChanges applies the changes of a replace or PATCH request to a user.
+// It aborts the request with a SCIM error and returns false if they cannot be
+// applied.
+func applyUserChanges(ctx context.Context, c *gin.Context, clients *mongo.Collection, rdb *redis.Client, validate *validator.Validate, credential *ScimCredential, client *Client, changes *scimUserChanges) bool {
+	set := bson.M{}
+	if changes.email != nil && normaliseEmail(*changes.email) != client.Email {
+		if err := validate.Var(*changes.email, "required,email"); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", "userName must be an email address")
+			return false
+		}
+		err := changeClientEmail(c.Request.Context(), clients, client, *changes.email, false)
+		if err == errEmailTaken {
+			scimError(c, http.StatusConflict, "uniqueness", "A user associated with the email address is already registered")
+			return false
+		}
+		if err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to update user")
+			return false
+		}
+	}
+	if changes.givenName != nil {
+		set["firstName"] = *changes.givenName
+	}
+	if changes.familyName != nil {
+		set["lastName"] = *changes.familyName
+	}
+	if changes.externalId != nil {
+		set["externalId"] = *changes.externalId
+	}
+
+	if changes.password != nil {
+		settings, err := getTenantSettings(ctx, clients, client.TenantId)
+		if err == nil {
+			err = settings.checkPassword(*changes.password)
+		}
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+			return false
+		}
+		if err := setPassword(c.Request.Context(), clients, client, *changes.password); err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to set password")
+			return false
+		}
+	}
+
+	if len(set) > 0 {
+		dbCtx, cancel := dbContext(ctx)
+		defer cancel()
+		if _, err := clients.UpdateOne(dbCtx, bson.M{"_id": client.Id}, bson.M{"$set": set, "$inc": bson.M{"version": 1}}); err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to update user")
+			return false
+		}
+	}
+
+	// Deactivating a user suspends it
+	if changes.active != nil && *changes.active == client.Suspended {
+		var err error
+		if *changes.active {
+			err = reactivateClient(c.Request.Context(), clients, rdb, client)
+			recordAudit(clients, c, AuditEvent{Action: "reactivate", ActorId: scimActor(credential), TargetId: client.Id.Hex(), Outcome: auditSuccess})
+		} else {
+			err = suspendClient(c.Request.Context(), clients, rdb, client, credential.Id)
+			recordAudit(clients, c, AuditEvent{Action: "suspend", ActorId: scimActor(credential), TargetId: client.Id.Hex(), Outcome: auditSuccess})
+		}
+		if err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to change the status of the user")
+			return false
+		}
+	}
+	return true
+}
+
+// makeCreateScimCredentialHandler creates a SCIM credential provisioning the
+// tenant of the admin. The bearer token is only returned once.
+func makeCreateScimCredentialHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form ScimCredentialForm
+
+		admin, ok := authoriseTenantRequest(c, clients, permScimManage)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		secret, err := randomHex(32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to generate SCIM credential"})
+			return
+		}
+		credential := &ScimCredential{
+			Id:         primitive.NewObjectID(),
+			TenantId:   admin.TenantId,
+			Name:       form.Name,
+			SecretHash: hashAPIKey(secret),
+			CreatedBy:  admin.Id,
+			CreatedAt:  time.Now(),
+		}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := getScimCredentialCollection(clients).InsertOne(dbCtx, credential); err != nil {
+			abortWithStorageError(c, err, "Unable to create SCIM credential")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "create-scim-credential", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: credential.Id.Hex()})
+		c.JSON(http.StatusCreated, gin.H{"credential": credential, "token": credential.Id.Hex() + "." + secret})
+	}
+}
+
+// makeListScimCredentialsHandler lists the SCIM credentials of the tenant of the
+// admin
+func makeListScimCredentialsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseTenantRequest(c, clients, permScimManage)
+		if !ok {
+			return
+		}
+
+		credentials := []ScimCredential{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getScimCredentialCollection(clients).Find(dbCtx, tenantFilter(admin.TenantId))
+		if err == nil {
+			err = cursor.All(dbCtx, &credentials)
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list SCIM credentials")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"credentials": credentials})
+	}
+}
+
+// makeDeleteScimCredentialHandler revokes a SCIM credential of the tenant of
+// the admin
+func makeDeleteScimCredentialHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := authoriseTenantRequest(c, clients, permScimManage)
+		if !ok {
+			return
+		}
+
+		filter := tenantFilter(admin.TenantId)
+		filter["_id"], _ = primitive.ObjectIDFromHex(c.Param("id"))
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := getScimCredentialCollection(clients).DeleteOne(dbCtx, filter)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete SCIM credential")
+			return
+		}
+		if result.DeletedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "SCIM credential not found"})
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "delete-scim-credential", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: c.Param("id")})
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully deleted SCIM credential"})
+	}
+}
+
+// makeScimServiceProviderConfigHandler describes the supported SCIM features
+func makeScimServiceProviderConfigHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scimJSON(c, http.StatusOK, gin.H{
+			"schemas":        []string{scimConfigSchema},
+			"patch":          gin.H{"supported": true},
+			"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         gin.H{"supported": true, "maxResults": scimMaxResults},
+			"changePassword": gin.H{"supported": true},
+			"sort":           gin.H{"supported": false},
+			"etag":           gin.H{"supported": false},
+			"authenticationSchemes": []gin.H{{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer token",
+				"description": "SCIM credential created through /scim-credentials",
+			}},
+		})
+	}
+}
+
+// makeScimListUsersHandler lists the users of the tenant matching the filter
+func makeScimListUsersHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		users := []Client{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := clients.Find(dbCtx, scimUsersFilter(credential.TenantId))
+		if err == nil {
+			err = cursor.All(dbCtx, &users)
+		}
+		if err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to list users")
+			return
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Id.Hex() < users[j].Id.Hex() })
+
+		resources := []interface{}{}
+		for i := range users {
+			resources = append(resources, scimUserResource(&users[i]))
+		}
+		response, err := scimListResponse(c, resources)
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		scimJSON(c, http.StatusOK, response)
+	}
+}
+
+// makeScimGetUserHandler returns a user of the tenant
+func makeScimGetUserHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		user, err := getScimUser(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		if err != nil {
+			scimError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+		scimJSON(c, http.StatusOK, scimUserResource(user))
+	}
+}
+
+// makeScimCreateUserHandler provisions a user in the tenant with the default
+// groups of the tenant. The user signs in with the given password, if any, or
+// through an identity provider or a login link.
+func makeScimCreateUserHandler(clients *mongo.Collection, rdb *redis.Client, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource ScimUser
+
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid JSON payload")
+			return
+		}
+
+		changes := userChangesFromResource(&resource)
+		if err := validate.Var(*changes.email, "required,email"); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", "userName must be an email address")
+			return
+		}
+		settings, err := getTenantSettings(c.Request.Context(), clients, credential.TenantId)
+		if err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to get tenant settings")
+			return
+		}
+		if resource.Password != "" {
+			if err := settings.checkPassword(resource.Password); err != nil {
+				scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+				return
+			}
+		}
+
+		groups := append([]string{}, settings.DefaultGroups...)
+		user, err := createNewUserClient(c.Request.Context(), clients, credential.TenantId, *changes.email, resource.Password, "", "", groups, nil, nil)
+		if err == errEmailTaken {
+			scimError(c, http.StatusConflict, "uniqueness", "A user associated with the email address is already registered")
+			return
+		}
+		if err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to create user")
+			return
+		}
+
+		// The remaining attributes are applied as a replace
+		changes.email, changes.password = nil, nil
+		if !applyUserChanges(c.Request.Context(), c, clients, rdb, validate, credential, user, changes) {
+			return
+		}
+		user, _ = getScimUser(c.Request.Context(), clients, credential.TenantId, user.Id.Hex())
+
+		recordAudit(clients, c, AuditEvent{Action: "register-user", ActorId: scimActor(credential), TargetId: user.Id.Hex(), Outcome: auditSuccess})
+		dispatchWebhookEvent(clients, webhookClientRegistered, gin.H{"clientId": user.Id.Hex(), "tenantId": user.TenantId, "email": user.Email, "groups": user.Groups})
+		c.Header("Location", "/scim/v2/Users/"+user.Id.Hex())
+		scimJSON(c, http.StatusCreated, scimUserResource(user))
+	}
+}
+
+// makeScimReplaceUserHandler replaces the attributes of a user
+func makeScimReplaceUserHandler(clients *mongo.Collection, rdb *redis.Client, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource ScimUser
+
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		user, err := getScimUser(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		if err != nil {
+			scimError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid JSON payload")
+			return
+		}
+
+		if !applyUserChanges(c.Request.Context(), c, clients, rdb, validate, credential, user, userChangesFromResource(&resource)) {
+			return
+		}
+
+		user, _ = getScimUser(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		scimJSON(c, http.StatusOK, scimUserResource(user))
+	}
+}
+
+// makeScimPatchUserHandler applies the operations of a PATCH request to a user
+func makeScimPatchUserHandler(clients *mongo.Collection, rdb *redis.Client, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var patch ScimPatch
+
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		user, err := getScimUser(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		if err != nil {
+			scimError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid JSON payload")
+			return
+		}
+
+		changes, err := userChangesFromPatch(&patch)
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+			return
+		}
+
+		if !applyUserChanges(c.Request.Context(), c, clients, rdb, validate, credential, user, changes) {
+			return
+		}
+
+		user, _ = getScimUser(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		scimJSON(c, http.StatusOK, scimUserResource(user))
+	}
+}
+
+// makeScimDeleteUserHandler deprovisions a user through the deletion cascade
+func makeScimDeleteUserHandler(clients *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		user, err := getScimUser(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		if err != nil {
+			scimError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+
+		blacklistClient(c.Request.Context(), rdb, user)
+		_, err = startDeletionJob(c.Request.Context(), clients, rdb, user, credential.Id, scimDeprovisionReason)
+		if err != nil && err != errDeletionInProgress {
+			scimError(c, http.StatusInternalServerError, "", "Unable to delete user")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "delete-client", ActorId: scimActor(credential), TargetId: user.Id.Hex(), Outcome: auditSuccess, Reason: scimDeprovisionReason})
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// makeScimListGroupsHandler lists the groups of the tenant matching the filter
+func makeScimListGroupsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		groups := []Group{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getGroupCollection(clients).Find(dbCtx, tenantFilter(credential.TenantId))
+		if err == nil {
+			err = cursor.All(dbCtx, &groups)
+		}
+		if err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to list groups")
+			return
+		}
+
+		resources := []interface{}{}
+		for i := range groups {
+			if groups[i].Name == "" {
+				groups[i].Name = groups[i].Key
+			}
+			members, err := getGroupMembers(c.Request.Context(), clients, credential.TenantId, groups[i].Name)
+			if err != nil {
+				scimError(c, http.StatusInternalServerError, "", "Unable to list groups")
+				return
+			}
+			resources = append(resources, scimGroupResource(&groups[i], members))
+		}
+		sort.Slice(resources, func(i, j int) bool {
+			return resources[i].(ScimGroup).Id < resources[j].(ScimGroup).Id
+		})
+
+		response, err := scimListResponse(c, resources)
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		scimJSON(c, http.StatusOK, response)
+	}
+}
+
+// respondScimGroup writes the SCIM representation of a group of the tenant
+func respondScimGroup(c *gin.Context, clients *mongo.Collection, credential *ScimCredential, name string, status int) {
+	group, err := getScimGroup(c.Request.Context(), clients, credential.TenantId, name)
+	if err != nil {
+		scimError(c, http.StatusNotFound, "", "Group not found")
+		return
+	}
+	members, err := getGroupMembers(c.Request.Context(), clients, credential.TenantId, group.Name)
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", "Unable to get group members")
+		return
+	}
+	scimJSON(c, status, scimGroupResource(group, members))
+}
+
+// makeScimGetGroupHandler returns a group of the tenant
+func makeScimGetGroupHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+		respondScimGroup(c, clients, credential, c.Param("id"), http.StatusOK)
+	}
+}
+
+// makeScimCreateGroupHandler defines a group in the tenant, without any role,
+// and adds the members to it
+func makeScimCreateGroupHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource ScimGroup
+
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&resource); err != nil || resource.DisplayName == "" {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid JSON payload")
+			return
+		}
+
+		group := &Group{
+			Key:      groupKey(credential.TenantId, resource.DisplayName),
+			Name:     resource.DisplayName,
+			TenantId: credential.TenantId,
+			Roles:    []string{},
+		}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		_, err := getGroupCollection(clients).InsertOne(dbCtx, group)
+		if mongo.IsDuplicateKeyError(err) {
+			scimError(c, http.StatusConflict, "uniqueness", "A group with the name already exists")
+			return
+		}
+		if err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to create group")
+			return
+		}
+
+		ids := []string{}
+		for _, member := range resource.Members {
+			ids = append(ids, member.Value)
+		}
+		if err := setGroupMembership(c.Request.Context(), clients, credential.TenantId, group.Name, ids, true); err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to add group members")
+			return
+		}
+
+		c.Header("Location", "/scim/v2/Groups/"+group.Name)
+		respondScimGroup(c, clients, credential, group.Name, http.StatusCreated)
+	}
+}
+
+// makeScimReplaceGroupHandler replaces the members of a group. Groups cannot be
+// renamed.
+func makeScimReplaceGroupHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource ScimGroup
+
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		group, err := getScimGroup(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		if err != nil {
+			scimError(c, http.StatusNotFound, "", "Group not found")
+			return
+		}
+
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid JSON payload")
+			return
+		}
+		if resource.DisplayName != "" && resource.DisplayName != group.Name {
+			scimError(c, http.StatusBadRequest, "mutability", "Groups cannot be renamed")
+			return
+		}
+
+		ids := []string{}
+		for _, member := range resource.Members {
+			ids = append(ids, member.Value)
+		}
+		if err := replaceGroupMembers(c.Request.Context(), clients, credential.TenantId, group.Name, ids); err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to replace group members")
+			return
+		}
+
+		respondScimGroup(c, clients, credential, group.Name, http.StatusOK)
+	}
+}
+
+// makeScimPatchGroupHandler applies the operations of a PATCH request to the
+// members of a group
+func makeScimPatchGroupHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var patch ScimPatch
+
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		group, err := getScimGroup(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		if err != nil {
+			scimError(c, http.StatusNotFound, "", "Group not found")
+			return
+		}
+
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid JSON payload")
+			return
+		}
+
+		for _, operation := range patch.Operations {
+			if err := applyGroupOperation(c.Request.Context(), clients, credential.TenantId, group, &operation); err != nil {
+				scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+				return
+			}
+		}
+
+		respondScimGroup(c, clients, credential, group.Name, http.StatusOK)
+	}
+}
+
+// applyGroupOperation applies an operation of a PATCH request to the members of
+// a group, e.g. adding members, removing `members[value eq "<id>"]` or
+// replacing every member
+func applyGroupOperation(ctx context.Context, clients *mongo.Collection, tenantId string, group *Group, operation *ScimPatchOperation) error {
+	var members []ScimMultiValue
+	var attributes struct {
+		DisplayName string           `json:"displayName"`
+		Members     []ScimMultiValue `json:"members"`
+	}
+
+	path := strings.ToLower(operation.Path)
+	op := strings.ToLower(operation.Op)
+	switch {
+	case path == "" && (op == "add" || op == "replace"):
+		if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+			return errScimInvalidValue
+		}
+		if attributes.DisplayName != "" && attributes.DisplayName != group.Name {
+			return errors.New("groups cannot be renamed")
+		}
+		members = attributes.Members
+		path = "members"
+	case path == "displayname":
+		if name, err := scimString(operation.Value); err != nil || name != group.Name {
+			return errors.New("groups cannot be renamed")
+		}
+		return nil
+	case path == "members" && len(operation.Value) > 0:
+		if err := json.Unmarshal(operation.Value, &members); err != nil {
+			return errScimInvalidValue
+		}
+	case strings.HasPrefix(path, "members[") && op == "remove":
+		// Remove the members matching the filter of the value path
+		filter, err := parseScimFilter(strings.TrimSuffix(strings.TrimPrefix(operation.Path[len("members"):], "["), "]"))
+		if err != nil {
+			return err
+		}
+		current, err := getGroupMembers(ctx, clients, tenantId, group.Name)
+		if err != nil {
+			return err
+		}
+		removed := []string{}
+		for _, member := range scimGroupResource(group, current).Members {
+			if filter.matches(map[string]interface{}{"value": member.Value, "display": member.Display}) {
+				removed = append(removed, member.Value)
+			}
+		}
+		return setGroupMembership(ctx, clients, tenantId, group.Name, removed, false)
+	case path != "members":
+		return errors.New("unsupported attribute " + operation.Path)
+	}
+
+	ids := []string{}
+	for _, member := range members {
+		ids = append(ids, member.Value)
+	}
+	switch op {
+	case "add":
+		return setGroupMembership(ctx, clients, tenantId, group.Name, ids, true)
+	case "replace":
+		return replaceGroupMembers(ctx, clients, tenantId, group.Name, ids)
+	case "remove":
+		// Removing members without a value removes every member
+		if len(operation.Value) == 0 {
+			return replaceGroupMembers(ctx, clients, tenantId, group.Name, nil)
+		}
+		return setGroupMembership(ctx, clients, tenantId, group.Name, ids, false)
+	}
+	return errors.New("unsupported operation " + operation.Op)
+}
+
+// makeScimDeleteGroupHandler deletes a group of the tenant and removes its
+// members from it
+func makeScimDeleteGroupHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential, ok := authenticateScim(c, clients)
+		if !ok {
+			return
+		}
+
+		group, err := getScimGroup(c.Request.Context(), clients, credential.TenantId, c.Param("id"))
+		if err != nil {
+			scimError(c, http.StatusNotFound, "", "Group not found")
+			return
+		}
+
+		if err := replaceGroupMembers(c.Request.Context(), clients, credential.TenantId, group.Name, nil); err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to remove group members")
+			return
+		}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := getGroupCollection(clients).DeleteOne(dbCtx, bson.M{"_id": group.Key}); err != nil {
+			scimError(c, http.StatusInternalServerError, "", "Unable to delete group")
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
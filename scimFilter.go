@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SCIM filters (RFC 7644 section 3.4.2.2) select the resources of a list query,
+// e.g. `userName eq "john@example.com"` or
+// `emails[type eq "work" and value co "@example.com"] or not (active pr)`.
+// Filters are parsed into a tree evaluated against the JSON representation of
+// the resources. Attribute names and string comparisons are case insensitive,
+// except for the id attribute.
+
+// scimFilter selects the resources that match it
+type scimFilter interface {
+	matches(resource map[string]interface{}) bool
+}
+
+// scimComparison compares the values of an attribute with a value, or checks
+// the attribute is present ("pr")
+type scimComparison struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+// scimLogical combines two filters with "and" or "or"
+type scimLogical struct {
+	op          string
+	left, right scimFilter
+}
+
+// scimNot negates a filter
+type scimNot struct {
+	filter scimFilter
+}
+
+// scimValuePath matches the resources with an element of a multi-valued
+// attribute matching the filter, e.g. `emails[type eq "work"]`
+type scimValuePath struct {
+	attribute string
+	filter    scimFilter
+}
+
+// scimToken is a token of a filter: a parenthesis or bracket, a quoted string or
+// a word (attribute path, operator or literal)
+type scimToken struct {
+	text   string
+	quoted bool
+}
+
+// scimCoreSchemaPrefixes are stripped from fully qualified attribute paths
+var scimCoreSchemaPrefixes = []string{scimUserSchema + ":", scimGroupSchema + ":"}
+
+// tokenizeScimFilter splits a filter into its tokens
+func tokenizeScimFilter(filter string) ([]scimToken, error) {
+	tokens := []scimToken{}
+	for i := 0; i < len(filter); {
+		switch ch := filter[i]; {
+		case ch == ' ':
+			i++
+		case ch == '(' || ch == ')' || ch == '[' || ch == ']':
+			tokens = append(tokens, scimToken{text: string(ch)})
+			i++
+		case ch == '"':
+			end := i + 1
+			for end < len(filter) && filter[end] != '"' {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, errors.New("unterminated string")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(filter[i:end+1]), &value); err != nil {
+				return nil, errors.New("invalid string " + filter[i:end+1])
+			}
+			tokens = append(tokens, scimToken{text: value, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && !strings.ContainsRune(" ()[]\"", rune(filter[end])) {
+				end++
+			}
+			tokens = append(tokens, scimToken{text: filter[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// scimFilterParser is a recursive descent parser of SCIM filters. "not" binds
+// tighter than "and", which binds tighter than "or".
+type scimFilterParser struct {
+	tokens []scimToken
+	pos    int
+}
+
+// parseScimFilter parses a SCIM filter
+func parseScimFilter(filter string) (scimFilter, error) {
+	tokens, err := tokenizeScimFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	result, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("unexpected " + p.tokens[p.pos].text)
+	}
+	return result, nil
+}
+
+// peek returns the next token as a lowercase keyword, or an empty string for
+// quoted strings and the end of the filter
+func (p *scimFilterParser) peek() string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return ""
+	}
+	return strings.ToLower(p.tokens[p.pos].text)
+}
+
+// expect consumes the next token if it is the keyword
+func (p *scimFilterParser) expect(keyword string) error {
+	if p.peek() != keyword {
+		return errors.New("expected " + keyword)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogical{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogical{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseUnary() (scimFilter, error) {
+	switch p.peek() {
+	case "not":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return &scimNot{filter: filter}, p.expect(")")
+	case "(":
+		p.pos++
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return filter, p.expect(")")
+	case "", ")", "[", "]":
+		return nil, errors.New("expected an attribute path")
+	}
+	return p.parseAttributeExpression()
+}
+
+func (p *scimFilterParser) parseAttributeExpression() (scimFilter, error) {
+	path := scimAttributePath(p.tokens[p.pos].text)
+	p.pos++
+
+	// A value path filters the elements of a multi-valued attribute
+	if p.peek() == "[" {
+		p.pos++
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &scimValuePath{attribute: path[0], filter: filter}, nil
+	}
+
+	op := p.peek()
+	switch op {
+	case "pr":
+		p.pos++
+		return &scimComparison{path: path, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+		p.pos++
+	default:
+		return nil, errors.New("expected an operator after " + strings.Join(path, "."))
+	}
+
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("expected a value after " + op)
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	if token.quoted {
+		return &scimComparison{path: path, op: op, value: token.text}, nil
+	}
+	switch strings.ToLower(token.text) {
+	case "true":
+		return &scimComparison{path: path, op: op, value: true}, nil
+	case "false":
+		return &scimComparison{path: path, op: op, value: false}, nil
+	case "null":
+		return &scimComparison{path: path, op: op, value: nil}, nil
+	}
+	number, err := strconv.ParseFloat(token.text, 64)
+	if err != nil {
+		return nil, errors.New("invalid value " + token.text)
+	}
+	return &scimComparison{path: path, op: op, value: number}, nil
+}
+
+// scimAttributePath splits an attribute path into its attribute and
+// sub-attribute, stripping the schema of fully qualified paths
+func scimAttributePath(path string) []string {
+	for _, prefix := range scimCoreSchemaPrefixes {
+		if len(path) > len(prefix) && strings.EqualFold(path[:len(prefix)], prefix) {
+			path = path[len(prefix):]
+		}
+	}
+	return strings.Split(path, ".")
+}
+
+// scimAttribute returns an attribute of a resource by its case insensitive name
+func scimAttribute(resource map[string]interface{}, name string) (interface{}, bool) {
+	for key, value := range resource {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// scimValues returns the values of an attribute path of a resource, flattening
+// multi-valued attributes
+func scimValues(resource map[string]interface{}, path []string) []interface{} {
+	value, ok := scimAttribute(resource, path[0])
+	if !ok || value == nil {
+		return nil
+	}
+	elements, multiValued := value.([]interface{})
+	if !multiValued {
+		elements = []interface{}{value}
+	}
+
+	if len(path) == 1 {
+		return elements
+	}
+	values := []interface{}{}
+	for _, element := range elements {
+		if object, ok := element.(map[string]interface{}); ok {
+			values = append(values, scimValues(object, path[1:])...)
+		}
+	}
+	return values
+}
+
+func (f *scimComparison) matches(resource map[string]interface{}) bool {
+	values := scimValues(resource, f.path)
+	if f.op == "pr" {
+		for _, value := range values {
+			if s, ok := value.(string); !ok || s != "" {
+				return true
+			}
+		}
+		return false
+	}
+	if f.op == "ne" {
+		return !(&scimComparison{path: f.path, op: "eq", value: f.value}).matches(resource)
+	}
+	if f.value == nil {
+		return f.op == "eq" && len(values) == 0
+	}
+
+	caseExact := strings.EqualFold(f.path[0], "id")
+	for _, value := range values {
+		if compareScimValue(value, f.op, f.value, caseExact) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareScimValue compares an attribute value with the value of a filter
+func compareScimValue(value interface{}, op string, expected interface{}, caseExact bool) bool {
+	switch expected := expected.(type) {
+	case bool:
+		actual, ok := value.(bool)
+		return ok && op == "eq" && actual == expected
+	case float64:
+		actual, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return actual == expected
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+		return false
+	case string:
+		actual, ok := value.(string)
+		if !ok {
+			return false
+		}
+		if !caseExact {
+			actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+		}
+		switch op {
+		case "eq":
+			return actual == expected
+		case "co":
+			return strings.Contains(actual, expected)
+		case "sw":
+			return strings.HasPrefix(actual, expected)
+		case "ew":
+			return strings.HasSuffix(actual, expected)
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	}
+	return false
+}
+
+func (f *scimLogical) matches(resource map[string]interface{}) bool {
+	if f.op == "and" {
+		return f.left.matches(resource) && f.right.matches(resource)
+	}
+	return f.left.matches(resource) || f.right.matches(resource)
+}
+
+func (f *scimNot) matches(resource map[string]interface{}) bool {
+	return !f.filter.matches(resource)
+}
+
+func (f *scimValuePath) matches(resource map[string]interface{}) bool {
+	for _, element := range scimValues(resource, []string{f.attribute}) {
+		if object, ok := element.(map[string]interface{}); ok && f.filter.matches(object) {
+			return true
+		}
+	}
+	return false
+}
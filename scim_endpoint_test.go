@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createScimCredential creates a SCIM credential as an admin and returns its
+// bearer token
+func createScimCredential(t *testing.T) string {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/scim-credentials", strings.NewReader(`{"name": "HR system"}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response.Token
+}
+
+// sendScim sends a SCIM request authenticated with the bearer token
+func sendScim(method string, path string, payload string, token string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", scimContentType)
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestScimProvisionUser(t *testing.T) {
+	token := createScimCredential(t)
+	email := genRandomEmail()
+
+	payload := `{"schemas": ["` + scimUserSchema + `"], "userName": "` + email + `", "externalId": "hr-42", "name": {"givenName": "John", "familyName": "Smith"}}`
+	recorder := sendScim("POST", "/scim/v2/Users", payload, token)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var user ScimUser
+	json.Unmarshal(recorder.Body.Bytes(), &user)
+	assert.Equal(t, email, user.UserName)
+	assert.True(t, *user.Active)
+
+	// Provisioning the same user again is a conflict
+	recorder = sendScim("POST", "/scim/v2/Users", payload, token)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	// The user can be found by filter
+	recorder = sendScim("GET", `/scim/v2/Users?filter=userName+eq+"`+strings.ToUpper(email)+`"`, "", token)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var list struct {
+		TotalResults int        `json:"totalResults"`
+		Resources    []ScimUser `json:"Resources"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &list)
+	assert.Equal(t, 1, list.TotalResults)
+	assert.Equal(t, "hr-42", list.Resources[0].ExternalId)
+
+	// Deactivating the user suspends it
+	patch := `{"schemas": ["` + scimPatchSchema + `"], "Operations": [{"op": "Replace", "path": "active", "value": false}]}`
+	recorder = sendScim("PATCH", "/scim/v2/Users/"+user.Id, patch, token)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	client, _ := getClientByEmail(context.Background(), clients, "", email)
+	assert.True(t, client.Suspended)
+
+	// Deleting the user starts the deletion cascade
+	recorder = sendScim("DELETE", "/scim/v2/Users/"+user.Id, "", token)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	recorder = sendScim("GET", "/scim/v2/Users/"+user.Id, "", token)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestScimGroupMembers(t *testing.T) {
+	token := createScimCredential(t)
+	memberId, _ := insertTestClient(t, []string{})
+	name := "scim-" + memberId.Hex()
+
+	payload := `{"schemas": ["` + scimGroupSchema + `"], "displayName": "` + name + `", "members": [{"value": "` + memberId.Hex() + `"}]}`
+	recorder := sendScim("POST", "/scim/v2/Groups", payload, token)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var group ScimGroup
+	json.Unmarshal(recorder.Body.Bytes(), &group)
+	assert.Len(t, group.Members, 1)
+
+	member, _ := getClientByIdOrEmail(context.Background(), clients, "", memberId.Hex(), "")
+	assert.Contains(t, member.Groups, name)
+
+	// Members are removed with a value path filter
+	patch := `{"schemas": ["` + scimPatchSchema + `"], "Operations": [{"op": "remove", "path": "members[value eq \"` + memberId.Hex() + `\"]"}]}`
+	recorder = sendScim("PATCH", "/scim/v2/Groups/"+name, patch, token)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &group)
+	assert.Empty(t, group.Members)
+
+	// Groups cannot be renamed
+	patch = `{"schemas": ["` + scimPatchSchema + `"], "Operations": [{"op": "replace", "path": "displayName", "value": "renamed"}]}`
+	recorder = sendScim("PATCH", "/scim/v2/Groups/"+name, patch, token)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestScimInvalidCredential(t *testing.T) {
+	recorder := sendScim("GET", "/scim/v2/Users", "", "invalid.token")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Services, devices and bots (see kinds.go), all referred to as services here,
+// are registered by an authenticated user who becomes their owner. A
+// service can also be owned by a team, a group whose members can all manage the
+// service. Owners can list, rotate the token of and delete their services;
+// admins can do so for any service with the keys:rotate and clients:delete
+// permissions.
+
+// Owner removal policies (OWNER_REMOVAL_POLICY) defining what happens to the
+// services of an owner that is suspended or deleted. Services also owned by a
+// team are not affected other than losing their owner when it is deleted.
+const (
+	// The services are suspended along with their owner (default)
+	ownerRemovalSuspend = "suspend"
+	// The services are deleted along with their owner
+	ownerRemovalDelete = "delete"
+	// The services are kept, without an owner once it is deleted
+	ownerRemovalOrphan = "orphan"
+)
+
+// ServiceSummary describes a service as listed to its owners
+type ServiceSummary struct {
+	Id        primitive.ObjectID  `json:"id"`
+	Kind      string              `json:"kind"`
+	Email     string              `json:"email"`
+	Name      string              `json:"name"`
+	Groups    []string            `json:"groups"`
+	OwnerId   *primitive.ObjectID `json:"ownerId,omitempty"`
+	OwnerTeam string              `json:"ownerTeam,omitempty"`
+	Suspended bool                `json:"suspended"`
+}
+
+// ownsService checks if a client is the owner of a service or a member of the
+// team owning it. Teams are groups of a tenant so only clients of the tenant of
+// the service can own it.
+func ownsService(client *Client, service *Client) bool {
+	if service.TenantId != client.TenantId {
+		return false
+	}
+	if service.OwnerId != nil && *service.OwnerId == client.Id {
+		return true
+	}
+	return service.OwnerTeam != "" && inGroup(client, service.OwnerTeam)
+}
+
+// getOwnedServices returns the services owned by a client or its teams
+func getOwnedServices(ctx context.Context, clients *mongo.Collection, client *Client) ([]Client, error) {
+	filter := tenantFilter(client.TenantId)
+	filter["kind"] = bson.M{"$in": machineKinds}
+	filter["$or"] = []bson.M{
+		{"ownerId": client.Id},
+		{"ownerTeam": bson.M{"$in": client.Groups}},
+	}
+	services := []Client{}
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := clients.Find(dbCtx, filter)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &services)
+	return services, err
+}
+
+// rotateServiceToken increments the token version of a service, invalidating
+// every token previously issued to it, and returns a new token
+func rotateServiceToken(ctx context.Context, clients *mongo.Collection, service *Client) (string, error) {
+	rotated := &Client{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := clients.FindOneAndUpdate(dbCtx,
+		bson.M{"_id": service.Id},
+		bson.M{"$inc": bson.M{"tokenVersion": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(rotated)
+	if err != nil {
+		return "", err
+	}
+	return generateAPIClientToken(ctx, clients, rotated)
+}
+
+// applyOwnerRemovalPolicy applies the configured owner removal policy to the
+// services of an owner being suspended or deleted
+func applyOwnerRemovalPolicy(ctx context.Context, clients *mongo.Collection, rdb *redis.Client, ownerId primitive.ObjectID, removedBy primitive.ObjectID, deleted bool) {
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := clients.Find(dbCtx, bson.M{"kind": bson.M{"$in": machineKinds}, "ownerId": ownerId})
+	if err != nil {
+		log.Println("Unable to query owned services: ", err)
+		return
+	}
+	var services []Client
+	if err := cursor.All(dbCtx, &services); err != nil {
+		log.Println("Unable to decode owned services: ", err)
+		return
+	}
+
+	for _, service := range services {
+		var err error
+		switch {
+		case service.OwnerTeam != "" || ownerRemovalPolicy == ownerRemovalOrphan:
+			if deleted {
+				updateCtx, cancelUpdate := dbContext(ctx)
+				_, err = clients.UpdateOne(updateCtx, bson.M{"_id": service.Id}, bson.M{"$unset": bson.M{"ownerId": ""}, "$inc": bson.M{"version": 1}})
+				cancelUpdate()
+			}
+		case ownerRemovalPolicy == ownerRemovalDelete:
+			blacklistClient(ctx, rdb, &service)
+			_, err = startDeletionJob(ctx, clients, rdb, &service, removedBy, "owner removed")
+			if err == errDeletionInProgress {
+				err = nil
+			}
+		default:
+			err = suspendClient(ctx, clients, rdb, &service, removedBy)
+		}
+		if err != nil {
+			log.Println("Unable to apply owner removal policy to service "+service.Id.Hex()+": ", err)
+		}
+	}
+}
+
+// authoriseServiceManagement processes the token cookie of the request and
+// checks the client owns the service of the ID parameter or has been granted the
+// permission. It aborts the request and returns false if not.
+func authoriseServiceManagement(c *gin.Context, clients *mongo.Collection, permission string) (*Client, *Client, bool) {
+	token, _ := c.Cookie("token")
+	code, claim := processClaim(token)
+	if code != http.StatusOK {
+		c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+		return nil, nil, false
+	}
+
+	status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+	if status != http.StatusOK {
+		c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+		return nil, nil, false
+	}
+
+	// Services of other tenants are not found
+	service := &Client{}
+	objID, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	filter := tenantFilter(client.TenantId)
+	filter["_id"] = objID
+	filter["kind"] = bson.M{"$in": machineKinds}
+	dbCtx, cancel := dbContext(c.Request.Context())
+	defer cancel()
+	err := clients.FindOne(dbCtx, filter).Decode(service)
+	if err == mongo.ErrNoDocuments {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Service not found"})
+		return nil, nil, false
+	}
+	if err != nil {
+		abortWithStorageError(c, err, "Unable to get service")
+		return nil, nil, false
+	}
+
+	if ownsService(client, service) {
+		return client, service, true
+	}
+	authorised, err := clientAuthorised(clients, c, client, permission, service)
+	if err != nil {
+		abortWithStorageError(c, err, "Unable to get service")
+		return nil, nil, false
+	}
+	if !authorised {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+		return nil, nil, false
+	}
+	return client, service, true
+}
+
+// makeListServicesHandler lists the services owned by the authenticated client
+// or its teams
+func makeListServicesHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		status, client := authAndAuthorised(c.Request.Context(), clients, claim)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "Unable to authenticate and authorise user"})
+			return
+		}
+
+		services, err := getOwnedServices(c.Request.Context(), clients, client)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list services")
+			return
+		}
+
+		summaries := []ServiceSummary{}
+		for _, service := range services {
+			summaries = append(summaries, ServiceSummary{
+				Id:        service.Id,
+				Kind:      clientKind(&service),
+				Email:     service.Email,
+				Name:      service.Name,
+				Groups:    service.Groups,
+				OwnerId:   service.OwnerId,
+				OwnerTeam: service.OwnerTeam,
+				Suspended: service.Suspended,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"services": summaries})
+	}
+}
+
+// makeRotateServiceHandler issues a new token to a service and invalidates the
+// previous ones
+func makeRotateServiceHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, service, ok := authoriseServiceManagement(c, clients, permKeysRotate)
+		if !ok {
+			return
+		}
+
+		apiToken, err := rotateServiceToken(c.Request.Context(), clients, service)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to rotate API token")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "rotate-service-token", ActorId: client.Id.Hex(), TargetId: service.Id.Hex(), Outcome: auditSuccess})
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully rotated API token", "apiToken": apiToken})
+	}
+}
+
+// makeDeleteServiceHandler deletes a service through the deletion cascade
+func makeDeleteServiceHandler(clients *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, service, ok := authoriseServiceManagement(c, clients, permClientsDelete)
+		if !ok {
+			return
+		}
+
+		blacklistClient(c.Request.Context(), rdb, service)
+
+		job, err := startDeletionJob(c.Request.Context(), clients, rdb, service, client.Id, "deleted by owner")
+		if err == errDeletionInProgress {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "Service deletion already in progress"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete service")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "delete-service", ActorId: client.Id.Hex(), TargetId: service.Id.Hex(), Outcome: auditSuccess})
+		c.JSON(http.StatusAccepted, gin.H{"message": "Service deletion requested", "jobId": job.Id.Hex()})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// registerTestService registers a service through the API on behalf of the
+// owner and returns its API token
+func registerTestService(ownerToken string, email string) string {
+	recorder := httptest.NewRecorder()
+	payload := `{"email": "` + email + `", "name": "Service A", "groups": []}`
+	req, _ := http.NewRequest("POST", "/register-service", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: ownerToken})
+	handler.ServeHTTP(recorder, req)
+
+	var registered struct {
+		ApiToken string `json:"apiToken"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &registered)
+	return registered.ApiToken
+}
+
+func TestUnauthenticatedServiceRegistration(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	payload := `{"email": "` + genRandomEmail() + `", "name": "Service A", "groups": []}`
+	req, _ := http.NewRequest("POST", "/register-service", strings.NewReader(payload))
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestOwnerRotatesServiceToken(t *testing.T) {
+	ownerId, ownerToken := insertTestClient(t, []string{})
+	email := genRandomEmail()
+	apiToken := registerTestService(ownerToken, email)
+
+	// The owner lists the service
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/services", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: ownerToken})
+	handler.ServeHTTP(recorder, req)
+
+	var listed struct {
+		Services []ServiceSummary `json:"services"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &listed)
+	assert.Len(t, listed.Services, 1)
+	assert.Equal(t, email, listed.Services[0].Email)
+	assert.Equal(t, ownerId, *listed.Services[0].OwnerId)
+
+	// Another user cannot rotate the service token
+	_, otherToken := insertTestClient(t, []string{})
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/services/"+listed.Services[0].Id.Hex()+"/rotate", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: otherToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// The owner can, after which the previous token is rejected
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/services/"+listed.Services[0].Id.Hex()+"/rotate", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: ownerToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	_, claim := processClaim(apiToken)
+	code, _ := authenticate(context.Background(), clients, claim)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestSuspendingOwnerSuspendsServices(t *testing.T) {
+	ownerId, ownerToken := insertTestClient(t, []string{})
+	email := genRandomEmail()
+	registerTestService(ownerToken, email)
+
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/suspend", strings.NewReader(`{"id": "`+ownerId.Hex()+`"}`))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// With the default policy the service is suspended with its owner
+	service, _ := getClientByEmail(context.Background(), clients, "", email)
+	assert.True(t, service.Suspended)
+	assert.Equal(t, service.Id.Hex(), rdb.Get(context.Background(), service.Id.Hex()).Val())
+
+	var records []SuspensionRecord
+	cursor, _ := getSuspensionHistoryCollection(clients).Find(context.Background(), bson.M{"clientId": service.Id})
+	cursor.All(context.Background(), &records)
+	assert.Len(t, records, 1)
+	assert.NotEqual(t, primitive.NilObjectID, records[0].SuspendedBy)
+}
+
+func TestServicesOfOtherTenantsCannotBeManaged(t *testing.T) {
+	// A service of the default tenant owned by the ops team
+	service, _ := createNewServiceClient(context.Background(), clients, "", genRandomEmail(), "Service A", []string{}, primitive.NilObjectID, "ops")
+
+	// An admin of another tenant who is also a member of a team called ops
+	tenantId := createTestTenant(t, `{}`)
+	email := genRandomEmail()
+	createNewUserClient(context.Background(), clients, tenantId, email, "somePassword", "John", "Smith", []string{"admin", "ops"}, nil, nil)
+	cookie := loginToTenant(tenantId, email)
+
+	recorder := sendWithCookie("POST", "/services/"+service.Id.Hex()+"/rotate", "", cookie)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = sendWithCookie("DELETE", "/services/"+service.Id.Hex(), "", cookie)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
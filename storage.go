@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Database and cache operations run in the context of the request they serve,
+// so that they are cancelled when the client disconnects, and each operation
+// is given its own deadline: DB_TIMEOUT_MS for the operations on a single
+// document, DB_BULK_TIMEOUT_MS for the queries and writes spanning many
+// documents, such as listings, purges and background scans, and
+// CACHE_TIMEOUT_MS for Redis. A context is never shared between operations so
+// that an operation is not left with what an earlier one did not use. An
+// operation timing out fails the request with 504 Gateway Timeout and an
+// unreachable database with 503 Service Unavailable, rather than the request
+// hanging for as long as the database stalls. Audit events, webhook deliveries
+// and started deletion jobs outlive the request that caused them: they are
+// bounded by their timeouts but not cancelled along with the request.
+
+// dbContext returns the context of a database operation, cancelled along with
+// its parent context or once DB_TIMEOUT_MS elapses
+func dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, dbOperationTimeout)
+}
+
+// dbBulkContext returns the context of a database operation spanning many
+// documents, including the iteration of its cursor, cancelled along with its
+// parent context or once DB_BULK_TIMEOUT_MS elapses
+func dbBulkContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, dbBulkOperationTimeout)
+}
+
+// cacheContext returns the context of a cache operation, cancelled along with
+// its parent context or once CACHE_TIMEOUT_MS elapses
+func cacheContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cacheOperationTimeout)
+}
+
+// storageErrorStatus returns the status of a request that failed on a storage
+// error: 504 if the operation timed out, 503 if the storage is unavailable or
+// the request was cancelled and 500 otherwise
+func storageErrorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case mongo.IsTimeout(err), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case mongo.IsNetworkError(err), errors.Is(err, context.Canceled), errors.As(err, &netErr):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// abortWithStorageError aborts a request that failed on a storage error with
+// its status (see storageErrorStatus)
+func abortWithStorageError(c *gin.Context, err error, message string) {
+	switch storageErrorStatus(err) {
+	case http.StatusGatewayTimeout:
+		c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"message": "The database did not respond in time"})
+	case http.StatusServiceUnavailable:
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "The database is unavailable"})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": message})
+	}
+}
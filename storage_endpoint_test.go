@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// stallingProxy forwards TCP connections to the database or cache and can stop
+// forwarding, simulating storage that stalls without dropping connections
+type stallingProxy struct {
+	listener net.Listener
+	target   string
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+// newStallingProxy starts a proxy forwarding to the target address
+func newStallingProxy(t *testing.T, target string) *stallingProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	proxy := &stallingProxy{listener: listener, target: target}
+	go proxy.serve()
+	return proxy
+}
+
+func (p *stallingProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go p.pipe(conn, upstream)
+		go p.pipe(upstream, conn)
+	}
+}
+
+// pipe copies from one connection to the other, holding the data back while
+// the proxy is stalled
+func (p *stallingProxy) pipe(from net.Conn, to net.Conn) {
+	defer from.Close()
+	defer to.Close()
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := from.Read(buffer)
+		for p.isStalled() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n > 0 {
+			if _, err := to.Write(buffer[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *stallingProxy) isStalled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stalled
+}
+
+func (p *stallingProxy) setStalled(stalled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stalled = stalled
+}
+
+func TestHandlersReturnPromptlyWhenDatabaseStalls(t *testing.T) {
+	proxy := newStallingProxy(t, dbHost+":"+dbPort)
+	defer proxy.listener.Close()
+
+	// A handler whose database is reached through the proxy
+	dbClient, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://"+dbUser+":"+dbPassword+"@"+proxy.listener.Addr().String()).
+		SetDirect(true))
+	assert.NoError(t, err)
+	defer dbClient.Disconnect(context.Background())
+	assert.NoError(t, dbClient.Ping(context.Background(), nil))
+	stalledClients := dbClient.Database(dbName).Collection("users")
+	stalledHandler := createHandler(stalledClients, rdb)
+
+	timeout, bulkTimeout := dbOperationTimeout, dbBulkOperationTimeout
+	dbOperationTimeout, dbBulkOperationTimeout = 200*time.Millisecond, 500*time.Millisecond
+	defer func() { dbOperationTimeout, dbBulkOperationTimeout = timeout, bulkTimeout }()
+
+	id, token := insertTestClient(t, []string{})
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	user, err := getClientByIdOrEmail(context.Background(), stalledClients, "", id.Hex(), "")
+	assert.NoError(t, err)
+	matched, err := passwordMatches(context.Background(), stalledClients, user, "somePassword")
+	assert.NoError(t, err)
+	assert.True(t, matched)
+	proxy.setStalled(true)
+	defer proxy.setStalled(false)
+
+	// Authenticated requests time out
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	stalledHandler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	start = time.Now()
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+genRandomEmail()+`", "password": "somePassword"}`))
+	stalledHandler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	start = time.Now()
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/audit", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	stalledHandler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// The password check of a known user times out rather than failing the
+	// password
+	start = time.Now()
+	matched, err = passwordMatches(context.Background(), stalledClients, user, "somePassword")
+	assert.False(t, matched)
+	assert.Equal(t, http.StatusGatewayTimeout, storageErrorStatus(err))
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Authorisation times out rather than denying the permission
+	start = time.Now()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("POST", "/suspend", nil)
+	authorised, err := clientAuthorised(stalledClients, c, user, permClientsSuspend, nil)
+	assert.False(t, authorised)
+	assert.Equal(t, http.StatusGatewayTimeout, storageErrorStatus(err))
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Audit events are neither appended, queried nor verified past the timeout
+	start = time.Now()
+	err = appendAuditEvent(context.Background(), stalledClients, &AuditEvent{Action: "login", Outcome: auditFailure, Time: time.Now()})
+	assert.Equal(t, http.StatusGatewayTimeout, storageErrorStatus(err))
+	_, err = findAuditEvents(context.Background(), stalledClients, bson.M{}, 10)
+	assert.Equal(t, http.StatusGatewayTimeout, storageErrorStatus(err))
+	_, _, err = verifyAuditLog(context.Background(), stalledClients)
+	assert.Equal(t, http.StatusGatewayTimeout, storageErrorStatus(err))
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// The audit events recorded by the requests are not waited on either
+	start = time.Now()
+	waitForAuditEvents()
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Requests whose client disconnected are not waited on
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(ctx, "GET", "/me", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	stalledHandler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestHandlersReturnPromptlyWhenCacheStalls(t *testing.T) {
+	proxy := newStallingProxy(t, os.Getenv("REDIS_HOST")+":"+os.Getenv("REDIS_PORT"))
+	defer proxy.listener.Close()
+
+	// A handler whose cache is reached through the proxy
+	stalledCache := redis.NewClient(&redis.Options{
+		Addr:     proxy.listener.Addr().String(),
+		Password: os.Getenv("REDIS_PASSWORD"),
+	})
+	defer stalledCache.Close()
+	assert.NoError(t, stalledCache.Ping(context.Background()).Err())
+	stalledHandler := createHandler(clients, stalledCache)
+
+	timeout := cacheOperationTimeout
+	cacheOperationTimeout = 200 * time.Millisecond
+	defer func() { cacheOperationTimeout = timeout }()
+
+	email := genRandomEmail()
+	registerAndLogin(email, `{"email": "`+email+`", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`)
+	nonce, token := requestMagicLink(t, email)
+	proxy.setStalled(true)
+	defer proxy.setStalled(false)
+
+	// Cache operations time out
+	start := time.Now()
+	cacheCtx, cancel := cacheContext(context.Background())
+	defer cancel()
+	err := stalledCache.Get(cacheCtx, email).Err()
+	assert.Equal(t, http.StatusGatewayTimeout, storageErrorStatus(err))
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// A login link whose use cannot be recorded is refused rather than usable
+	// again
+	start = time.Now()
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/magic-link/consume?token="+token, nil)
+	req.AddCookie(nonce)
+	stalledHandler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Requesting a login link is not held up by the rate limit counter
+	start = time.Now()
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/magic-link", strings.NewReader(`{"email": "`+email+`"}`))
+	stalledHandler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -18,6 +20,32 @@ type SuspendForm struct {
 	Id string `json:"id" validate:"required"`
 }
 
+// suspendClient flags a client as suspended and blacklists it. As service
+// tokens never expire services are blacklisted indefinitely.
+func suspendClient(ctx context.Context, clients *mongo.Collection, rdb *redis.Client, client *Client, suspendedBy primitive.ObjectID) error {
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if _, err := clients.UpdateOne(dbCtx, bson.M{"_id": client.Id}, bson.M{"$set": bson.M{"suspended": true}}); err != nil {
+		return err
+	}
+	blacklistClient(ctx, rdb, client)
+	recordSuspension(ctx, clients, client.Id, suspendedBy)
+	dispatchWebhookEvent(clients, webhookClientSuspended, gin.H{"clientId": client.Id.Hex(), "suspendedBy": suspendedBy.Hex()})
+	return nil
+}
+
+// reactivateClient lifts the suspension of a client
+func reactivateClient(ctx context.Context, clients *mongo.Collection, rdb *redis.Client, client *Client) error {
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if _, err := clients.UpdateOne(dbCtx, bson.M{"_id": client.Id}, bson.M{"$set": bson.M{"suspended": false}}); err != nil {
+		return err
+	}
+	cacheCtx, cancel := cacheContext(ctx)
+	defer cancel()
+	return rdb.Del(cacheCtx, client.Id.Hex()).Err()
+}
+
 // suspendUser is an only admin accessible handler for suspending a user
 func makeSuspendClient(users *mongo.Collection, rdb *redis.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -32,21 +60,37 @@ func makeSuspendClient(users *mongo.Collection, rdb *redis.Client) gin.HandlerFu
 			return
 		}
 
-		status, _ := authAndAuthorisedAdmin(users, claim)
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unable to parse JSON payload"})
+			return
+		}
+
+		// Authorization policies may depend on the client being suspended
+		target, err := getClientByIdOrEmail(c.Request.Context(), users, "", form.Id, "")
+		status, admin := authorise(users, c, claim, permClientsSuspend, target)
 
 		if status != http.StatusOK {
-			// Get the JSON body and decode into credentials
+			recordAudit(users, c, AuditEvent{Action: "suspend", ActorId: claim.Id, TargetId: form.Id, Outcome: auditFailure, Reason: "not authorised"})
 			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
 			return
 		}
 
-		// Now that we have validate that the user making the request is an admin, we can suspend the user he is requesting to suspend
-		if err := c.ShouldBindJSON(&form); err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unable to parse JSON payload"})
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Client not found"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to suspend user")
 			return
 		}
 
-		rdb.Set(context.Background(), form.Id, form.Id, jwtTokenExpiration)
+		// Now that we have validated that the client making the request is authorised, we can suspend the client it is requesting to suspend
+		if err := suspendClient(c.Request.Context(), users, rdb, target, admin.Id); err != nil {
+			abortWithStorageError(c, err, "Unable to suspend user")
+			return
+		}
+		applyOwnerRemovalPolicy(c.Request.Context(), users, rdb, target.Id, admin.Id, false)
+		recordAudit(users, c, AuditEvent{Action: "suspend", ActorId: admin.Id.Hex(), TargetId: form.Id, Outcome: auditSuccess})
 		c.JSON(http.StatusOK, gin.H{"message": "Successfully suspended user"})
 	}
 }
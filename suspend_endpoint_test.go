@@ -31,7 +31,7 @@ func TestSuccessfulSuspend(t *testing.T) {
 	// Get admin user valid token to append to request
 	adminId := result.InsertedID.(primitive.ObjectID).Hex()
 
-	adminToken, _ := genToken(adminId, []string{"admin"})
+	adminToken := issueTestToken(t, adminId)
 
 	// Create a non-admin user
 
@@ -65,6 +65,11 @@ func TestSuccessfulSuspend(t *testing.T) {
 	// check if the user is in the blacklist
 	assert.Equal(t, id.InsertedID.(primitive.ObjectID).Hex(), x.Val())
 
+	// The suspension is persisted along with the blacklist
+	user := &Client{}
+	clients.FindOne(context.Background(), bson.M{"_id": id.InsertedID}).Decode(user)
+	assert.True(t, user.Suspended)
+
 	// A succeful suspend is a correct response code and the user is in the blacklist in redis (the actual responsibility of suspending authorisation is at the gateway level)
 }
 
@@ -94,7 +99,7 @@ func TestFailedNonAdminSuspend(t *testing.T) {
 		{Key: "groups", Value: []string{""}},
 	})
 
-	user1Token, _ := genToken(result1.InsertedID.(primitive.ObjectID).Hex(), []string{""})
+	user1Token := issueTestToken(t, result1.InsertedID.(primitive.ObjectID).Hex())
 
 	// Test that one non-admin user cannot suspend the other
 	suspendPayload := `{"id": "` + result2.InsertedID.(primitive.ObjectID).Hex() + `"}`
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Several products can share a deployment as tenants (organizations). Every
+// client belongs to a tenant, given by the X-Tenant-Id header when registering
+// and logging in, and the same email address can be registered in different
+// tenants. Clients without a tenant belong to the default tenant, whose
+// settings are given by the env variables.
+//
+// Groups are defined per tenant, and admins of a tenant can only act on the
+// clients of their tenant with the tenant permissions (see permissions.go).
+// Admins of the default tenant administer the whole deployment.
+
+// tenantHeader is the header identifying the tenant of unauthenticated requests
+const tenantHeader = "X-Tenant-Id"
+
+// Tenant describes an organization clients belong to
+type Tenant struct {
+	Id        string         `bson:"_id" json:"id"`
+	Name      string         `bson:"name" json:"name"`
+	Settings  TenantSettings `bson:"settings" json:"settings"`
+	CreatedAt time.Time      `bson:"createdAt" json:"createdAt"`
+}
+
+// TenantSettings describes the token lifetime, registration policy and password
+// policy of a tenant. Unset token lifetime and password length fall back on the
+// settings of the default tenant.
+type TenantSettings struct {
+	TokenLifetimeMinutes     int      `bson:"tokenLifetimeMinutes,omitempty" json:"tokenLifetimeMinutes,omitempty" validate:"omitempty,min=1"`
+	DefaultGroups            []string `bson:"defaultGroups" json:"defaultGroups"`
+	SelfSelectableGroups     []string `bson:"selfSelectableGroups" json:"selfSelectableGroups"`
+	PasswordMinLength        int      `bson:"passwordMinLength,omitempty" json:"passwordMinLength,omitempty" validate:"omitempty,min=8,max=64"`
+	PasswordRequireDigit     bool     `bson:"passwordRequireDigit" json:"passwordRequireDigit"`
+	PasswordRequireUppercase bool     `bson:"passwordRequireUppercase" json:"passwordRequireUppercase"`
+	PasswordRequireSymbol    bool     `bson:"passwordRequireSymbol" json:"passwordRequireSymbol"`
+}
+
+// TenantForm describes the expected JSON payload when an admin creates a tenant
+type TenantForm struct {
+	Id       string         `json:"id" validate:"required,alphanum,max=32"`
+	Name     string         `json:"name" validate:"required"`
+	Settings TenantSettings `json:"settings"`
+}
+
+// getTenantCollection returns the collection tenants are stored in
+func getTenantCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("tenants")
+}
+
+// defaultTenantSettings returns the settings of the default tenant
+func defaultTenantSettings() TenantSettings {
+	return TenantSettings{
+		TokenLifetimeMinutes: int(jwtTokenExpiration / time.Minute),
+		DefaultGroups:        registrationDefaultGroups,
+		SelfSelectableGroups: registrationSelfSelectableGroups,
+		PasswordMinLength:    8,
+	}
+}
+
+// requestTenant returns the tenant an unauthenticated request is made to
+func requestTenant(c *gin.Context) string {
+	return c.GetHeader(tenantHeader)
+}
+
+// tenantFilter returns the filter matching the clients of a tenant. Clients of
+// the default tenant have no tenant ID.
+func tenantFilter(tenantId string) bson.M {
+	if tenantId == "" {
+		return bson.M{"tenantId": bson.M{"$exists": false}}
+	}
+	return bson.M{"tenantId": tenantId}
+}
+
+// getTenant returns a tenant by its ID
+func getTenant(ctx context.Context, clients *mongo.Collection, id string) (*Tenant, error) {
+	tenant := &Tenant{}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	err := getTenantCollection(clients).FindOne(dbCtx, bson.M{"_id": id}).Decode(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// getTenantSettings returns the settings of a tenant
+func getTenantSettings(ctx context.Context, clients *mongo.Collection, tenantId string) (TenantSettings, error) {
+	defaults := defaultTenantSettings()
+	if tenantId == "" {
+		return defaults, nil
+	}
+
+	tenant, err := getTenant(ctx, clients, tenantId)
+	if err != nil {
+		return TenantSettings{}, err
+	}
+	settings := tenant.Settings
+	if settings.TokenLifetimeMinutes == 0 {
+		settings.TokenLifetimeMinutes = defaults.TokenLifetimeMinutes
+	}
+	if settings.PasswordMinLength == 0 {
+		settings.PasswordMinLength = defaults.PasswordMinLength
+	}
+	return settings, nil
+}
+
+// tokenLifetime returns how long the tokens issued to users are valid for
+func (s TenantSettings) tokenLifetime() time.Duration {
+	return time.Duration(s.TokenLifetimeMinutes) * time.Minute
+}
+
+// checkPassword checks a password against the password policy
+func (s TenantSettings) checkPassword(password string) error {
+	if len(password) < s.PasswordMinLength {
+		return errors.New("password must be at least " + strconv.Itoa(s.PasswordMinLength) + " characters long")
+	}
+	hasDigit, hasUpper, hasSymbol := false, false, false
+	for _, r := range password {
+		hasDigit = hasDigit || unicode.IsDigit(r)
+		hasUpper = hasUpper || unicode.IsUpper(r)
+		hasSymbol = hasSymbol || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	}
+	missing := []string{}
+	if s.PasswordRequireDigit && !hasDigit {
+		missing = append(missing, "a digit")
+	}
+	if s.PasswordRequireUppercase && !hasUpper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if s.PasswordRequireSymbol && !hasSymbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return errors.New("password must contain " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validateTenantSettings checks the settings of a tenant. Tokens cannot be
+// valid for longer than JWT_TOKEN_EXP_MIN as suspended clients are blacklisted
+// for that long.
+func validateTenantSettings(validate *validator.Validate, settings TenantSettings) error {
+	if err := validate.Struct(settings); err != nil {
+		return err
+	}
+	if settings.tokenLifetime() > jwtTokenExpiration {
+		return errors.New("token lifetime cannot exceed " + jwtTokenExpiration.String())
+	}
+	return nil
+}
+
+// authoriseTenantRequest processes the token cookie of the request and checks
+// the client is granted the permission. It aborts the request and returns false
+// if not.
+func authoriseTenantRequest(c *gin.Context, clients *mongo.Collection, permission string) (*Client, bool) {
+	token, _ := c.Cookie("token")
+	code, claim := processClaim(token)
+	if code != http.StatusOK {
+		c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+		return nil, false
+	}
+
+	status, admin := authorise(clients, c, claim, permission, nil)
+	if status != http.StatusOK {
+		c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+		return nil, false
+	}
+	return admin, true
+}
+
+// makeCreateTenantHandler creates a tenant
+func makeCreateTenantHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form TenantForm
+
+		admin, ok := authoriseTenantRequest(c, clients, permTenantsManage)
+		if !ok {
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		if err := validateTenantSettings(validate, form.Settings); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		tenant := &Tenant{Id: form.Id, Name: form.Name, Settings: form.Settings, CreatedAt: time.Now()}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		_, err := getTenantCollection(clients).InsertOne(dbCtx, tenant)
+		if mongo.IsDuplicateKeyError(err) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "A tenant with the ID already exists"})
+			return
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to create tenant")
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "create-tenant", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: tenant.Id})
+		c.JSON(http.StatusCreated, gin.H{"tenant": tenant})
+	}
+}
+
+// makeListTenantsHandler lists the tenants
+func makeListTenantsHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authoriseTenantRequest(c, clients, permTenantsManage); !ok {
+			return
+		}
+
+		tenants := []Tenant{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getTenantCollection(clients).Find(dbCtx, bson.M{})
+		if err == nil {
+			err = cursor.All(dbCtx, &tenants)
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list tenants")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"tenants": tenants})
+	}
+}
+
+// makePutTenantSettingsHandler replaces the settings of a tenant. Admins of a
+// tenant can only change the settings of their own tenant.
+func makePutTenantSettingsHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var settings TenantSettings
+
+		admin, ok := authoriseTenantRequest(c, clients, permSettingsManage)
+		if !ok {
+			return
+		}
+		if admin.TenantId != "" && admin.TenantId != c.Param("id") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&settings); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validateTenantSettings(validate, settings); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := getTenantCollection(clients).UpdateOne(dbCtx, bson.M{"_id": c.Param("id")}, bson.M{"$set": bson.M{"settings": settings}})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to update tenant settings")
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Tenant not found"})
+			return
+		}
+
+		recordAudit(clients, c, AuditEvent{Action: "update-tenant-settings", ActorId: admin.Id.Hex(), Outcome: auditSuccess, Reason: c.Param("id")})
+		c.JSON(http.StatusOK, gin.H{"settings": settings})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestTenant creates a tenant with the given settings as an admin of the
+// default tenant and returns its ID
+func createTestTenant(t *testing.T, settings string) string {
+	_, adminToken := insertTestClient(t, []string{"admin"})
+	id := "tenant" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	recorder := httptest.NewRecorder()
+	payload := `{"id": "` + id + `", "name": "Product", "settings": ` + settings + `}`
+	req, _ := http.NewRequest("POST", "/tenants", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+	return id
+}
+
+func TestSameEmailInDifferentTenants(t *testing.T) {
+	tenantId := createTestTenant(t, `{"tokenLifetimeMinutes": 5}`)
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+
+	// The email is registered in the default tenant and in the new tenant
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	req.Header.Set(tenantHeader, tenantId)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	// Logging in to the tenant issues a token carrying the tenant, valid for
+	// the token lifetime of the tenant
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+email+`", "password": "somePassword"}`))
+	req.Header.Set(tenantHeader, tenantId)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	claim := &Claim{}
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "token" {
+			jwt.ParseWithClaims(cookie.Value, claim, func(token *jwt.Token) (interface{}, error) {
+				return jwtKey, nil
+			})
+		}
+	}
+	assert.Equal(t, tenantId, claim.TenantId)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), claim.ExpiresAt.Time, time.Minute)
+}
+
+func TestTenantPasswordPolicy(t *testing.T) {
+	tenantId := createTestTenant(t, `{"passwordMinLength": 12, "passwordRequireDigit": true}`)
+
+	recorder := httptest.NewRecorder()
+	user := `{"email": "` + genRandomEmail() + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	req.Header.Set(tenantHeader, tenantId)
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"message":"password must contain a digit"}`, recorder.Body.String())
+}
+
+func TestTenantAdminScopedToTenant(t *testing.T) {
+	tenantId := createTestTenant(t, `{}`)
+
+	// An admin of the default tenant registers an admin of the new tenant
+	_, platformToken := insertTestClient(t, []string{"admin"})
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": ["admin"]}`
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	req.Header.Set(tenantHeader, tenantId)
+	req.AddCookie(&http.Cookie{Name: "token", Value: platformToken})
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, `{"message":"User registered successfully"}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(`{"email": "`+email+`", "password": "somePassword"}`))
+	req.Header.Set(tenantHeader, tenantId)
+	handler.ServeHTTP(recorder, req)
+	var tenantAdmin *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == "token" {
+			tenantAdmin = cookie
+		}
+	}
+
+	// The tenant admin cannot suspend a client of the default tenant
+	otherId, _ := insertTestClient(t, []string{})
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/suspend", strings.NewReader(`{"id": "`+otherId.Hex()+`"}`))
+	req.AddCookie(tenantAdmin)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	// Nor read the audit log of the deployment
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/audit", nil)
+	req.AddCookie(tenantAdmin)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
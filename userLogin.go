@@ -32,60 +32,130 @@ func makeLoginHandler(users *mongo.Collection, validate *validator.Validate) gin
 			return
 		}
 
-		// Get the user details from the database
-		user, err := getClientByEmail(users, form.Email)
+		// Get the user details from the database, in the tenant of the request
+		user, err := getClientByEmail(c.Request.Context(), users, requestTenant(c), form.Email)
 		if err == mongo.ErrNoDocuments {
+			recordAudit(users, c, AuditEvent{Action: "login", Outcome: auditFailure, Reason: "unknown email"})
 			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "User not found"})
 			return
 		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to get user")
+			return
+		}
 
 		// Compare the provided password with the stored hashed password, if they do not match return an "Unauthorized"
 		// status and an incorrect password message
-		validPass := verifyPassword(user.HashedPassword, form.Password)
+		validPass, err := passwordMatches(c.Request.Context(), users, user, form.Password)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to check password")
+			return
+		}
 		if !validPass {
+			recordAudit(users, c, AuditEvent{Action: "login", TargetId: user.Id.Hex(), Outcome: auditFailure, Reason: "incorrect password"})
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Incorrect password"})
 			return
 		}
 
-		// Check if user is suspended. If suspended, do not issue a token
-		if user.Suspended {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "User account suspended"})
+		if !loginAllowed(users, c, user) {
 			return
 		}
 
-		// Declare the expiration time of the token as determined by the jwtTokenExpiration variable
-		expirationTime := time.Now().Add(jwtTokenExpiration)
-
-		// Create the JWT claims, which includes the authenticated user ID and expiry time
-		claims := &Claim{
-			Id:     user.Id.Hex(),
-			Groups: user.Groups,
-			RegisteredClaims: jwt.RegisteredClaims{
-				// In JWT, the expiry time is expressed as unix milliseconds
-				ExpiresAt: jwt.NewNumericDate(expirationTime),
-			},
-		}
-
-		// Create the token with the HS256 algorithm used for signing, and the created claim
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-		// Create the JWT string
-		tokenString, err := token.SignedString(jwtKey)
-		if err != nil {
-			// If there is an error in creating the JWT return an internal server error
+		if err := setLoginCookie(users, c, user); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to create token"})
 			return
 		}
 
-		// Finally, we set the client cookie for "token" as the JWT we just generated we also set an expiry time which is
-		// the same as the token itself
-		c.SetCookie("token", tokenString, int(expirationTime.Unix()), "/", "localhost", false, true)
 		c.JSON(http.StatusOK, gin.H{"message": "Successfully logged in"})
 	}
 }
 
-func makeLogoutHandler() gin.HandlerFunc {
+// loginAllowed checks a token can be issued to a user. It records the failed
+// login and aborts the request if not.
+func loginAllowed(users *mongo.Collection, c *gin.Context, user *Client) bool {
+	// Check if user is suspended. If suspended, do not issue a token
+	if user.Suspended {
+		recordAudit(users, c, AuditEvent{Action: "login", TargetId: user.Id.Hex(), Outcome: auditFailure, Reason: "account suspended"})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "User account suspended"})
+		return false
+	}
+
+	// Do not issue a token to a user whose account is scheduled for deletion
+	// or being deleted
+	if user.DeletionState != "" {
+		recordAudit(users, c, AuditEvent{Action: "login", TargetId: user.Id.Hex(), Outcome: auditFailure, Reason: "account scheduled for deletion"})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "User account is scheduled for deletion"})
+		return false
+	}
+	return true
+}
+
+// issueLoginToken issues a token to a user and records the login
+func issueLoginToken(users *mongo.Collection, c *gin.Context, user *Client) (string, time.Time, error) {
+	// Declare the expiration time of the token as determined by the kind of the
+	// user and the settings of its tenant
+	settings, err := getTenantSettings(c.Request.Context(), users, user.TenantId)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expirationTime := now.Add(clientTokenLifetime(user, settings))
+
+	// Create the JWT claims, which includes the authenticated user ID, issue
+	// time (used to require a recent login) and expiry time
+	claims := &Claim{
+		Id:       user.Id.Hex(),
+		Version:  user.TokenVersion,
+		TenantId: user.TenantId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt: jwt.NewNumericDate(now),
+			// In JWT, the expiry time is expressed as unix milliseconds
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+	}
+
+	// Include the groups and/or permissions of the user as configured
+	if err := setClaimGroups(c.Request.Context(), users, user, claims); err != nil {
+		return "", time.Time{}, err
+	}
+
+	// Create the token with the HS256 algorithm used for signing, and the created claim
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	// Create the JWT string
+	tokenString, err := token.SignedString(jwtKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	recordLogin(c.Request.Context(), users, user, c)
+	recordAudit(users, c, AuditEvent{Action: "login", ActorId: user.Id.Hex(), TargetId: user.Id.Hex(), Outcome: auditSuccess})
+	dispatchWebhookEvent(users, webhookClientLogin, gin.H{"clientId": user.Id.Hex(), "ip": c.ClientIP()})
+	return tokenString, expirationTime, nil
+}
+
+// setLoginCookie issues a token to a user, records the login and sets the
+// token cookie
+func setLoginCookie(users *mongo.Collection, c *gin.Context, user *Client) error {
+	tokenString, expirationTime, err := issueLoginToken(users, c, user)
+	if err != nil {
+		return err
+	}
+
+	// Finally, we set the client cookie for "token" as the JWT we just generated we also set an expiry time which is
+	// the same as the token itself
+	c.SetCookie("token", tokenString, int(expirationTime.Unix()), "/", "localhost", false, true)
+	return nil
+}
+
+func makeLogoutHandler(users *mongo.Collection) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Record who logged out if the token is still valid
+		token, _ := c.Cookie("token")
+		if code, claim := processClaim(token); code == http.StatusOK {
+			recordAudit(users, c, AuditEvent{Action: "logout", ActorId: claim.Id, TargetId: claim.Id, Outcome: auditSuccess})
+		}
+
 		// Clear the token cookie by setting cookie to expiry now
 		c.SetCookie("token", "", 0, "/", "localhost", false, true)
 		c.JSON(http.StatusOK, gin.H{"message": "Successfully logged out"})
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admins can subscribe external systems (CRM, billing, analytics etc.) to client
+// lifecycle events. Every matching event creates a delivery which is POSTed to
+// the subscription URL with an HMAC-SHA256 signature of the payload computed
+// with the subscription secret:
+//
+//	X-Webhook-Signature: sha256=hex(hmac(secret, timestamp + "." + body))
+//
+// Failed deliveries are retried with exponential backoff and are moved to the
+// dead-letter list once they exhaust their attempts.
+
+// Client lifecycle events webhooks can subscribe to
+const (
+	webhookClientRegistered = "client.registered"
+	webhookClientLogin      = "client.login"
+	webhookClientSuspended  = "client.suspended"
+	webhookClientRestored   = "client.restored"
+	webhookClientDeleted    = "client.deleted"
+
+	webhookClientPasswordChanged = "client.password_changed"
+)
+
+// webhookEvents lists the events a subscription can filter on
+var webhookEvents = []string{
+	webhookClientRegistered,
+	webhookClientLogin,
+	webhookClientSuspended,
+	webhookClientRestored,
+	webhookClientDeleted,
+	webhookClientPasswordChanged,
+}
+
+// Webhook delivery statuses
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookDead      = "dead"
+)
+
+// Retry policy for failed webhook deliveries. A delivery being attempted is
+// leased for webhookDeliveryLease so that it is not attempted twice at once.
+const (
+	webhookRetryBaseDelay   = 10 * time.Second
+	webhookRetryMaxDelay    = time.Hour
+	webhookRetryMaxAttempts = 8
+	webhookRetryInterval    = 5 * time.Second
+	webhookDeliveryLease    = time.Minute
+)
+
+// Maximum number of deliveries returned by the delivery log endpoints
+const webhookDeliveryLogLimit = 500
+
+// webhookHTTPClient is used to deliver webhooks, the timeout stops a slow
+// receiver from holding up deliveries
+var webhookHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookForm describes the expected JSON payload when an admin subscribes to
+// client lifecycle events
+type WebhookForm struct {
+	URL    string   `json:"url" validate:"required,url"`
+	Events []string `json:"events" validate:"required,min=1"`
+}
+
+// WebhookSubscription describes an endpoint subscribed to client lifecycle
+// events
+type WebhookSubscription struct {
+	Id        primitive.ObjectID `bson:"_id" json:"id"`
+	URL       string             `bson:"url" json:"url"`
+	Events    []string           `bson:"events" json:"events"`
+	Secret    string             `bson:"secret" json:"-"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// WebhookDelivery describes the delivery of an event to a subscription
+type WebhookDelivery struct {
+	Id             primitive.ObjectID `bson:"_id" json:"id"`
+	SubscriptionId primitive.ObjectID `bson:"subscriptionId" json:"subscriptionId"`
+	Event          string             `bson:"event" json:"event"`
+	Payload        string             `bson:"payload" json:"payload"`
+	Status         string             `bson:"status" json:"status"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	NextAttempt    time.Time          `bson:"nextAttempt" json:"nextAttempt"`
+	LastStatusCode int                `bson:"lastStatusCode,omitempty" json:"lastStatusCode,omitempty"`
+	LastError      string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	CreatedAt      time.Time          `bson:"createdAt" json:"createdAt"`
+	DeliveredAt    *time.Time         `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+}
+
+// getWebhookCollection returns the collection webhook subscriptions are stored in
+func getWebhookCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("webhooks")
+}
+
+// getWebhookDeliveryCollection returns the collection webhook deliveries are
+// stored in
+func getWebhookDeliveryCollection(clients *mongo.Collection) *mongo.Collection {
+	return clients.Database().Collection("webhookDeliveries")
+}
+
+// signWebhookPayload returns the signature of a payload sent at the given unix
+// timestamp
+func signWebhookPayload(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// dispatchWebhookEvent creates a delivery of the event for every subscription
+// filtering on it and attempts the deliveries in the background. Failing to
+// dispatch an event is logged but does not fail the request. The deliveries
+// are created even if the request is cancelled once the event has occurred.
+func dispatchWebhookEvent(clients *mongo.Collection, event string, data gin.H) {
+	dbCtx, cancel := dbBulkContext(context.Background())
+	defer cancel()
+	cursor, err := getWebhookCollection(clients).Find(dbCtx, bson.M{"events": event})
+	if err != nil {
+		log.Println("Unable to query webhook subscriptions: ", err)
+		return
+	}
+	var subscriptions []WebhookSubscription
+	if err := cursor.All(dbCtx, &subscriptions); err != nil {
+		log.Println("Unable to decode webhook subscriptions: ", err)
+		return
+	}
+
+	now := time.Now()
+	for _, subscription := range subscriptions {
+		delivery := &WebhookDelivery{
+			Id:             primitive.NewObjectID(),
+			SubscriptionId: subscription.Id,
+			Event:          event,
+			Status:         webhookPending,
+			NextAttempt:    now,
+			CreatedAt:      now,
+		}
+		payload, _ := json.Marshal(gin.H{"id": delivery.Id.Hex(), "event": event, "time": now, "data": data})
+		delivery.Payload = string(payload)
+
+		insertCtx, cancelInsert := dbContext(context.Background())
+		_, err := getWebhookDeliveryCollection(clients).InsertOne(insertCtx, delivery)
+		cancelInsert()
+		if err != nil {
+			log.Println("Unable to create webhook delivery: ", err)
+			continue
+		}
+		go attemptWebhookDelivery(clients, delivery.Id)
+	}
+}
+
+// claimWebhookDelivery leases a pending delivery that is due so that only one
+// attempt is made at a time
+func claimWebhookDelivery(clients *mongo.Collection, id primitive.ObjectID) (*WebhookDelivery, error) {
+	now := time.Now()
+	delivery := &WebhookDelivery{}
+	dbCtx, cancel := dbContext(context.Background())
+	defer cancel()
+	err := getWebhookDeliveryCollection(clients).FindOneAndUpdate(dbCtx,
+		bson.M{"_id": id, "status": webhookPending, "nextAttempt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextAttempt": now.Add(webhookDeliveryLease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(delivery)
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// sendWebhook POSTs a delivery to the subscription URL and returns the status
+// code of the response
+func sendWebhook(subscription *WebhookSubscription, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.Id.Hex())
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhookPayload(subscription.Secret, timestamp, delivery.Payload))
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("receiver responded with " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// attemptWebhookDelivery makes a delivery attempt and records its outcome. A
+// failed delivery is rescheduled with exponential backoff or, once it exhausts
+// its attempts, moved to the dead-letter list.
+func attemptWebhookDelivery(clients *mongo.Collection, id primitive.ObjectID) {
+	delivery, err := claimWebhookDelivery(clients, id)
+	if err != nil {
+		// Not due, already delivered or being attempted elsewhere
+		return
+	}
+
+	deliveries := getWebhookDeliveryCollection(clients)
+	subscription := &WebhookSubscription{}
+	dbCtx, cancel := dbContext(context.Background())
+	err = getWebhookCollection(clients).FindOne(dbCtx, bson.M{"_id": delivery.SubscriptionId}).Decode(subscription)
+	cancel()
+	if err != nil {
+		// The subscription was removed, there is nowhere to deliver to
+		dbCtx, cancel = dbContext(context.Background())
+		defer cancel()
+		deliveries.UpdateOne(dbCtx, bson.M{"_id": delivery.Id}, bson.M{"$set": bson.M{"status": webhookDead, "lastError": "subscription removed"}})
+		return
+	}
+
+	statusCode, err := sendWebhook(subscription, delivery)
+	update := bson.M{"lastStatusCode": statusCode}
+	switch {
+	case err == nil:
+		update["status"] = webhookDelivered
+		update["deliveredAt"] = time.Now()
+	case delivery.Attempts >= webhookRetryMaxAttempts:
+		update["status"] = webhookDead
+		update["lastError"] = err.Error()
+	default:
+		update["nextAttempt"] = time.Now().Add(exponentialBackoff(webhookRetryBaseDelay, webhookRetryMaxDelay, delivery.Attempts))
+		update["lastError"] = err.Error()
+	}
+
+	dbCtx, cancel = dbContext(context.Background())
+	defer cancel()
+	if _, err := deliveries.UpdateOne(dbCtx, bson.M{"_id": delivery.Id}, bson.M{"$set": update}); err != nil {
+		log.Println("Unable to update webhook delivery: ", err)
+	}
+}
+
+// retryWebhookDeliveries attempts every pending delivery that is due
+func retryWebhookDeliveries(clients *mongo.Collection) {
+	filter := bson.M{"status": webhookPending, "nextAttempt": bson.M{"$lte": time.Now()}}
+	dbCtx, cancel := dbBulkContext(context.Background())
+	defer cancel()
+	cursor, err := getWebhookDeliveryCollection(clients).Find(dbCtx, filter)
+	if err != nil {
+		log.Println("Unable to query webhook deliveries: ", err)
+		return
+	}
+	var due []WebhookDelivery
+	if err := cursor.All(dbCtx, &due); err != nil {
+		log.Println("Unable to decode webhook deliveries: ", err)
+		return
+	}
+
+	for _, delivery := range due {
+		attemptWebhookDelivery(clients, delivery.Id)
+	}
+}
+
+// runWebhookWorker periodically retries failed webhook deliveries. This is a
+// blocking call and is expected to be run in its own goroutine.
+func runWebhookWorker(clients *mongo.Collection) {
+	ticker := time.NewTicker(webhookRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		retryWebhookDeliveries(clients)
+	}
+}
+
+// findWebhookDeliveries returns the deliveries matching the filter, most recent
+// first
+func findWebhookDeliveries(ctx context.Context, clients *mongo.Collection, filter bson.M) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(webhookDeliveryLogLimit)
+	dbCtx, cancel := dbBulkContext(ctx)
+	defer cancel()
+	cursor, err := getWebhookDeliveryCollection(clients).Find(dbCtx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(dbCtx, &deliveries)
+	return deliveries, err
+}
+
+// makeCreateWebhookHandler is an admin only handler subscribing a URL to client
+// lifecycle events. The generated signing secret is only returned once.
+func makeCreateWebhookHandler(clients *mongo.Collection, validate *validator.Validate) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form WebhookForm
+
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permWebhooksManage, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid JSON payload"})
+			return
+		}
+
+		if err := validate.Struct(form); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+
+		for _, event := range form.Events {
+			if !contains(webhookEvents, event) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Unknown event: " + event})
+				return
+			}
+		}
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Unable to generate webhook secret"})
+			return
+		}
+
+		subscription := &WebhookSubscription{
+			Id:        primitive.NewObjectID(),
+			URL:       form.URL,
+			Events:    form.Events,
+			Secret:    hex.EncodeToString(secret),
+			CreatedAt: time.Now(),
+		}
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		if _, err := getWebhookCollection(clients).InsertOne(dbCtx, subscription); err != nil {
+			abortWithStorageError(c, err, "Unable to create webhook")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"webhook": subscription, "secret": subscription.Secret})
+	}
+}
+
+// makeListWebhooksHandler is an admin only handler listing webhook subscriptions
+func makeListWebhooksHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permWebhooksManage, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		subscriptions := []WebhookSubscription{}
+		dbCtx, cancel := dbBulkContext(c.Request.Context())
+		defer cancel()
+		cursor, err := getWebhookCollection(clients).Find(dbCtx, bson.M{})
+		if err == nil {
+			err = cursor.All(dbCtx, &subscriptions)
+		}
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list webhooks")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"webhooks": subscriptions})
+	}
+}
+
+// makeDeleteWebhookHandler is an admin only handler removing a webhook
+// subscription
+func makeDeleteWebhookHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permWebhooksManage, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Webhook not found"})
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := getWebhookCollection(clients).DeleteOne(dbCtx, bson.M{"_id": objID})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to delete webhook")
+			return
+		}
+		if result.DeletedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Webhook not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully deleted webhook"})
+	}
+}
+
+// makeWebhookDeliveriesHandler is an admin only handler returning the delivery
+// log of a webhook subscription
+func makeWebhookDeliveriesHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permWebhooksManage, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Webhook not found"})
+			return
+		}
+
+		deliveries, err := findWebhookDeliveries(c.Request.Context(), clients, bson.M{"subscriptionId": objID})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list webhook deliveries")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	}
+}
+
+// makeDeadLettersHandler is an admin only handler returning the deliveries that
+// permanently failed
+func makeDeadLettersHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permWebhooksManage, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		deliveries, err := findWebhookDeliveries(c.Request.Context(), clients, bson.M{"status": webhookDead})
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to list dead letters")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	}
+}
+
+// makeRedeliverWebhookHandler is an admin only handler requeuing a dead letter
+// for delivery
+func makeRedeliverWebhookHandler(clients *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie("token")
+		code, claim := processClaim(token)
+		if code != http.StatusOK {
+			c.AbortWithStatusJSON(code, gin.H{"message": "Unable to process JWT token"})
+			return
+		}
+
+		if status, _ := authorise(clients, c, claim, permWebhooksManage, nil); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"message": "You are not authorised to perform this action"})
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Dead letter not found"})
+			return
+		}
+
+		dbCtx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+		result, err := getWebhookDeliveryCollection(clients).UpdateOne(dbCtx,
+			bson.M{"_id": objID, "status": webhookDead},
+			bson.M{"$set": bson.M{"status": webhookPending, "attempts": 0, "nextAttempt": time.Now()}},
+		)
+		if err != nil {
+			abortWithStorageError(c, err, "Unable to requeue delivery")
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Dead letter not found"})
+			return
+		}
+
+		go attemptWebhookDelivery(clients, objID)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Delivery requeued"})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// createTestWebhook subscribes the URL to the events as an admin and returns
+// the created subscription and its signing secret
+func createTestWebhook(t *testing.T, url string, events string) (*WebhookSubscription, string) {
+	adminHashedPass, _ := hashAndSalt("somePassword")
+	result, _ := clients.InsertOne(context.Background(), bson.D{
+		{Key: "email", Value: genRandomEmail()},
+		{Key: "hashedPassword", Value: adminHashedPass},
+		{Key: "firstName", Value: "John"},
+		{Key: "lastName", Value: "Smith"},
+		{Key: "groups", Value: []string{"admin"}},
+	})
+	adminToken := issueTestToken(t, result.InsertedID.(primitive.ObjectID).Hex())
+
+	recorder := httptest.NewRecorder()
+	payload := `{"url": "` + url + `", "events": ` + events + `}`
+	req, _ := http.NewRequest("POST", "/webhooks", strings.NewReader(payload))
+	req.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	handler.ServeHTTP(recorder, req)
+
+	var body struct {
+		Webhook *WebhookSubscription `json:"webhook"`
+		Secret  string               `json:"secret"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return body.Webhook, body.Secret
+}
+
+func TestWebhookDeliveredOnRegistration(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   string
+	}
+	deliveries := make(chan received, 10)
+
+	// Receiver standing in for an external system
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- received{header: r.Header, body: string(body)}
+	}))
+	defer receiver.Close()
+
+	webhook, secret := createTestWebhook(t, receiver.URL, `["client.registered"]`)
+	defer getWebhookCollection(clients).DeleteOne(context.Background(), bson.M{"_id": webhook.Id})
+
+	// Register a new user
+	email := genRandomEmail()
+	recorder := httptest.NewRecorder()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+	req, _ := http.NewRequest("POST", "/register-user", strings.NewReader(user))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	select {
+	case delivery := <-deliveries:
+		assert.Equal(t, "client.registered", delivery.header.Get("X-Webhook-Event"))
+		assert.Contains(t, delivery.body, email)
+
+		// The signature can be verified with the subscription secret
+		expected := signWebhookPayload(secret, delivery.header.Get("X-Webhook-Timestamp"), delivery.body)
+		assert.Equal(t, expected, delivery.header.Get("X-Webhook-Signature"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not delivered")
+	}
+
+	// The delivery log records the successful delivery
+	assert.Eventually(t, func() bool {
+		logged, _ := findWebhookDeliveries(context.Background(), clients, bson.M{"subscriptionId": webhook.Id})
+		return len(logged) == 1 && logged[0].Status == webhookDelivered
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestFailingWebhookMovedToDeadLetters(t *testing.T) {
+	// Receiver that always fails
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	webhook, _ := createTestWebhook(t, receiver.URL, `["client.login"]`)
+	defer getWebhookCollection(clients).DeleteOne(context.Background(), bson.M{"_id": webhook.Id})
+
+	email := genRandomEmail()
+	user := `{"email": "` + email + `", "password": "somePassword",
+				"firstName": "John", "lastName": "Smith", "groups": []}`
+	registerAndLogin(email, user)
+
+	// The first attempt fails and the delivery is rescheduled
+	var delivery WebhookDelivery
+	assert.Eventually(t, func() bool {
+		logged, _ := findWebhookDeliveries(context.Background(), clients, bson.M{"subscriptionId": webhook.Id})
+		if len(logged) != 1 || logged[0].Attempts != 1 || logged[0].LastStatusCode == 0 {
+			return false
+		}
+		delivery = logged[0]
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Equal(t, webhookPending, delivery.Status)
+	assert.Equal(t, http.StatusInternalServerError, delivery.LastStatusCode)
+
+	// Exhaust the attempts of the delivery and retry it
+	getWebhookDeliveryCollection(clients).UpdateOne(context.Background(), bson.M{"_id": delivery.Id},
+		bson.M{"$set": bson.M{"attempts": webhookRetryMaxAttempts - 1, "nextAttempt": time.Now()}})
+	retryWebhookDeliveries(clients)
+
+	deadLetters, _ := findWebhookDeliveries(context.Background(), clients, bson.M{"status": webhookDead, "_id": delivery.Id})
+	assert.Len(t, deadLetters, 1)
+}
+
+func TestWebhookDeliveredOnPasswordChange(t *testing.T) {
+	deliveries := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- string(body)
+	}))
+	defer receiver.Close()
+
+	webhook, _ := createTestWebhook(t, receiver.URL, `["client.password_changed"]`)
+	defer getWebhookCollection(clients).DeleteOne(context.Background(), bson.M{"_id": webhook.Id})
+
+	email := genRandomEmail()
+	cookie := registerAndLogin(email, `{"email": "`+email+`", "password": "somePassword", "firstName": "John", "lastName": "Smith", "groups": []}`)
+	client := &Client{}
+	clients.FindOne(context.Background(), bson.M{"email": email}).Decode(client)
+
+	awaitDelivery := func() {
+		select {
+		case body := <-deliveries:
+			assert.Contains(t, body, client.Id.Hex())
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook was not delivered")
+		}
+	}
+
+	// Replace the password with another login method and link a new one
+	identities := listIdentities(cookie)
+	recorder := sendWithCookie("POST", "/me/identities", `{"method": "api-key"}`, cookie)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	recorder = sendWithCookie("DELETE", "/me/identities/"+identities[0].Id.Hex(), "", cookie)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = sendWithCookie("POST", "/me/identities", `{"method": "password", "password": "someNewPassword"}`, cookie)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	awaitDelivery()
+
+	// Passwords set by provisioning are notified too
+	assert.NoError(t, setPassword(context.Background(), clients, client, "someOtherPassword"))
+	awaitDelivery()
+}